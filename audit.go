@@ -0,0 +1,214 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// AuditSuccess is the outcome of an audited action that succeeded
+	AuditSuccess = "success"
+	// AuditFailure is the outcome of an audited action that failed or was denied
+	AuditFailure = "failure"
+	// AuditUnknown is the outcome of an audited action whose result isn't known, e.g. when it was only requested
+	AuditUnknown = "unknown"
+)
+
+// The meta key the schema of an audit event is logged under
+const MetaKeyAudit = "audit"
+
+// The meta key the problems of an incomplete audit event are logged under, see IPageV2.AuditEvent
+const MetaKeyAuditProblems = "auditProblems"
+
+// The name of the audit handler set with SetAuditHandler in the diary statistics
+const auditHandlerName = "audit"
+
+// A public struct to encapsulate an audit event, the actor is always the auth of the page chain [NOTE: The actor is empty for pages without auth, e.g. scheduled jobs.]
+//
+// - Action: What the actor did, e.g. "order.delete"
+// - Target: What the action was performed on, e.g. "order/42"
+// - Outcome: Either AuditSuccess, AuditFailure or AuditUnknown
+// - Reason: Why the action had the outcome, e.g. "insufficient permissions" (may be empty)
+// - Meta: Any other additional data of the event (may be empty) [WARNING: Don't ever log personal data without first encrypting or salt-hashing the data.]
+type AuditEvent struct {
+	Action  string
+	Target  string
+	Outcome string
+	Reason  string
+	Meta    M
+}
+
+// A public struct to encapsulate every problem found with an audit event
+type AuditError struct {
+	Problems []string
+}
+
+func (e AuditError) Error() string {
+	return fmt.Sprintf("invalid audit event:\n - %s", strings.Join(e.Problems, "\n - "))
+}
+
+// validate reports every problem with the audit event
+func (e AuditEvent) validate() []string {
+	var problems []string
+	if strings.TrimSpace(e.Action) == "" {
+		problems = append(problems, "action: may not be empty")
+	}
+	if strings.TrimSpace(e.Target) == "" {
+		problems = append(problems, "target: may not be empty")
+	}
+	switch e.Outcome {
+	case AuditSuccess, AuditFailure, AuditUnknown:
+	default:
+		problems = append(problems, fmt.Sprintf("outcome: unknown outcome %q (expected success, failure or unknown)", e.Outcome))
+	}
+	return problems
+}
+
+// schema returns the audit event as the value logged under MetaKeyAudit
+func (e AuditEvent) schema(actor Auth) M {
+	schema := M{
+		"actor": M{
+			"type":       actor.Type,
+			"identifier": actor.Identifier,
+		},
+		"action":  e.Action,
+		"target":  e.Target,
+		"outcome": e.Outcome,
+	}
+	if e.Reason != "" {
+		schema["reason"] = e.Reason
+	}
+	return schema
+}
+
+// A private function used to read the action, target, outcome and reason of an audit entry for formatters with audit fields
+func auditFields(log Log) (action, target, outcome, reason string) {
+	var schema map[string]interface{}
+	switch value := log.Meta[MetaKeyAudit].(type) {
+	case M:
+		schema = value
+	case map[string]interface{}:
+		schema = value
+	default:
+		return "", "", "", ""
+	}
+	action, _ = schema["action"].(string)
+	target, _ = schema["target"].(string)
+	outcome, _ = schema["outcome"].(string)
+	reason, _ = schema["reason"].(string)
+	return action, target, outcome, reason
+}
+
+// A private struct to encapsulate the audit handler given to a diary instance, see IDiaryV2.SetAuditHandler
+type auditor struct {
+	handler atomic.Pointer[func(log Log) error]
+}
+
+// SetAuditHandler sets the handler that audit entries are delivered to synchronously, failures are returned by IPageV2.AuditEvent
+// Audit handlers configured with Config.Audit take precedence
+//
+// - handler: (may be nil) [NOTE: If nil audit entries are only sent to the regular handlers.]
+func (d diary) SetAuditHandler(handler H) {
+	if handler == nil {
+		d.auditor.handler.Store(nil)
+		return
+	}
+	deliver := d.monitor.deliver(auditHandlerName, handler, LevelTrace, nil)
+	d.auditor.handler.Store(&deliver)
+}
+
+// audit delivers an audit entry to the audit handlers and then to the regular handlers
+// The entry always reaches the regular handlers, even if an audit handler fails
+//
+// - return: The prepared entry and the failure of the audit handlers, if any
+func (d diary) audit(s *settings, log Log) (Log, error) {
+	log = d.prepare(s, log)
+	d.monitor.level(LevelAudit).emitted.Add(1)
+
+	deliver := s.Audit
+	if deliver == nil {
+		if h := d.auditor.handler.Load(); h != nil {
+			deliver = *h
+		}
+	}
+	var err error
+	if deliver != nil {
+		if d.lifecycle.closed.Load() {
+			err = ErrClosed
+		} else {
+			err = deliver(log)
+		}
+	}
+	d.dispatch(s, log)
+	return log, err
+}
+
+// used to track specific events for auditing, audit entries are never filtered or sampled
+// The entry is delivered to the audit handlers synchronously like AuditEvent, failures are passed on to the fallback sink, see IDiaryV2.SetFallback
+func (p page) Audit(category string, meta M) {
+	if meta == nil {
+		meta = M{}
+	}
+	log, err := p.Diary.audit(p.settings, Log{
+		Service:  p.Diary.Service,
+		Commit:   p.Diary.Commit,
+		Chain:    p.Chain,
+		Level:    TextLevelAudit,
+		Category: joinCategory(p.Category, category),
+		Line:     callerLine(1),
+		Stack:    "",
+		Message:  "",
+		Meta:     p.meta(meta),
+		Time:     time.Now(),
+	})
+	if err != nil && !errors.Is(err, ErrClosed) {
+		// entries of a closed diary instance are already written to stderr
+		p.Diary.monitor.fail(auditHandlerName, log, err)
+	}
+}
+
+// used to track specific events for auditing with a fixed schema, audit entries are never filtered or sampled
+// The entry is delivered to the audit handlers synchronously, see IDiaryV2.SetAuditHandler
+// An incomplete event is still logged, with its problems under MetaKeyAuditProblems, so that it's never lost
+//
+// - return: An AuditError if the event is incomplete, otherwise the failure of an audit handler
+func (p page) AuditEvent(category string, event AuditEvent) error {
+	cat := joinCategory(p.Category, category)
+
+	actor := p.Chain.Auth
+	problems := event.validate()
+	meta := make(M, len(event.Meta)+2)
+	for key, value := range event.Meta {
+		meta[key] = value
+	}
+	meta[MetaKeyAudit] = event.schema(actor)
+	if len(problems) > 0 {
+		meta[MetaKeyAuditProblems] = problems
+	}
+
+	_, err := p.Diary.audit(p.settings, Log{
+		Service:  p.Diary.Service,
+		Commit:   p.Diary.Commit,
+		Chain:    p.Chain,
+		Level:    TextLevelAudit,
+		Category: cat,
+		Line:     callerLine(1),
+		Stack:    "",
+		Message:  strings.TrimSpace(fmt.Sprintf("%s %s %s: %s", actor.Identifier, event.Action, event.Target, event.Outcome)),
+		Meta:     p.meta(meta),
+		Time:     time.Now(),
+	})
+	if len(problems) > 0 && err != nil {
+		return errors.Join(AuditError{Problems: problems}, err)
+	} else if len(problems) > 0 {
+		return AuditError{Problems: problems}
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var (
+	_ IDiaryV2 = diary{}
+	_ IPageV2  = page{}
+)
+
+func TestAudit(t *testing.T) {
+	var logged, audited []Log
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelError, func(log Log) { logged = append(logged, log) })
+	d.SetAuditHandler(func(log Log) { audited = append(audited, log) })
+
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(page IPage) {
+		p := page.(IPageV2)
+
+		// the original free-form call still reaches the audit handler
+		p.Audit("export", M{"rows": 3})
+
+		// pages without auth are audited with an empty actor
+		if err := p.AuditEvent("export", AuditEvent{Action: "report.export", Target: "report/1", Outcome: AuditSuccess}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		// incomplete events are logged and reported
+		var invalid AuditError
+		if err := p.AuditEvent("export", AuditEvent{Target: "report/2", Outcome: "maybe"}); !errors.As(err, &invalid) || len(invalid.Problems) != 2 {
+			t.Errorf("expected an AuditError with 2 problems, got %v", err)
+		}
+	})
+
+	if len(audited) != 3 {
+		t.Fatalf("expected 3 audited entries, got %d", len(audited))
+	}
+	for _, log := range audited {
+		if log.Level != TextLevelAudit {
+			t.Errorf("audit entry %q logged at %s", log.Category, log.Level)
+		}
+	}
+	if audited[0].Meta["rows"] != 3 {
+		t.Errorf("free-form audit meta is %v", audited[0].Meta)
+	}
+	if _, ok := audited[2].Meta[MetaKeyAuditProblems]; !ok {
+		t.Errorf("incomplete audit event logged without its problems: %v", audited[2].Meta)
+	}
+
+	audits := 0
+	for _, log := range logged {
+		if log.Level == TextLevelAudit {
+			audits++
+		}
+	}
+	if audits != 3 {
+		t.Errorf("expected the regular handler to receive 3 audit entries, got %d", audits)
+	}
+}
+
+func TestAuditHandlerFailure(t *testing.T) {
+	var fallback []Log
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelError, func(log Log) {})
+	d.SetFallback(func(log Log) { fallback = append(fallback, log) })
+	d.SetAuditHandler(func(log Log) { ReportFailure(log, errors.New("disk full")) })
+
+	d.Page(-1, 0, false, "jobs", nil, "user", "42", nil, func(page IPage) {
+		page.Audit("export", nil)
+		if err := page.(IPageV2).AuditEvent("export", AuditEvent{Action: "report.export", Target: "report/1", Outcome: AuditSuccess}); err == nil {
+			t.Error("expected the failure of the audit handler")
+		}
+	})
+
+	if len(fallback) != 1 || fallback[0].Meta[MetaKeyHandlerError] == nil {
+		t.Errorf("expected the failed free-form audit entry at the fallback sink, got %v", fallback)
+	}
+}
+
+func TestSiemAuditTarget(t *testing.T) {
+	log := Log{
+		Chain:    Chain{Auth: Auth{Type: "user", Identifier: "42"}},
+		Level:    TextLevelAudit,
+		Category: "orders",
+		Meta:     M{MetaKeyAudit: AuditEvent{Action: "order.delete", Target: "order/7", Outcome: AuditSuccess}.schema(Auth{Type: "user", Identifier: "42"})},
+	}
+	cef, err := CefFormatter{}.Format(nil, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(cef), " cs1Label=target cs1=order/7") || strings.Contains(string(cef), "duser=") {
+		t.Errorf("expected the audit target as cs1 and no duser: %s", cef)
+	}
+	leef, err := LeefFormatter{}.Format(nil, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(leef), "\ttarget=order/7") || strings.Contains(string(leef), "duser=") {
+		t.Errorf("expected the audit target as target and no duser: %s", leef)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"io"
+	"testing"
+)
+
+// benchPage runs the benchmark inside a page of a diary instance that writes JSON to io.Discard
+func benchPage(b *testing.B, level int, bench func(b *testing.B, p IPage)) {
+	d := Dear("uprate", "diary", "bench", M{"region": "eu"}, "github.com/go-diary/diary", "abc123", []string{"v1.0.0"}, M{"branch": "main"}, level, WriterHandler(io.Discard, JsonFormatter{}))
+	d.Page(-1, 0, false, "bench", nil, "user", "42", nil, func(p IPage) {
+		b.ReportAllocs()
+		b.ResetTimer()
+		bench(b, p)
+	})
+}
+
+func BenchmarkInfoDisabled(b *testing.B) {
+	meta := M{"id": 7}
+	benchPage(b, LevelNotice, func(b *testing.B, p IPage) {
+		for i := 0; i < b.N; i++ {
+			p.Info("order", meta)
+		}
+	})
+}
+
+func BenchmarkDebugDisabled(b *testing.B) {
+	benchPage(b, LevelInfo, func(b *testing.B, p IPage) {
+		for i := 0; i < b.N; i++ {
+			p.Debug("order", 7)
+		}
+	})
+}
+
+func BenchmarkInfoEnabled(b *testing.B) {
+	meta := M{"id": 7, "name": "order", "total": 12.5}
+	benchPage(b, LevelInfo, func(b *testing.B, p IPage) {
+		for i := 0; i < b.N; i++ {
+			p.Info("order", meta)
+		}
+	})
+}
+
+func BenchmarkInfoEnabledNilMeta(b *testing.B) {
+	benchPage(b, LevelInfo, func(b *testing.B, p IPage) {
+		for i := 0; i < b.N; i++ {
+			p.Info("order", nil)
+		}
+	})
+}
+
+func BenchmarkNoticeEnabledWithFields(b *testing.B) {
+	meta := M{"id": 7}
+	benchPage(b, LevelInfo, func(b *testing.B, p IPage) {
+		p = p.(IPageV2).With(M{"tenant": "acme"})
+		for i := 0; i < b.N; i++ {
+			p.Notice("order", meta)
+		}
+	})
+}
+
+func BenchmarkInfoEnabledConvertedServiceMeta(b *testing.B) {
+	// the service meta is converted by the limits, the converted copy is still only encoded once
+	d := Dear("uprate", "diary", "bench", M{"build": struct{ Version string }{"1.0.0"}}, "github.com/go-diary/diary", "abc123", nil, nil, LevelInfo, WriterHandler(io.Discard, JsonFormatter{}))
+	meta := M{"id": 7}
+	d.Page(-1, 0, false, "bench", nil, "", "", nil, func(p IPage) {
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			p.Info("order", meta)
+		}
+	})
+}
+
+func BenchmarkInfoEnabledTwoDiaries(b *testing.B) {
+	// the encoded service and commit details are kept per diary instance, so alternating instances don't evict each other
+	first := Dear("uprate", "diary", "first", nil, "", "", nil, nil, LevelInfo, WriterHandler(io.Discard, JsonFormatter{}))
+	second := Dear("uprate", "diary", "second", nil, "", "", nil, nil, LevelInfo, WriterHandler(io.Discard, JsonFormatter{}))
+	meta := M{"id": 7}
+	first.Page(-1, 0, false, "bench", nil, "", "", nil, func(p IPage) {
+		second.Page(-1, 0, false, "bench", nil, "", "", nil, func(q IPage) {
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p.Info("order", meta)
+				q.Info("order", meta)
+			}
+		})
+	})
+}
+
+func BenchmarkJsonFormatter(b *testing.B) {
+	log := Log{
+		Service: Service{Client: "uprate", Project: "diary", Service: "bench", Host: "web-1", HostIps: []string{"10.0.0.1"}, Meta: M{"region": "eu"}},
+		Commit:  Commit{Repository: "github.com/go-diary/diary", Hash: "abc123", Tags: []string{"v1.0.0"}, Meta: M{}},
+		Chain:   Chain{Id: "chain-1", Meta: M{}, Auth: Auth{Meta: M{}}},
+		Level:   TextLevelInfo,
+		Meta:    M{"id": 7, "name": "order"},
+	}
+	buffer := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer, _ = JsonFormatter{}.Format(buffer[:0], log)
+	}
+}
@@ -0,0 +1,439 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// An definition of the primitives a binary encoding has to provide to encode log entries
+// Log entries are encoded with a stable layout shared by every binary encoding, see appendBinaryLog
+type binaryEncoder interface {
+	appendMap(dst []byte, size int) []byte
+	appendArray(dst []byte, size int) []byte
+	appendString(dst []byte, value string) []byte
+	appendBytes(dst []byte, value []byte) []byte
+	appendInt(dst []byte, value int64) []byte
+	appendUint(dst []byte, value uint64) []byte
+	appendFloat(dst []byte, value float64) []byte
+	appendBool(dst []byte, value bool) []byte
+	appendNil(dst []byte) []byte
+	appendTime(dst []byte, value time.Time) []byte
+}
+
+// The maximum nesting of arrays, maps and tags a binary decoder accepts, so that crafted input can't overflow the stack
+const binaryMaxDepth = 100
+
+// An definition of the routine a binary encoding has to provide to decode log entries
+// Values are decoded into nil, bool, int64, uint64, float64, string, []byte, time.Time, []interface{} or map[string]interface{}
+//
+// - depth: The nesting of the value, values nested deeper than binaryMaxDepth are rejected
+type binaryDecoder interface {
+	decodeValue(data []byte, depth int) (interface{}, []byte, error)
+}
+
+// A private function used to append a log entry as a map with a fixed key order
+// The keys and nesting match the JSON output of the DefaultHandler
+func appendBinaryLog(e binaryEncoder, dst []byte, log Log) ([]byte, error) {
+	var err error
+	size := 10
+	if log.Template != "" {
+		size++
+	}
+	if len(log.Frames) > 0 {
+		size++
+	}
+	if log.Fingerprint != "" {
+		size++
+	}
+	dst = e.appendMap(dst, size)
+
+	dst = e.appendString(dst, "service")
+	dst = e.appendMap(dst, 8)
+	dst = e.appendString(e.appendString(dst, "client"), log.Service.Client)
+	dst = e.appendString(e.appendString(dst, "project"), log.Service.Project)
+	dst = e.appendString(e.appendString(dst, "service"), log.Service.Service)
+	dst = e.appendString(e.appendString(dst, "host"), log.Service.Host)
+	dst = appendBinaryStrings(e, e.appendString(dst, "hostIps"), log.Service.HostIps)
+	dst = e.appendInt(e.appendString(dst, "pid"), int64(log.Service.ProcessId))
+	dst = e.appendInt(e.appendString(dst, "ppid"), int64(log.Service.ParentProcessId))
+	if dst, err = appendBinaryMeta(e, e.appendString(dst, "meta"), log.Service.Meta); err != nil {
+		return dst, err
+	}
+
+	dst = e.appendString(dst, "commit")
+	dst = e.appendMap(dst, 4)
+	dst = e.appendString(e.appendString(dst, "repository"), log.Commit.Repository)
+	dst = e.appendString(e.appendString(dst, "hash"), log.Commit.Hash)
+	dst = appendBinaryStrings(e, e.appendString(dst, "tags"), log.Commit.Tags)
+	if dst, err = appendBinaryMeta(e, e.appendString(dst, "meta"), log.Commit.Meta); err != nil {
+		return dst, err
+	}
+
+	dst = e.appendString(dst, "chain")
+	dst = e.appendMap(dst, 3)
+	dst = e.appendString(e.appendString(dst, "id"), log.Chain.Id)
+	if dst, err = appendBinaryMeta(e, e.appendString(dst, "meta"), log.Chain.Meta); err != nil {
+		return dst, err
+	}
+	dst = e.appendString(dst, "auth")
+	dst = e.appendMap(dst, 3)
+	dst = e.appendString(e.appendString(dst, "type"), log.Chain.Auth.Type)
+	dst = e.appendString(e.appendString(dst, "identifier"), log.Chain.Auth.Identifier)
+	if dst, err = appendBinaryMeta(e, e.appendString(dst, "meta"), log.Chain.Auth.Meta); err != nil {
+		return dst, err
+	}
+
+	dst = e.appendString(e.appendString(dst, "level"), log.Level)
+	dst = e.appendString(e.appendString(dst, "category"), log.Category)
+	dst = e.appendString(e.appendString(dst, "line"), log.Line)
+	dst = e.appendString(e.appendString(dst, "stack"), log.Stack)
+	if len(log.Frames) > 0 {
+		dst = appendBinaryFrames(e, e.appendString(dst, "frames"), log.Frames)
+	}
+	if log.Fingerprint != "" {
+		dst = e.appendString(e.appendString(dst, "fingerprint"), log.Fingerprint)
+	}
+	dst = e.appendString(e.appendString(dst, "message"), log.Message)
+	if log.Template != "" {
+		dst = e.appendString(e.appendString(dst, "template"), log.Template)
+	}
+	if dst, err = appendBinaryMeta(e, e.appendString(dst, "meta"), log.Meta); err != nil {
+		return dst, err
+	}
+	dst = e.appendTime(e.appendString(dst, "time"), log.Time)
+	return dst, nil
+}
+
+// A private function used to append stack frames, optional fields are omitted like JSON omits them
+func appendBinaryFrames(e binaryEncoder, dst []byte, frames []Frame) []byte {
+	dst = e.appendArray(dst, len(frames))
+	for _, frame := range frames {
+		size := 3
+		if frame.Module != "" {
+			size++
+		}
+		if frame.Version != "" {
+			size++
+		}
+		dst = e.appendMap(dst, size)
+		dst = e.appendString(e.appendString(dst, "function"), frame.Function)
+		dst = e.appendString(e.appendString(dst, "file"), frame.File)
+		dst = e.appendInt(e.appendString(dst, "line"), int64(frame.Line))
+		if frame.Module != "" {
+			dst = e.appendString(e.appendString(dst, "module"), frame.Module)
+		}
+		if frame.Version != "" {
+			dst = e.appendString(e.appendString(dst, "version"), frame.Version)
+		}
+	}
+	return dst
+}
+
+// A private function used to append a list of strings, nil is encoded as nil like JSON
+func appendBinaryStrings(e binaryEncoder, dst []byte, values []string) []byte {
+	if values == nil {
+		return e.appendNil(dst)
+	}
+	dst = e.appendArray(dst, len(values))
+	for _, value := range values {
+		dst = e.appendString(dst, value)
+	}
+	return dst
+}
+
+// A private function used to append meta with its keys in sorted order, nil is encoded as nil like JSON
+func appendBinaryMeta(e binaryEncoder, dst []byte, meta map[string]interface{}) ([]byte, error) {
+	if meta == nil {
+		return e.appendNil(dst), nil
+	}
+	var err error
+	dst = e.appendMap(dst, len(meta))
+	for _, key := range sortedKeys(meta) {
+		dst = e.appendString(dst, key)
+		if dst, err = appendBinaryValue(e, dst, meta[key]); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// A private function used to append a single meta value
+// Types without a native binary form are encoded the same way encoding/json would encode them
+func appendBinaryValue(e binaryEncoder, dst []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return e.appendNil(dst), nil
+	case bool:
+		return e.appendBool(dst, v), nil
+	case string:
+		return e.appendString(dst, v), nil
+	case []byte:
+		return e.appendBytes(dst, v), nil
+	case int:
+		return e.appendInt(dst, int64(v)), nil
+	case int8:
+		return e.appendInt(dst, int64(v)), nil
+	case int16:
+		return e.appendInt(dst, int64(v)), nil
+	case int32:
+		return e.appendInt(dst, int64(v)), nil
+	case int64:
+		return e.appendInt(dst, v), nil
+	case uint:
+		return e.appendUint(dst, uint64(v)), nil
+	case uint8:
+		return e.appendUint(dst, uint64(v)), nil
+	case uint16:
+		return e.appendUint(dst, uint64(v)), nil
+	case uint32:
+		return e.appendUint(dst, uint64(v)), nil
+	case uint64:
+		return e.appendUint(dst, v), nil
+	case float32:
+		return appendBinaryFloat(e, dst, float64(v))
+	case float64:
+		return appendBinaryFloat(e, dst, v)
+	case time.Time:
+		return e.appendTime(dst, v), nil
+	case M:
+		return appendBinaryMeta(e, dst, v)
+	case map[string]interface{}:
+		return appendBinaryMeta(e, dst, v)
+	case []string:
+		return appendBinaryStrings(e, dst, v), nil
+	case []interface{}:
+		if v == nil {
+			return e.appendNil(dst), nil
+		}
+		var err error
+		dst = e.appendArray(dst, len(v))
+		for _, item := range v {
+			if dst, err = appendBinaryValue(e, dst, item); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	}
+
+	// fall back on the JSON representation so that the binary and JSON output stay equivalent
+	data, err := json.Marshal(value)
+	if err != nil {
+		return dst, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return dst, err
+	}
+	return appendBinaryValue(e, dst, jsonNumbers(generic))
+}
+
+// A private function used to reject the float values that JSON can't represent either
+func appendBinaryFloat(e binaryEncoder, dst []byte, value float64) ([]byte, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return dst, fmt.Errorf("unsupported value: %v", value)
+	}
+	return e.appendFloat(dst, value), nil
+}
+
+// A private function used to replace json.Number values with int64, uint64 or float64 values
+func jsonNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonNumbers(item)
+		}
+	}
+	return value
+}
+
+// A private function used to read a big endian unsigned integer of the given number of bytes
+func binaryUint(data []byte, size int) (uint64, []byte, error) {
+	if len(data) < size {
+		return 0, data, fmt.Errorf("unexpected end of data")
+	}
+	var value uint64
+	for _, b := range data[:size] {
+		value = value<<8 | uint64(b)
+	}
+	return value, data[size:], nil
+}
+
+// A private function used to decode a single log entry, returning the bytes that follow it
+func decodeBinaryLog(d binaryDecoder, data []byte) (Log, []byte, error) {
+	value, rest, err := d.decodeValue(data, 0)
+	if err != nil {
+		return Log{}, rest, err
+	}
+	root, ok := value.(map[string]interface{})
+	if !ok {
+		return Log{}, rest, fmt.Errorf("expected a map but got %T", value)
+	}
+
+	r := binaryReader{}
+	service := r.object(root, "service")
+	commit := r.object(root, "commit")
+	chain := r.object(root, "chain")
+	auth := r.object(chain, "auth")
+	log := Log{
+		Service: Service{
+			Client:          r.string(service, "client"),
+			Project:         r.string(service, "project"),
+			Service:         r.string(service, "service"),
+			Host:            r.string(service, "host"),
+			HostIps:         r.strings(service, "hostIps"),
+			ProcessId:       r.int(service, "pid"),
+			ParentProcessId: r.int(service, "ppid"),
+			Meta:            r.meta(service, "meta"),
+		},
+		Commit: Commit{
+			Repository: r.string(commit, "repository"),
+			Hash:       r.string(commit, "hash"),
+			Tags:       r.strings(commit, "tags"),
+			Meta:       r.meta(commit, "meta"),
+		},
+		Chain: Chain{
+			Id:   r.string(chain, "id"),
+			Meta: r.meta(chain, "meta"),
+			Auth: Auth{
+				Type:       r.string(auth, "type"),
+				Identifier: r.string(auth, "identifier"),
+				Meta:       r.meta(auth, "meta"),
+			},
+		},
+		Level:       r.string(root, "level"),
+		Category:    r.string(root, "category"),
+		Line:        r.string(root, "line"),
+		Stack:       r.string(root, "stack"),
+		Frames:      r.frames(root, "frames"),
+		Fingerprint: r.string(root, "fingerprint"),
+		Message:     r.string(root, "message"),
+		Template:    r.string(root, "template"),
+		Meta:        r.meta(root, "meta"),
+		Time:        r.time(root, "time"),
+	}
+	return log, rest, r.err
+}
+
+// A private struct used to read typed fields from a decoded map, keeping the first error
+type binaryReader struct {
+	err error
+}
+
+func (r *binaryReader) fail(key string, value interface{}, expected string) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%s: expected %s but got %T", key, expected, value)
+	}
+}
+
+func (r *binaryReader) object(m map[string]interface{}, key string) map[string]interface{} {
+	value, ok := m[key].(map[string]interface{})
+	if !ok && m[key] != nil {
+		r.fail(key, m[key], "a map")
+	}
+	return value
+}
+
+func (r *binaryReader) string(m map[string]interface{}, key string) string {
+	value, ok := m[key].(string)
+	if !ok && m[key] != nil {
+		r.fail(key, m[key], "a string")
+	}
+	return value
+}
+
+func (r *binaryReader) strings(m map[string]interface{}, key string) []string {
+	list, ok := m[key].([]interface{})
+	if !ok {
+		if m[key] != nil {
+			r.fail(key, m[key], "a list")
+		}
+		return nil
+	}
+	values := make([]string, 0, len(list))
+	for _, item := range list {
+		value, ok := item.(string)
+		if !ok {
+			r.fail(key, item, "a string")
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+func (r *binaryReader) frames(m map[string]interface{}, key string) []Frame {
+	list, ok := m[key].([]interface{})
+	if !ok {
+		if m[key] != nil {
+			r.fail(key, m[key], "a list")
+		}
+		return nil
+	}
+	frames := make([]Frame, 0, len(list))
+	for _, item := range list {
+		value, ok := item.(map[string]interface{})
+		if !ok {
+			r.fail(key, item, "a map")
+		}
+		frames = append(frames, Frame{
+			Function: r.string(value, "function"),
+			File:     r.string(value, "file"),
+			Line:     r.int(value, "line"),
+			Module:   r.string(value, "module"),
+			Version:  r.string(value, "version"),
+		})
+	}
+	return frames
+}
+
+func (r *binaryReader) int(m map[string]interface{}, key string) int {
+	switch v := m[key].(type) {
+	case int64:
+		return int(v)
+	case uint64:
+		return int(v)
+	case nil:
+		return 0
+	}
+	r.fail(key, m[key], "an integer")
+	return 0
+}
+
+func (r *binaryReader) meta(m map[string]interface{}, key string) M {
+	value, ok := m[key].(map[string]interface{})
+	if !ok {
+		if m[key] != nil {
+			r.fail(key, m[key], "a map")
+		}
+		return nil
+	}
+	return M(value)
+}
+
+func (r *binaryReader) time(m map[string]interface{}, key string) time.Time {
+	value, ok := m[key].(time.Time)
+	if !ok && m[key] != nil {
+		r.fail(key, m[key], "a timestamp")
+	}
+	return value
+}
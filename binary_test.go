@@ -0,0 +1,211 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The binary formats and their decoders under test
+var binaryFormats = map[string]struct {
+	formatter Formatter
+	decode    func(data []byte) (Log, []byte, error)
+}{
+	"cbor":    {CborFormatter{}, DecodeCbor},
+	"msgpack": {MsgpackFormatter{}, DecodeMsgpack},
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	times := []time.Time{
+		time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC),
+		time.Date(2023, 11, 14, 22, 13, 20, 123456789, time.UTC),
+		time.Date(2023, 11, 14, 22, 13, 20, 1, time.UTC),
+		time.Date(1969, 7, 20, 20, 17, 40, 999999999, time.UTC),
+		time.Date(2600, 1, 1, 0, 0, 0, 500, time.UTC),
+	}
+
+	for name, format := range binaryFormats {
+		for _, moment := range times {
+			log := Log{
+				Service:     Service{Client: "uprate", Project: "diary", Service: "api", Host: "web-1", HostIps: []string{"10.0.0.1"}, ProcessId: 42, ParentProcessId: 1, Meta: M{"region": "eu"}},
+				Commit:      Commit{Repository: "github.com/uprate/diary", Hash: "abc123", Tags: []string{"v1.0.0"}, Meta: M{}},
+				Chain:       Chain{Id: "chain-1", Meta: M{}, Auth: Auth{Type: "user", Identifier: "42", Meta: M{}}},
+				Level:       TextLevelError,
+				Category:    "orders",
+				Line:        "/app/orders.go:12",
+				Stack:       "goroutine 1 [running]:",
+				Frames:      []Frame{{Function: "main.main", File: "/app/main.go", Line: 3}},
+				Fingerprint: "f00d",
+				Message:     "order failed",
+				Template:    "order {id} failed",
+				Meta:        M{"id": int64(7), "at": moment, "tags": []interface{}{"a", int64(-1)}},
+				Time:        moment,
+			}
+
+			data, err := format.formatter.Format([]byte{}, log)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			// a second record checks that records are self-delimiting
+			data, err = format.formatter.Format(data, log)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			for i := 0; i < 2; i++ {
+				var decoded Log
+				decoded, data, err = format.decode(data)
+				if err != nil {
+					t.Fatalf("%s %s: %v", name, moment, err)
+				}
+				if !decoded.Time.Equal(moment) {
+					t.Errorf("%s: time %s decoded as %s", name, moment.Format(time.RFC3339Nano), decoded.Time.Format(time.RFC3339Nano))
+				}
+				if at, _ := decoded.Meta["at"].(time.Time); !at.Equal(moment) {
+					t.Errorf("%s: meta time %s decoded as %v", name, moment.Format(time.RFC3339Nano), decoded.Meta["at"])
+				}
+				decoded.Time, decoded.Meta["at"], log.Meta["at"] = log.Time, nil, nil
+				if !reflect.DeepEqual(decoded, log) {
+					t.Errorf("%s: decoded\n%#v\nexpected\n%#v", name, decoded, log)
+				}
+				log.Meta["at"] = moment
+			}
+			if len(data) != 0 {
+				t.Errorf("%s: %d bytes left over", name, len(data))
+			}
+		}
+	}
+}
+
+// genericJson decodes JSON into generic values, numbers are compared as float64
+func genericJson(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		t.Fatalf("invalid json %s: %v", data, err)
+	}
+	return value
+}
+
+func TestBinaryJsonEquivalence(t *testing.T) {
+	moment := time.Date(2023, 11, 14, 22, 13, 20, 123456789, time.UTC)
+	log := Log{
+		Service:     Service{Client: "uprate", Project: "diary", Service: "api", Host: "web-1", HostIps: []string{"10.0.0.1"}, ProcessId: 42, ParentProcessId: 1, Meta: M{"region": "eu"}},
+		Commit:      Commit{Repository: "github.com/uprate/diary", Hash: "abc123", Meta: M{}},
+		Chain:       Chain{Id: "chain-1", Meta: M{"request": "r-1"}, Auth: Auth{Type: "user", Identifier: "42", Meta: M{}}},
+		Level:       TextLevelError,
+		Category:    "orders",
+		Line:        "/app/orders.go:12",
+		Frames:      []Frame{{Function: "main.main", File: "/app/main.go", Line: 3, Module: "example.com/app"}},
+		Fingerprint: "f00d",
+		Message:     "order failed",
+		Template:    "order {id} failed",
+		Meta: M{
+			"id":     int64(-7),
+			"total":  19.5,
+			"paid":   false,
+			"note":   nil,
+			"at":     moment,
+			"items":  []interface{}{"a", int64(1), M{"sku": "x-1"}},
+			"nested": M{"deep": M{"unicode": "héllo ☃"}},
+		},
+		Time: moment,
+	}
+
+	expected, err := JsonFormatter{}.Format(nil, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, format := range binaryFormats {
+		data, err := format.formatter.Format(nil, log)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var value interface{}
+		switch name {
+		case "cbor":
+			value, _, err = cbor{}.decodeValue(data, 0)
+		case "msgpack":
+			value, _, err = msgpack{}.decodeValue(data, 0)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// times are rendered the way the JSON output renders them
+		converted, err := json.Marshal(value)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got, want := genericJson(t, converted), genericJson(t, expected); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: decoded\n%s\nexpected the JSON output\n%s", name, converted, expected)
+		}
+	}
+}
+
+func TestBinaryCraftedLengths(t *testing.T) {
+	inputs := map[string][]string{
+		"cbor": {
+			"9bffffffffffffffff",               // array with a length that overflows an int
+			"bbffffffffffffffff",               // map with a length that overflows an int
+			"9b7fffffffffffffff00",             // array longer than the data
+			"7bffffffffffffffff",               // text longer than the data
+			"5a00010000",                       // bytes longer than the data
+			"9a",                               // truncated length
+			strings.Repeat("81", 1<<20) + "00", // arrays nested deeper than the stack allows
+			strings.Repeat("c1", 1<<20) + "00", // tags nested deeper than the stack allows
+			strings.Repeat("9f", 1<<20) + "00", // indefinite arrays nested deeper than the stack allows
+		},
+		"msgpack": {
+			"dfffffffff",                         // map longer than the data
+			"ddffffffff",                         // array longer than the data
+			"dbffffffff",                         // string longer than the data
+			"c6ffffffff",                         // bytes longer than the data
+			"c9ffffffffff",                       // extension longer than the data
+			"dc",                                 // truncated length
+			strings.Repeat("91", 1<<20) + "00",   // arrays nested deeper than the stack allows
+			strings.Repeat("8100", 1<<19) + "00", // maps nested deeper than the stack allows
+		},
+	}
+	for name, cases := range inputs {
+		for _, input := range cases {
+			data, _ := hex.DecodeString(input)
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("%s %s: panicked: %v", name, input, r)
+					}
+				}()
+				if _, _, err := binaryFormats[name].decode(data); err == nil {
+					t.Errorf("%s %s: expected an error", name, input)
+				}
+			}()
+		}
+	}
+}
+
+func TestCborTimeTags(t *testing.T) {
+	whole := cbor{}.appendTime(nil, time.Unix(1700000000, 0))
+	if hex.EncodeToString(whole) != "c11a6553f100" {
+		t.Errorf("whole seconds encoded as %x, expected tag 1 with an integer", whole)
+	}
+	fraction := cbor{}.appendTime(nil, time.Unix(1700000000, 5))
+	if hex.EncodeToString(fraction) != "d903e9a2011a6553f1002805" {
+		t.Errorf("fraction encoded as %x, expected tag 1001 with nanoseconds", fraction)
+	}
+
+	// floats under tag 1 written by older versions are still read
+	value, _, err := cbor{}.decodeValue([]byte{0xc1, 0xfb, 0x41, 0xd9, 0x54, 0xfc, 0x40, 0x08, 0x00, 0x00}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moment, ok := value.(time.Time); !ok || moment.Unix() != 1700000000 {
+		t.Errorf("float epoch decoded as %v", value)
+	}
+}
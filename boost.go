@@ -0,0 +1,112 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The error returned by IDiaryV2.Boost and IDiaryV2.BoostOnSignal when the duration is zero or less
+var ErrBoostDuration = errors.New("boost duration must be greater than zero")
+
+// A private struct to encapsulate a temporary verbosity boost of a diary instance
+// The boost lowers the effective level of every page by a number of steps until it reverts
+type booster struct {
+	steps      atomic.Int32
+	mutex      sync.Mutex
+	timer      *time.Timer
+	generation int
+}
+
+// level returns the given level lowered by the active boost
+func (b *booster) level(level int) int {
+	return level - int(b.steps.Load())
+}
+
+// Boost steps the effective level of the diary down one step toward TRACE for the given duration
+// Boosting again while a boost is active steps down further and restarts the duration
+// A NOTICE is logged describing the new level and when it will revert
+// [NOTE: Returns ErrBoostDuration and leaves the level as it is if the duration is zero or less, or ErrClosed once the diary instance is closed]
+func (d diary) Boost(duration time.Duration) error {
+	if duration <= 0 {
+		return ErrBoostDuration
+	}
+	if d.lifecycle.closed.Load() {
+		return ErrClosed
+	}
+
+	b := d.booster
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	settings := d.current()
+	steps := b.steps.Load()
+	if int(steps) < settings.Level-LevelTrace {
+		steps++
+		b.steps.Store(steps)
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.generation++
+	generation := b.generation
+	b.timer = time.AfterFunc(duration, func() {
+		d.revert("verbosity boost expired", generation)
+	})
+
+	until := time.Now().Add(duration)
+	d.system(TextLevelNotice, "diary.boost", fmt.Sprintf("verbosity boosted to %s until %s", ConvertToTextLevel(settings.Level-int(steps)), until.Format(time.RFC3339)), M{
+		"level": ConvertToTextLevel(settings.Level - int(steps)),
+		"steps": steps,
+		"until": until,
+	})
+	return nil
+}
+
+// stop cancels the timer of an active boost without reverting it, see IDiaryV2.Close
+// A timer that has already fired is made stale, so that it doesn't log once the diary instance is closed
+func (b *booster) stop() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.generation++
+}
+
+// ResetBoost immediately reverts any active verbosity boost
+func (d diary) ResetBoost() {
+	d.revert("verbosity boost reset", -1)
+}
+
+// revert removes the boost and logs a NOTICE describing the restored level
+//
+// - generation: The boost that expired, if a newer boost is active nothing is reverted [NOTE: If -1 will always revert]
+func (d diary) revert(reason string, generation int) {
+	b := d.booster
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if generation != -1 && generation != b.generation {
+		return
+	}
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.steps.Store(0)
+
+	settings := d.current()
+	d.system(TextLevelNotice, "diary.boost", fmt.Sprintf("%s, level restored to %s", reason, ConvertToTextLevel(settings.Level)), M{
+		"level": ConvertToTextLevel(settings.Level),
+		"steps": 0,
+	})
+}
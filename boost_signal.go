@@ -0,0 +1,55 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9 && !js && !wasip1
+
+package diary
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// BoostOnSignal opts in to signal driven verbosity boosts for on-call debugging
+// SIGUSR1 steps the effective level down one step for the given duration and SIGUSR2 resets it immediately
+// Other signal handlers registered by the application keep receiving these signals
+// [NOTE: Returns ErrBoostDuration if the duration is zero or less]
+func (d diary) BoostOnSignal(duration time.Duration) (stop func(), err error) {
+	if duration <= 0 {
+		return nil, ErrBoostDuration
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-done:
+				return
+			case s := <-signals:
+				if s == syscall.SIGUSR1 {
+					d.Boost(duration)
+				} else {
+					d.ResetBoost()
+				}
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return d.background(func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+			<-finished
+		})
+	}), nil
+}
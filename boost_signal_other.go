@@ -0,0 +1,17 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build windows || plan9 || js || wasip1
+
+package diary
+
+import "time"
+
+// BoostOnSignal is not supported on platforms without SIGUSR1 and SIGUSR2, use Boost and ResetBoost instead
+func (d diary) BoostOnSignal(duration time.Duration) (stop func(), err error) {
+	if duration <= 0 {
+		return nil, ErrBoostDuration
+	}
+	return func() {}, nil
+}
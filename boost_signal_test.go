@@ -0,0 +1,36 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9 && !js && !wasip1
+
+package diary
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBoostOnSignal(t *testing.T) {
+	recorder := &logRecorder{}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelNotice, recorder.handler)
+	stop, err := d.BoostOnSignal(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	waitForBoost(t, recorder, "verbosity boosted to info until ")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	waitForBoost(t, recorder, "verbosity boost reset, level restored to notice")
+	if info, _ := boostLogged(d, recorder); info {
+		t.Errorf("info logged after the boost was reset")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// boostLogged reports whether an info and a debug entry of a new page reach the handlers
+func boostLogged(d IDiaryV2, recorder *logRecorder) (info, debug bool) {
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Info("info", nil)
+		p.Debug("debug", 1)
+	})
+	info, debug = len(recorder.find("jobs.info", "")) > 0, len(recorder.find("jobs.debug", "")) > 0
+	recorder.mutex.Lock()
+	recorder.logs = nil
+	recorder.mutex.Unlock()
+	return info, debug
+}
+
+// boostNotices returns the boost notices that start with the given text
+func boostNotices(recorder *logRecorder, prefix string) []Log {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	var notices []Log
+	for _, log := range recorder.logs {
+		if log.Category == "diary.boost" && log.Level == TextLevelNotice && strings.HasPrefix(log.Message, prefix) {
+			notices = append(notices, log)
+		}
+	}
+	return notices
+}
+
+// waitForBoost polls the recorder until a boost notice that starts with the given text was logged
+func waitForBoost(t *testing.T, recorder *logRecorder, prefix string) Log {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if notices := boostNotices(recorder, prefix); len(notices) > 0 {
+			return notices[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%q wasn't logged", prefix)
+	return Log{}
+}
+
+func TestBoost(t *testing.T) {
+	recorder := &logRecorder{}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelNotice, recorder.handler)
+	if info, _ := boostLogged(d, recorder); info {
+		t.Fatalf("info logged before the boost")
+	}
+
+	if err := d.Boost(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	notice := waitForBoost(t, recorder, "verbosity boosted to info until ")
+	if notice.Meta["level"] != TextLevelInfo {
+		t.Errorf("unexpected boost notice %+v", notice.Meta)
+	}
+	if info, debug := boostLogged(d, recorder); !info || debug {
+		t.Errorf("expected a boost to info, got info %t and debug %t", info, debug)
+	}
+
+	if err := d.Boost(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if info, debug := boostLogged(d, recorder); !info || !debug {
+		t.Errorf("expected a boost to debug, got info %t and debug %t", info, debug)
+	}
+	for i := 0; i < 3; i++ {
+		if err := d.Boost(time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if steps := d.(*diary).booster.steps.Load(); steps != LevelNotice-LevelTrace {
+		t.Errorf("expected the boost to stop at trace, got %d steps", steps)
+	}
+
+	d.ResetBoost()
+	waitForBoost(t, recorder, "verbosity boost reset, level restored to notice")
+	if info, _ := boostLogged(d, recorder); info {
+		t.Errorf("info logged after the boost was reset")
+	}
+}
+
+func TestBoostExpires(t *testing.T) {
+	recorder := &logRecorder{}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelNotice, recorder.handler)
+	if err := d.Boost(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	notice := waitForBoost(t, recorder, "verbosity boost expired, level restored to notice")
+	if notice.Meta["level"] != TextLevelNotice {
+		t.Errorf("unexpected revert notice %+v", notice.Meta)
+	}
+	if info, _ := boostLogged(d, recorder); info {
+		t.Errorf("info logged after the boost expired")
+	}
+}
+
+func TestBoostStaleTimer(t *testing.T) {
+	recorder := &logRecorder{}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelNotice, recorder.handler)
+	defer d.ResetBoost()
+	if err := d.Boost(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Boost(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// a timer of the first boost that fires while the second is being applied must not revert it
+	d.(*diary).revert("verbosity boost expired", 1)
+	if notices := boostNotices(recorder, "verbosity boost expired"); len(notices) != 0 {
+		t.Errorf("a stale timer reverted the boost: %+v", notices)
+	}
+	if info, debug := boostLogged(d, recorder); !info || !debug {
+		t.Errorf("expected the boost to be kept, got info %t and debug %t", info, debug)
+	}
+}
+
+func TestBoostDuration(t *testing.T) {
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelNotice, func(log Log) {})
+	for _, duration := range []time.Duration{0, -time.Second} {
+		if err := d.Boost(duration); !errors.Is(err, ErrBoostDuration) {
+			t.Errorf("%s: expected ErrBoostDuration but got %v", duration, err)
+		}
+		if stop, err := d.BoostOnSignal(duration); !errors.Is(err, ErrBoostDuration) || stop != nil {
+			t.Errorf("%s: expected ErrBoostDuration but got %v", duration, err)
+		}
+	}
+	if steps := d.(*diary).booster.steps.Load(); steps != 0 {
+		t.Errorf("an invalid boost changed the level by %d steps", steps)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// A private cache of "file:line" references by program counter
+// Program counters are limited by the size of the binary so the cache never has to evict
+var callers = struct {
+	sync.RWMutex
+	lines map[uintptr]string
+}{lines: map[uintptr]string{}}
+
+// A private function used to return the "file:line" reference of a caller
+//
+// - skip: The number of stack frames to ascend, with 0 identifying the caller of callerLine [NOTE: The same as runtime.Caller.]
+func callerLine(skip int) string {
+	var pcs [1]uintptr
+	if runtime.Callers(skip+2, pcs[:]) == 0 {
+		return ""
+	}
+	pc := pcs[0]
+
+	callers.RLock()
+	line, ok := callers.lines[pc]
+	callers.RUnlock()
+	if ok {
+		return line
+	}
+
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	line = frame.File + ":" + strconv.Itoa(frame.Line)
+	callers.Lock()
+	callers.lines[pc] = line
+	callers.Unlock()
+	return line
+}
+
+// A private function used to concatenate categories by dot-notation, e.g. "main.sub1"
+func joinCategory(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	return parent + "." + child
+}
@@ -0,0 +1,335 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// A public struct used to encode log entries as CBOR maps
+// Records are self-delimiting so a stream of them can be decoded with DecodeCbor
+// Times use tag 1 (epoch-based) as an integer for whole seconds and tag 1001 (extended time, RFC 9581) with nanoseconds otherwise
+// [NOTE: Tag 1001 is a deliberate deviation from tag 1, a float64 epoch only resolves about 240ns for current dates while the JSON output keeps nanoseconds. Decoders without RFC 9581 read these times as a tagged map of the seconds (key 1) and nanoseconds (key -9).]
+type CborFormatter struct{}
+
+func (CborFormatter) Format(dst []byte, log Log) ([]byte, error) {
+	return appendBinaryLog(cbor{}, dst, log)
+}
+
+// DecodeCbor reads a single log entry written by the CborFormatter, returning the bytes that follow it
+func DecodeCbor(data []byte) (Log, []byte, error) {
+	return decodeBinaryLog(cbor{}, data)
+}
+
+const (
+	cborUnsigned = 0 << 5
+	cborNegative = 1 << 5
+	cborBytes    = 2 << 5
+	cborText     = 3 << 5
+	cborArray    = 4 << 5
+	cborMap      = 5 << 5
+	cborTag      = 6 << 5
+	cborSimple   = 7 << 5
+)
+
+// A private struct implementing the CBOR primitives, see RFC 8949
+type cbor struct{}
+
+// A private function used to append the initial byte and argument of a data item
+func cborHead(dst []byte, major byte, argument uint64) []byte {
+	switch {
+	case argument < 24:
+		return append(dst, major|byte(argument))
+	case argument <= math.MaxUint8:
+		return append(dst, major|24, byte(argument))
+	case argument <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, major|25), uint16(argument))
+	case argument <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, major|26), uint32(argument))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, major|27), argument)
+}
+
+func (cbor) appendMap(dst []byte, size int) []byte {
+	return cborHead(dst, cborMap, uint64(size))
+}
+
+func (cbor) appendArray(dst []byte, size int) []byte {
+	return cborHead(dst, cborArray, uint64(size))
+}
+
+func (cbor) appendString(dst []byte, value string) []byte {
+	return append(cborHead(dst, cborText, uint64(len(value))), value...)
+}
+
+func (cbor) appendBytes(dst []byte, value []byte) []byte {
+	return append(cborHead(dst, cborBytes, uint64(len(value))), value...)
+}
+
+func (cbor) appendInt(dst []byte, value int64) []byte {
+	if value < 0 {
+		return cborHead(dst, cborNegative, uint64(-(value + 1)))
+	}
+	return cborHead(dst, cborUnsigned, uint64(value))
+}
+
+func (cbor) appendUint(dst []byte, value uint64) []byte {
+	return cborHead(dst, cborUnsigned, value)
+}
+
+func (cbor) appendFloat(dst []byte, value float64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, cborSimple|27), math.Float64bits(value))
+}
+
+func (cbor) appendBool(dst []byte, value bool) []byte {
+	if value {
+		return append(dst, cborSimple|21)
+	}
+	return append(dst, cborSimple|20)
+}
+
+func (cbor) appendNil(dst []byte) []byte {
+	return append(dst, cborSimple|22)
+}
+
+func (c cbor) appendTime(dst []byte, value time.Time) []byte {
+	if value.Nanosecond() == 0 {
+		return c.appendInt(cborHead(dst, cborTag, 1), value.Unix())
+	}
+	// an extended time map of the seconds (key 1) and nanoseconds (key -9)
+	dst = c.appendMap(cborHead(dst, cborTag, 1001), 2)
+	dst = c.appendInt(c.appendInt(dst, 1), value.Unix())
+	return c.appendInt(c.appendInt(dst, -9), int64(value.Nanosecond()))
+}
+
+func (c cbor) decodeValue(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, data, fmt.Errorf("cbor: unexpected end of data")
+	}
+	if depth > binaryMaxDepth {
+		return nil, data, fmt.Errorf("cbor: nesting exceeds %d levels", binaryMaxDepth)
+	}
+	major, info := data[0]&0xe0, data[0]&0x1f
+
+	if major == cborSimple {
+		switch info {
+		case 20:
+			return false, data[1:], nil
+		case 21:
+			return true, data[1:], nil
+		case 22, 23:
+			return nil, data[1:], nil
+		case 25:
+			value, rest, err := binaryUint(data[1:], 2)
+			return cborHalf(uint16(value)), rest, err
+		case 26:
+			value, rest, err := binaryUint(data[1:], 4)
+			return float64(math.Float32frombits(uint32(value))), rest, err
+		case 27:
+			value, rest, err := binaryUint(data[1:], 8)
+			return math.Float64frombits(value), rest, err
+		}
+		return nil, data, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+
+	if info == 31 {
+		return c.decodeIndefinite(major, data[1:], depth)
+	}
+	argument, data, err := cborArgument(data)
+	if err != nil {
+		return nil, data, err
+	}
+
+	switch major {
+	case cborUnsigned:
+		if argument <= math.MaxInt64 {
+			return int64(argument), data, nil
+		}
+		return argument, data, nil
+	case cborNegative:
+		if argument > math.MaxInt64 {
+			return nil, data, fmt.Errorf("cbor: negative integer overflows int64")
+		}
+		return -1 - int64(argument), data, nil
+	case cborBytes, cborText:
+		if uint64(len(data)) < argument {
+			return nil, data, fmt.Errorf("cbor: unexpected end of data")
+		}
+		if major == cborText {
+			return string(data[:argument]), data[argument:], nil
+		}
+		return append([]byte(nil), data[:argument]...), data[argument:], nil
+	case cborArray:
+		// every item takes at least a byte, which also keeps the argument in the range of an int
+		if argument > uint64(len(data)) {
+			return nil, data, fmt.Errorf("cbor: array of %d items exceeds the data", argument)
+		}
+		list := make([]interface{}, 0, int(argument))
+		for i := uint64(0); i < argument; i++ {
+			var value interface{}
+			if value, data, err = c.decodeValue(data, depth+1); err != nil {
+				return nil, data, err
+			}
+			list = append(list, value)
+		}
+		return list, data, nil
+	case cborMap:
+		if argument > uint64(len(data)) {
+			return nil, data, fmt.Errorf("cbor: map of %d pairs exceeds the data", argument)
+		}
+		values := make(map[string]interface{}, int(argument))
+		for i := uint64(0); i < argument; i++ {
+			var key, value interface{}
+			if key, data, err = c.decodeValue(data, depth+1); err != nil {
+				return nil, data, err
+			}
+			if value, data, err = c.decodeValue(data, depth+1); err != nil {
+				return nil, data, err
+			}
+			values[fmt.Sprint(key)] = value
+		}
+		return values, data, nil
+	case cborTag:
+		value, data, err := c.decodeValue(data, depth+1)
+		if err != nil {
+			return nil, data, err
+		}
+		switch argument {
+		case 1:
+			return cborEpoch(value, data)
+		case 1001:
+			return cborExtendedTime(value, data)
+		}
+		// unknown tags are ignored and their content returned as is
+		return value, data, nil
+	}
+	return nil, data, fmt.Errorf("cbor: unsupported major type %d", major>>5)
+}
+
+// decodeIndefinite reads an indefinite length string, array or map up to its break code
+func (c cbor) decodeIndefinite(major byte, data []byte, depth int) (interface{}, []byte, error) {
+	var chunks []byte
+	var list []interface{}
+	values := map[string]interface{}{}
+	for {
+		if len(data) == 0 {
+			return nil, data, fmt.Errorf("cbor: unexpected end of data")
+		}
+		if data[0] == 0xff {
+			data = data[1:]
+			break
+		}
+
+		value, rest, err := c.decodeValue(data, depth+1)
+		if err != nil {
+			return nil, rest, err
+		}
+		data = rest
+		switch major {
+		case cborBytes, cborText:
+			switch chunk := value.(type) {
+			case string:
+				chunks = append(chunks, chunk...)
+			case []byte:
+				chunks = append(chunks, chunk...)
+			default:
+				return nil, data, fmt.Errorf("cbor: invalid string chunk %T", value)
+			}
+		case cborArray:
+			list = append(list, value)
+		case cborMap:
+			item, rest, err := c.decodeValue(data, depth+1)
+			if err != nil {
+				return nil, rest, err
+			}
+			data = rest
+			values[fmt.Sprint(value)] = item
+		default:
+			return nil, data, fmt.Errorf("cbor: major type %d may not be indefinite", major>>5)
+		}
+	}
+
+	switch major {
+	case cborBytes:
+		return chunks, data, nil
+	case cborText:
+		return string(chunks), data, nil
+	case cborArray:
+		if list == nil {
+			list = []interface{}{}
+		}
+		return list, data, nil
+	}
+	return values, data, nil
+}
+
+// A private function used to convert the content of an epoch-based time (tag 1)
+func cborEpoch(value interface{}, data []byte) (interface{}, []byte, error) {
+	switch v := value.(type) {
+	case int64:
+		return time.Unix(v, 0).UTC(), data, nil
+	case float64:
+		seconds, fraction := math.Modf(v)
+		return time.Unix(int64(seconds), int64(math.Round(fraction*1e9))).UTC(), data, nil
+	}
+	return nil, data, fmt.Errorf("cbor: invalid epoch-based time %T", value)
+}
+
+// A private function used to convert the content of an extended time (tag 1001), the seconds (key 1) and a fraction in milli-, micro- or nanoseconds (key -3, -6 or -9)
+func cborExtendedTime(value interface{}, data []byte) (interface{}, []byte, error) {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, data, fmt.Errorf("cbor: invalid extended time %T", value)
+	}
+	seconds, ok := fields["1"].(int64)
+	if !ok {
+		return nil, data, fmt.Errorf("cbor: extended time without integer seconds")
+	}
+	var nanoseconds int64
+	for key, scale := range map[string]int64{"-3": 1e6, "-6": 1e3, "-9": 1} {
+		if fraction, ok := fields[key].(int64); ok {
+			nanoseconds = fraction * scale
+		}
+	}
+	return time.Unix(seconds, nanoseconds).UTC(), data, nil
+}
+
+// A private function used to read the argument that follows the initial byte of a data item
+func cborArgument(data []byte) (uint64, []byte, error) {
+	info := data[0] & 0x1f
+	switch {
+	case info < 24:
+		return uint64(info), data[1:], nil
+	case info <= 27:
+		return binaryUint(data[1:], 1<<(info-24))
+	}
+	return 0, data, fmt.Errorf("cbor: invalid additional information %d", info)
+}
+
+// A private function used to convert a half precision float, see RFC 8949 appendix D
+func cborHalf(half uint16) float64 {
+	exponent := int(half>>10) & 0x1f
+	mantissa := float64(half & 0x3ff)
+	var value float64
+	switch exponent {
+	case 0:
+		value = math.Ldexp(mantissa, -24)
+	case 31:
+		if mantissa == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if half&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
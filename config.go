@@ -0,0 +1,844 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	EnvConfig     = "DIARY_CONFIG"
+	EnvLevel      = "DIARY_LEVEL"
+	EnvSample     = "DIARY_SAMPLE"
+	EnvCatch      = "DIARY_CATCH"
+	EnvCategories = "DIARY_CATEGORIES"
+	EnvHandlers   = "DIARY_HANDLERS"
+	EnvRedact     = "DIARY_REDACT"
+	EnvRedactKey  = "DIARY_REDACT_KEY"
+	EnvPanic      = "DIARY_PANIC"
+)
+
+const (
+	ConfigFormatJson = "json"
+	ConfigFormatYaml = "yaml"
+)
+
+// A public struct to encapsulate the configuration used to build a diary instance
+//
+// - Level: The default level to log at [NOTE: Normally NOTICE for production services]
+// - Categories: Per-category level overrides, matched by category prefix [NOTE: "api" matches "api" and "api.users" but not "apis".]
+// - Sample: The default trace sample rate for pages created with a sample of -1
+// - Catch: A flag indicating if all pages should catch, log and return panics
+// - Handlers: The handler routes that log entries are sent to [NOTE: If empty will use the DefaultHandler]
+// - Audit: The handler routes that audit entries are delivered to synchronously, see IPageV2.AuditEvent [NOTE: Audit entries are sent to Handlers as well.]
+// - Redact: The redaction rules applied to log entries before they reach any handler
+// - RedactKey: The secret HMAC key of redacted values that are hashed (may be empty) [NOTE: If empty will use a random key, so that hashes only correlate within the process.]
+// - Limits: The limits applied to the meta of log entries before they reach any handler [NOTE: If zero will use DefaultLimits]
+// - Panic: How pages that catch panics handle them
+// - ExitTimeout: The time the exit hooks are given to finish before the process exits, see IDiaryV2.OnExit [NOTE: If zero will use DefaultExitTimeout]
+type Config struct {
+	Level       int
+	Categories  map[string]int
+	Sample      int
+	Catch       bool
+	Handlers    []HandlerConfig
+	Audit       []HandlerConfig
+	Redact      []RedactRule
+	RedactKey   []byte
+	Limits      Limits
+	Panic       PanicConfig
+	ExitTimeout time.Duration
+}
+
+// A public struct to encapsulate a single handler route definition
+//
+// - Type: The name the handler factory was registered with
+// - Level: The minimum level routed to the handler [NOTE: If -1 all levels will be routed]
+// - Categories: The category prefixes routed to the handler (may be empty)
+// - Options: The handler specific options passed to the handler factory (may be empty)
+type HandlerConfig struct {
+	Type       string
+	Level      int
+	Categories []string
+	Options    M
+}
+
+// A public struct to encapsulate every problem found while reading a configuration
+type ConfigError struct {
+	Problems []string
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("invalid diary configuration:\n - %s", strings.Join(e.Problems, "\n - "))
+}
+
+// A package shorthand for a handler factory function
+//
+// - options: The handler specific options, factories must report any option they don't understand
+type HandlerFactory func(options M) (H, error)
+
+// A private registry of handler factories by name, guarded since handlers may be registered while a configuration is reloaded
+var handlerFactories = struct {
+	sync.RWMutex
+	factories map[string]HandlerFactory
+}{factories: map[string]HandlerFactory{
+	"default": formatterHandler(JsonFormatter{}),
+	"json":    formatterHandler(JsonFormatter{}),
+	"human":   formatterHandler(HumanFormatter{}),
+	"console": consoleHandler,
+	"tree":    treeHandlerFactory,
+	"logfmt":  logfmtHandler,
+	"ecs":     ecsHandler,
+	"cef":     siemHandler(false),
+	"leef":    siemHandler(true),
+	"msgpack": formatterHandler(MsgpackFormatter{}),
+	"cbor":    formatterHandler(CborFormatter{}),
+	"ledger":  ledgerHandler,
+}}
+
+// RegisterHandler makes a handler factory available to configuration files by name
+// Registering a name twice will replace the previous factory
+func RegisterHandler(name string, factory HandlerFactory) {
+	if factory == nil {
+		panic("factory must be defined")
+	}
+	handlerFactories.Lock()
+	defer handlerFactories.Unlock()
+	handlerFactories.factories[strings.ToLower(name)] = factory
+}
+
+// A private function used to look up a handler factory by name, case-insensitive
+func handlerFactory(name string) (HandlerFactory, bool) {
+	handlerFactories.RLock()
+	defer handlerFactories.RUnlock()
+	factory, ok := handlerFactories.factories[strings.ToLower(name)]
+	return factory, ok
+}
+
+// A private function used to create a handler factory that writes log entries encoded by the formatter
+//
+// Options:
+// - output: Either "stdout", "stderr" or "file" [NOTE: If empty will use stdout]
+// - path: The file log entries are appended to, required if output is "file"
+func formatterHandler(formatter Formatter) HandlerFactory {
+	return func(options M) (H, error) {
+		options = copyOptions(options)
+		w, err := outputOption(options)
+		if err != nil {
+			return nil, err
+		}
+		if err := unknownOptions(options); err != nil {
+			return nil, err
+		}
+		return WriterHandler(w, formatter), nil
+	}
+}
+
+// A private function used to copy handler options so that factories can consume them
+func copyOptions(options M) M {
+	out := make(M, len(options))
+	for key, value := range options {
+		out[key] = value
+	}
+	return out
+}
+
+// A private function used to consume the output and path options of a handler definition
+func outputOption(options M) (io.Writer, error) {
+	output, _ := options["output"].(string)
+	path, _ := options["path"].(string)
+	delete(options, "output")
+	delete(options, "path")
+
+	switch strings.ToLower(output) {
+	case "", "stdout":
+		return stdout{}, nil
+	case "stderr":
+		return stderr{}, nil
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("path is required when output is file")
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		manage(file)
+		return file, nil
+	}
+	return nil, fmt.Errorf("unknown output %q (expected stdout, stderr or file)", output)
+}
+
+// A private function used to report the handler options that were not consumed by a factory
+func unknownOptions(options M) error {
+	if len(options) > 0 {
+		return fmt.Errorf("unknown options %s", strings.Join(sortedKeys(options), ", "))
+	}
+	return nil
+}
+
+// DefaultConfig returns the configuration used when no other value has been given
+func DefaultConfig() Config {
+	return Config{
+		Level:      LevelNotice,
+		Categories: map[string]int{},
+	}
+}
+
+// LoadConfig reads the configuration from a JSON or YAML file and then applies the DIARY_* environment variables on top of it
+//
+// - file: The path of the configuration file [NOTE: If empty will use DIARY_CONFIG, if that is also empty only the environment is used]
+func LoadConfig(file string) (Config, error) {
+	config := DefaultConfig()
+	var problems []string
+
+	if file == "" {
+		file = os.Getenv(EnvConfig)
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return config, err
+		}
+		problems = append(problems, config.parse(data, configFormat(file))...)
+	}
+	problems = append(problems, config.environment(os.Environ())...)
+	problems = append(problems, config.validate()...)
+
+	if len(problems) > 0 {
+		return config, ConfigError{Problems: problems}
+	}
+	return config, nil
+}
+
+// ParseConfig reads the configuration from JSON or YAML data, keys that are absent keep their default value
+//
+// - format: Either "json" or "yaml"
+func ParseConfig(data []byte, format string) (Config, error) {
+	config := DefaultConfig()
+	problems := config.parse(data, format)
+	problems = append(problems, config.validate()...)
+	if len(problems) > 0 {
+		return config, ConfigError{Problems: problems}
+	}
+	return config, nil
+}
+
+// Validate checks the configuration and reports every problem found
+func (c Config) Validate() error {
+	if problems := c.validate(); len(problems) > 0 {
+		return ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// DearConfig returns a diary.Diary interface instance for consumption built from the given configuration
+// See Dear for a description of the service and commit parameters
+func DearConfig(client, project, service string, serviceMeta M, repository, commitHash string, commitTags []string, commitMeta M, config Config) (IDiaryV2, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	d := dear(client, project, service, serviceMeta, repository, commitHash, commitTags, commitMeta, config.Level, nil)
+	settings, err := config.settings(nil, d.monitor)
+	if err != nil {
+		return nil, err
+	}
+	d.settings.Store(settings)
+	return d, nil
+}
+
+// settings builds the runtime settings of a diary instance from the configuration
+//
+// - base: The handler to use when no handlers are configured (may be nil)
+// - monitor: The monitor of the diary instance that guards each configured handler
+func (c Config) settings(base H, monitor *monitor) (*settings, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	handler, audit, resources, err := c.handler(monitor)
+	if err != nil {
+		return nil, err
+	}
+	if handler == nil {
+		handler = base
+	}
+	redact, err := newRedactor(c.Redact, c.RedactKey)
+	if err != nil {
+		closeResources(resources)
+		return nil, err
+	}
+
+	categories := make(map[string]int, len(c.Categories))
+	for category, level := range c.Categories {
+		categories[category] = level
+	}
+	c.Categories = categories
+
+	return &settings{
+		Config:     c,
+		Level:      c.Level,
+		Sample:     c.Sample,
+		Catch:      c.Catch,
+		Categories: categories,
+		Handler:    handler,
+		Audit:      audit,
+		Redactor:   redact,
+		Resources:  resources,
+	}, nil
+}
+
+// A private function used to detect the format of a configuration file from its extension
+func configFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return ConfigFormatYaml
+	}
+	return ConfigFormatJson
+}
+
+// parse decodes the data into a generic document so that every unknown or invalid key can be reported at once
+func (c *Config) parse(data []byte, format string) []string {
+	var raw map[string]interface{}
+	var err error
+	switch strings.ToLower(format) {
+	case ConfigFormatJson:
+		err = json.Unmarshal(data, &raw)
+	case ConfigFormatYaml, "yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return []string{fmt.Sprintf("unknown format %q (expected json or yaml)", format)}
+	}
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var problems []string
+	for _, key := range sortedKeys(raw) {
+		value := raw[key]
+		switch key {
+		case "level":
+			if level, ok := parseLevel(value); ok {
+				c.Level = level
+			} else {
+				problems = append(problems, fmt.Sprintf("level: invalid level %v", value))
+			}
+		case "sample":
+			if sample, ok := parseInt(value); ok {
+				c.Sample = sample
+			} else {
+				problems = append(problems, fmt.Sprintf("sample: expected a number but got %v", value))
+			}
+		case "catch":
+			if catch, ok := value.(bool); ok {
+				c.Catch = catch
+			} else {
+				problems = append(problems, fmt.Sprintf("catch: expected a boolean but got %v", value))
+			}
+		case "categories":
+			categories, ok := parseMap(value)
+			if !ok {
+				problems = append(problems, "categories: expected a map of category to level")
+				continue
+			}
+			for _, category := range sortedKeys(categories) {
+				if level, ok := parseLevel(categories[category]); ok {
+					c.Categories[category] = level
+				} else {
+					problems = append(problems, fmt.Sprintf("categories.%s: invalid level %v", category, categories[category]))
+				}
+			}
+		case "handlers":
+			handlers, ok := value.([]interface{})
+			if !ok {
+				problems = append(problems, "handlers: expected a list of handler definitions")
+				continue
+			}
+			c.Handlers = nil
+			for i, item := range handlers {
+				handler, handlerProblems := parseHandlerConfig(fmt.Sprintf("handlers[%d]", i), item)
+				problems = append(problems, handlerProblems...)
+				c.Handlers = append(c.Handlers, handler)
+			}
+		case "audit":
+			handlers, ok := value.([]interface{})
+			if !ok {
+				problems = append(problems, "audit: expected a list of handler definitions")
+				continue
+			}
+			c.Audit = nil
+			for i, item := range handlers {
+				handler, handlerProblems := parseHandlerConfig(fmt.Sprintf("audit[%d]", i), item)
+				problems = append(problems, handlerProblems...)
+				c.Audit = append(c.Audit, handler)
+			}
+		case "redact":
+			rules, ok := value.([]interface{})
+			if !ok {
+				problems = append(problems, "redact: expected a list of redaction rules")
+				continue
+			}
+			c.Redact = nil
+			for i, item := range rules {
+				rule, ruleProblems := parseRedactRule(fmt.Sprintf("redact[%d]", i), item)
+				problems = append(problems, ruleProblems...)
+				c.Redact = append(c.Redact, rule)
+			}
+		case "limits":
+			limits, ok := parseMap(value)
+			if !ok {
+				problems = append(problems, "limits: expected a map of limits")
+				continue
+			}
+			problems = append(problems, c.Limits.parse(limits)...)
+		case "exitTimeout":
+			if timeout, ok := parseDuration(value); ok {
+				c.ExitTimeout = timeout
+			} else {
+				problems = append(problems, fmt.Sprintf("exitTimeout: expected a duration but got %v", value))
+			}
+		case "panic":
+			panics, ok := parseMap(value)
+			if !ok {
+				problems = append(problems, "panic: expected a map of panic settings")
+				continue
+			}
+			problems = append(problems, c.Panic.parse(panics)...)
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown key", key))
+		}
+	}
+	return problems
+}
+
+// parse reads the limits that are present in the decoded document, e.g. {"maxDepth": 5, "maxString": 1024}
+func (l *Limits) parse(raw map[string]interface{}) []string {
+	var problems []string
+	for _, key := range sortedKeys(raw) {
+		value, ok := parseInt(raw[key])
+		if !ok {
+			problems = append(problems, fmt.Sprintf("limits.%s: expected a number but got %v", key, raw[key]))
+			continue
+		}
+		switch key {
+		case "maxDepth":
+			l.MaxDepth = value
+		case "maxString":
+			l.MaxString = value
+		case "maxItems":
+			l.MaxItems = value
+		case "maxEntry":
+			l.MaxEntry = value
+		case "maxPropagated":
+			l.MaxPropagated = value
+		case "maxFrames":
+			l.MaxFrames = value
+		default:
+			problems = append(problems, fmt.Sprintf("limits.%s: unknown key", key))
+		}
+	}
+	return problems
+}
+
+// parse reads the panic settings that are present in the decoded document, e.g. {"policy": "repanic", "goroutines": true}
+func (p *PanicConfig) parse(raw map[string]interface{}) []string {
+	var problems []string
+	for _, key := range sortedKeys(raw) {
+		value := raw[key]
+		switch key {
+		case "policy":
+			if policy, ok := value.(string); ok {
+				p.Policy = strings.ToLower(policy)
+			} else {
+				problems = append(problems, fmt.Sprintf("panic.policy: expected a string but got %v", value))
+			}
+		case "goroutines":
+			if goroutines, ok := value.(bool); ok {
+				p.Goroutines = goroutines
+			} else {
+				problems = append(problems, fmt.Sprintf("panic.goroutines: expected a boolean but got %v", value))
+			}
+		case "exitCode":
+			if code, ok := parseInt(value); ok {
+				p.ExitCode = code
+			} else {
+				problems = append(problems, fmt.Sprintf("panic.exitCode: expected a number but got %v", value))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("panic.%s: unknown key", key))
+		}
+	}
+	return problems
+}
+
+// environment applies the DIARY_* variables found in the given "key=value" list
+// Variables that diary doesn't know are ignored, since other tools may share the prefix, only known variables with invalid values are reported
+// [NOTE: Handler options can't be set from the environment, DIARY_HANDLERS only selects handler types with their default options.]
+func (c *Config) environment(environ []string) []string {
+	var problems []string
+	for _, entry := range environ {
+		key, value, _ := strings.Cut(entry, "=")
+		if !strings.HasPrefix(key, "DIARY_") {
+			continue
+		}
+		switch key {
+		case EnvConfig:
+		case EnvLevel:
+			if level, ok := parseLevel(value); ok {
+				c.Level = level
+			} else {
+				problems = append(problems, fmt.Sprintf("%s: invalid level %q", key, value))
+			}
+		case EnvSample:
+			if sample, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+				c.Sample = sample
+			} else {
+				problems = append(problems, fmt.Sprintf("%s: expected a number but got %q", key, value))
+			}
+		case EnvCatch:
+			if catch, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+				c.Catch = catch
+			} else {
+				problems = append(problems, fmt.Sprintf("%s: expected a boolean but got %q", key, value))
+			}
+		case EnvCategories:
+			// e.g. DIARY_CATEGORIES="api.users=debug,db=warning"
+			for _, pair := range splitList(value) {
+				category, text, found := strings.Cut(pair, "=")
+				level, ok := parseLevel(text)
+				if !found || !ok {
+					problems = append(problems, fmt.Sprintf("%s: invalid category level %q (expected category=level)", key, pair))
+					continue
+				}
+				c.Categories[strings.TrimSpace(category)] = level
+			}
+		case EnvHandlers:
+			// e.g. DIARY_HANDLERS="human,json"
+			c.Handlers = nil
+			for _, name := range splitList(value) {
+				c.Handlers = append(c.Handlers, HandlerConfig{Type: name, Level: -1})
+			}
+		case EnvPanic:
+			// e.g. DIARY_PANIC="repanic"
+			c.Panic.Policy = strings.ToLower(strings.TrimSpace(value))
+		case EnvRedact:
+			// e.g. DIARY_REDACT="password,*token*"
+			for _, glob := range splitList(value) {
+				c.Redact = append(c.Redact, RedactRule{Key: glob, Action: RedactMask})
+			}
+		case EnvRedactKey:
+			// e.g. DIARY_REDACT_KEY="a long random secret"
+			c.RedactKey = []byte(value)
+		}
+	}
+	return problems
+}
+
+// validate reports every problem with the configuration values
+func (c Config) validate() []string {
+	var problems []string
+	if !IsValidLevel(c.Level) {
+		problems = append(problems, fmt.Sprintf("level: invalid level %d", c.Level))
+	}
+	for _, category := range sortedKeys(c.Categories) {
+		if strings.TrimSpace(category) == "" {
+			problems = append(problems, "categories: category may not be empty")
+		}
+		if !IsValidLevel(c.Categories[category]) {
+			problems = append(problems, fmt.Sprintf("categories.%s: invalid level %d", category, c.Categories[category]))
+		}
+	}
+	if c.ExitTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("exitTimeout: may not be negative but got %s", c.ExitTimeout))
+	}
+	switch c.Panic.Policy {
+	case "", PanicRecover, PanicRepanic, PanicExit:
+	default:
+		problems = append(problems, fmt.Sprintf("panic.policy: unknown policy %q (expected recover, repanic or exit)", c.Panic.Policy))
+	}
+	problems = append(problems, validateHandlers("handlers", c.Handlers)...)
+	problems = append(problems, validateHandlers("audit", c.Audit)...)
+	for i, rule := range c.Redact {
+		if _, err := compileRedactRule(rule); err != nil {
+			problems = append(problems, fmt.Sprintf("redact[%d]: %v", i, err))
+		}
+	}
+	return problems
+}
+
+// A private function used to report every problem with a list of handler definitions
+func validateHandlers(key string, handlers []HandlerConfig) []string {
+	var problems []string
+	for i, handler := range handlers {
+		if _, ok := handlerFactory(handler.Type); !ok {
+			problems = append(problems, fmt.Sprintf("%s[%d].type: unknown handler %q", key, i, handler.Type))
+		}
+		if handler.Level != -1 && !IsValidLevel(handler.Level) {
+			problems = append(problems, fmt.Sprintf("%s[%d].level: invalid level %d", key, i, handler.Level))
+		}
+	}
+	return problems
+}
+
+// handler builds a single handler routing log entries to every configured handler, and a single audit handler delivering audit entries to every configured audit handler
+// The resources the handler factories open are returned as well, see manage
+// Each handler is guarded by the monitor, so that a failing handler doesn't affect the others, see monitor.guard
+func (c Config) handler(monitor *monitor) (H, func(log Log) error, []interface{}, error) {
+	if len(c.Handlers) == 0 && len(c.Audit) == 0 {
+		return nil, nil, nil, nil
+	}
+
+	opening.Lock()
+	opening.resources = nil
+	defer func() {
+		opening.resources = nil
+		opening.Unlock()
+	}()
+
+	var problems []string
+	routes := make([]H, 0, len(c.Handlers))
+	for i, definition := range c.Handlers {
+		factory, ok := handlerFactory(definition.Type)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("handlers[%d].type: unknown handler %q", i, definition.Type))
+			continue
+		}
+		handler, err := factory(definition.Options)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("handlers[%d].options: %v", i, err))
+			continue
+		}
+		name := fmt.Sprintf("handlers[%d].%s", i, strings.ToLower(definition.Type))
+		routes = append(routes, monitor.guard(name, handler, definition.Level, definition.Categories))
+	}
+	audits := make([]func(log Log) error, 0, len(c.Audit))
+	for i, definition := range c.Audit {
+		factory, ok := handlerFactory(definition.Type)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("audit[%d].type: unknown handler %q", i, definition.Type))
+			continue
+		}
+		handler, err := factory(definition.Options)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("audit[%d].options: %v", i, err))
+			continue
+		}
+		name := fmt.Sprintf("audit[%d].%s", i, strings.ToLower(definition.Type))
+		audits = append(audits, monitor.deliver(name, handler, definition.Level, definition.Categories))
+	}
+	resources := opening.resources
+	if len(problems) > 0 {
+		closeResources(resources)
+		return nil, nil, nil, ConfigError{Problems: problems}
+	}
+	return joinHandlers(routes), joinAuditHandlers(audits), resources, nil
+}
+
+// A private function used to combine handlers into a single handler (may return nil)
+func joinHandlers(routes []H) H {
+	switch len(routes) {
+	case 0:
+		return nil
+	case 1:
+		return routes[0]
+	}
+	return func(log Log) {
+		for _, route := range routes {
+			route(log)
+		}
+	}
+}
+
+// A private function used to combine audit handlers into a single audit handler (may return nil)
+// Every audit handler is delivered to even if one fails, the errors are joined
+func joinAuditHandlers(audits []func(log Log) error) func(log Log) error {
+	switch len(audits) {
+	case 0:
+		return nil
+	case 1:
+		return audits[0]
+	}
+	return func(log Log) error {
+		var err error
+		for _, audit := range audits {
+			err = errors.Join(err, audit(log))
+		}
+		return err
+	}
+}
+
+// A private function used to close the resources of handlers that will never be used
+func closeResources(resources []interface{}) {
+	for _, resource := range resources {
+		if closer, ok := resource.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+}
+
+// A private function used to read a single handler definition
+func parseHandlerConfig(prefix string, value interface{}) (HandlerConfig, []string) {
+	handler := HandlerConfig{Level: -1}
+	raw, ok := parseMap(value)
+	if !ok {
+		return handler, []string{fmt.Sprintf("%s: expected a handler definition", prefix)}
+	}
+
+	var problems []string
+	for _, key := range sortedKeys(raw) {
+		value := raw[key]
+		switch key {
+		case "type":
+			if name, ok := value.(string); ok {
+				handler.Type = name
+			} else {
+				problems = append(problems, fmt.Sprintf("%s.type: expected a string but got %v", prefix, value))
+			}
+		case "level":
+			if level, ok := parseLevel(value); ok {
+				handler.Level = level
+			} else {
+				problems = append(problems, fmt.Sprintf("%s.level: invalid level %v", prefix, value))
+			}
+		case "categories":
+			categories, ok := value.([]interface{})
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s.categories: expected a list of categories", prefix))
+				continue
+			}
+			for _, category := range categories {
+				handler.Categories = append(handler.Categories, fmt.Sprint(category))
+			}
+		case "options":
+			options, ok := parseMap(value)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s.options: expected a map of options", prefix))
+				continue
+			}
+			handler.Options = M(options)
+		default:
+			problems = append(problems, fmt.Sprintf("%s.%s: unknown key", prefix, key))
+		}
+	}
+	if handler.Type == "" {
+		problems = append(problems, fmt.Sprintf("%s.type: handler type is required", prefix))
+	}
+	return handler, problems
+}
+
+// A private function used to read a single redaction rule
+func parseRedactRule(prefix string, value interface{}) (RedactRule, []string) {
+	var rule RedactRule
+	raw, ok := parseMap(value)
+	if !ok {
+		return rule, []string{fmt.Sprintf("%s: expected a redaction rule", prefix)}
+	}
+
+	var problems []string
+	for _, key := range sortedKeys(raw) {
+		text, ok := raw[key].(string)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s.%s: expected a string but got %v", prefix, key, raw[key]))
+			continue
+		}
+		switch key {
+		case "key":
+			rule.Key = text
+		case "pattern":
+			rule.Pattern = text
+		case "detect":
+			rule.Detect = text
+		case "action":
+			rule.Action = text
+		default:
+			problems = append(problems, fmt.Sprintf("%s.%s: unknown key", prefix, key))
+		}
+	}
+	return rule, problems
+}
+
+// A private function used to read a level from either its text or numeric form
+func parseLevel(value interface{}) (int, bool) {
+	if text, ok := value.(string); ok {
+		text = strings.TrimSpace(text)
+		if level, err := strconv.Atoi(text); err == nil {
+			return level, IsValidLevel(level)
+		}
+		level := ConvertFromTextLevel(text)
+		return level, level != -1
+	}
+	level, ok := parseInt(value)
+	return level, ok && IsValidLevel(level)
+}
+
+// A private function used to read a whole number from a decoded JSON or YAML value
+func parseInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), true
+		}
+	}
+	return 0, false
+}
+
+// A private function used to read a duration from a decoded JSON or YAML value, e.g. "5s" [NOTE: Numbers are read as seconds.]
+func parseDuration(value interface{}) (time.Duration, bool) {
+	if text, ok := value.(string); ok {
+		duration, err := time.ParseDuration(strings.TrimSpace(text))
+		return duration, err == nil
+	}
+	if seconds, ok := parseInt(value); ok {
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// A private function used to read a map from a decoded JSON or YAML value
+func parseMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case M:
+		return v, true
+	}
+	return nil, false
+}
+
+// A private function used to split a comma separated list ignoring empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// A private function used to iterate maps in a stable order so that problems are reported consistently
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
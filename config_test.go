@@ -0,0 +1,245 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestConfigParse(t *testing.T) {
+	cases := []struct {
+		name     string
+		format   string
+		data     string
+		problems []string
+	}{
+		{
+			name:   "json",
+			format: ConfigFormatJson,
+			data: `{"level": "loud", "sample": "x", "catch": "yes", "colour": 1, "exitTimeout": "soon",
+				"categories": {"db": "noisy", "api": "debug"},
+				"limits": {"maxDepth": "deep", "maxWidth": 1},
+				"panic": {"policy": 3, "mode": "x"}}`,
+			problems: []string{
+				"catch: expected a boolean but got yes",
+				"categories.db: invalid level noisy",
+				"colour: unknown key",
+				"exitTimeout: expected a duration but got soon",
+				"level: invalid level loud",
+				"limits.maxDepth: expected a number but got deep",
+				"limits.maxWidth: unknown key",
+				"panic.mode: unknown key",
+				"panic.policy: expected a string but got 3",
+				"sample: expected a number but got x",
+			},
+		},
+		{
+			name:   "yaml",
+			format: ConfigFormatYaml,
+			data: `
+handlers:
+  - type: json
+    level: loud
+    colour: red
+  - level: info
+audit: nope
+redact:
+  - key: 1
+    mask: x
+`,
+			problems: []string{
+				"audit: expected a list of handler definitions",
+				"handlers[0].colour: unknown key",
+				"handlers[0].level: invalid level loud",
+				"handlers[1].type: handler type is required",
+				"redact[0].key: expected a string but got 1",
+				"redact[0].mask: unknown key",
+			},
+		},
+		{
+			name:     "format",
+			format:   "toml",
+			data:     `level = "info"`,
+			problems: []string{`unknown format "toml" (expected json or yaml)`},
+		},
+		{
+			name:   "valid",
+			format: ConfigFormatJson,
+			data:   `{"level": "warning", "categories": {"db": 1}, "handlers": [{"type": "human"}]}`,
+		},
+	}
+	for _, c := range cases {
+		config := DefaultConfig()
+		if problems := config.parse([]byte(c.data), c.format); !reflect.DeepEqual(problems, c.problems) {
+			t.Errorf("%s: expected problems\n%q\nbut got\n%q", c.name, c.problems, problems)
+		}
+	}
+}
+
+func TestConfigEnvironment(t *testing.T) {
+	cases := []struct {
+		name     string
+		environ  []string
+		problems []string
+		check    func(c Config) error
+	}{
+		{
+			name: "invalid",
+			environ: []string{
+				"DIARY_LEVEL=loud",
+				"HOME=/root",
+				"DIARY_SAMPLE=x",
+				"DIARY_CATCH=maybe",
+				"DIARY_CATEGORIES=db=debug, api, web=noisy",
+				"DIARY_UNKNOWN=1",
+			},
+			problems: []string{
+				`DIARY_LEVEL: invalid level "loud"`,
+				`DIARY_SAMPLE: expected a number but got "x"`,
+				`DIARY_CATCH: expected a boolean but got "maybe"`,
+				`DIARY_CATEGORIES: invalid category level "api" (expected category=level)`,
+				`DIARY_CATEGORIES: invalid category level "web=noisy" (expected category=level)`,
+			},
+			check: func(c Config) error {
+				if c.Categories["db"] != LevelDebug {
+					return fmt.Errorf("the valid category wasn't applied: %v", c.Categories)
+				}
+				return nil
+			},
+		},
+		{
+			name:    "valid",
+			environ: []string{"DIARY_LEVEL=error", "DIARY_SAMPLE=10", "DIARY_CATCH=true", "DIARY_HANDLERS=human, json", "DIARY_PANIC=Repanic"},
+			check: func(c Config) error {
+				if c.Level != LevelError || c.Sample != 10 || !c.Catch || c.Panic.Policy != PanicRepanic {
+					return fmt.Errorf("unexpected settings %+v", c)
+				}
+				if len(c.Handlers) != 2 || c.Handlers[0].Type != "human" || c.Handlers[1].Type != "json" || c.Handlers[1].Level != -1 {
+					return fmt.Errorf("unexpected handlers %+v", c.Handlers)
+				}
+				return nil
+			},
+		},
+	}
+	for _, c := range cases {
+		config := DefaultConfig()
+		if problems := config.environment(c.environ); !reflect.DeepEqual(problems, c.problems) {
+			t.Errorf("%s: expected problems\n%q\nbut got\n%q", c.name, c.problems, problems)
+		}
+		if err := c.check(config); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   func(c *Config)
+		problems []string
+	}{
+		{
+			name: "invalid",
+			config: func(c *Config) {
+				c.Level = 99
+				c.Categories = map[string]int{"": LevelInfo, "db": 99}
+				c.ExitTimeout = -1
+				c.Panic.Policy = "explode"
+				c.Handlers = []HandlerConfig{{Type: "nope", Level: 99}, {Type: "JSON", Level: -1}}
+				c.Audit = []HandlerConfig{{Type: "cef", Level: LevelAudit}, {Type: "syslog", Level: -1}}
+				c.Redact = []RedactRule{{Key: "password", Action: "blur"}, {}}
+			},
+			problems: []string{
+				"level: invalid level 99",
+				"categories: category may not be empty",
+				"categories.db: invalid level 99",
+				"exitTimeout: may not be negative but got -1ns",
+				`panic.policy: unknown policy "explode" (expected recover, repanic or exit)`,
+				`handlers[0].type: unknown handler "nope"`,
+				"handlers[0].level: invalid level 99",
+				`audit[1].type: unknown handler "syslog"`,
+				`redact[0]: unknown action "blur" (expected mask, hash or drop)`,
+				"redact[1]: either key, pattern or detect must be defined",
+			},
+		},
+		{
+			name:   "valid",
+			config: func(c *Config) {},
+		},
+	}
+	for _, c := range cases {
+		config := DefaultConfig()
+		c.config(&config)
+		err := config.Validate()
+		if c.problems == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.name, err)
+			}
+			continue
+		}
+		var configError ConfigError
+		if !errors.As(err, &configError) {
+			t.Errorf("%s: expected a ConfigError but got %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(configError.Problems, c.problems) {
+			t.Errorf("%s: expected problems\n%q\nbut got\n%q", c.name, c.problems, configError.Problems)
+		}
+	}
+}
+
+func TestParseConfigReportsEveryProblem(t *testing.T) {
+	_, err := ParseConfig([]byte(`{"level": "loud", "panic": {"policy": "explode"}, "handlers": [{"type": "nope"}]}`), ConfigFormatJson)
+	var configError ConfigError
+	if !errors.As(err, &configError) {
+		t.Fatalf("expected a ConfigError but got %v", err)
+	}
+	expected := []string{
+		"level: invalid level loud",
+		`panic.policy: unknown policy "explode" (expected recover, repanic or exit)`,
+		`handlers[0].type: unknown handler "nope"`,
+	}
+	if !reflect.DeepEqual(configError.Problems, expected) {
+		t.Errorf("expected problems\n%q\nbut got\n%q", expected, configError.Problems)
+	}
+}
+
+func TestRegisterHandlerConcurrent(t *testing.T) {
+	names := []string{"test-concurrent-0", "test-concurrent-1", "test-concurrent-2", "test-concurrent-3"}
+	defer func() {
+		handlerFactories.Lock()
+		for _, name := range names {
+			delete(handlerFactories.factories, name)
+		}
+		handlerFactories.Unlock()
+	}()
+
+	config := DefaultConfig()
+	config.Handlers = []HandlerConfig{{Type: "json", Level: -1}}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(2)
+		go func(name string) {
+			defer wg.Done()
+			RegisterHandler(name, formatterHandler(JsonFormatter{}))
+		}(name)
+		go func() {
+			defer wg.Done()
+			if err := config.Validate(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, name := range names {
+		if _, ok := handlerFactory(name); !ok {
+			t.Errorf("%s wasn't registered", name)
+		}
+	}
+}
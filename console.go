@@ -0,0 +1,283 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The terminal width used when it can't be detected
+const ConsoleDefaultWidth = 120
+
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+// A public struct used to encode log entries in a compact, optionally colored, form for terminals
+//
+// - Color: A flag indicating if ANSI colors should be used
+// - Root: The directory that file paths are shown relative to (may be empty)
+// - Width: The width the category column is fitted to [NOTE: If zero or less will use ConsoleDefaultWidth.]
+// - InlineMeta: A flag indicating if meta should be rendered on the same line as key=value pairs instead of indented JSON
+type ConsoleFormatter struct {
+	Color      bool
+	Root       string
+	Width      int
+	InlineMeta bool
+}
+
+func (f ConsoleFormatter) Format(dst []byte, log Log) ([]byte, error) {
+	width := f.Width
+	if width <= 0 {
+		width = ConsoleDefaultWidth
+	}
+	line := shortenPath(f.Root, log.Line)
+	chain := log.Chain.Id
+	if len(chain) > 8 {
+		chain = chain[len(chain)-8:]
+	}
+
+	// 15:04:05.000 LEVEL   category  chain file:line
+	categoryWidth := width - len("15:04:05.000 ") - len("WARNING ") - len(chain) - 1 - len(line) - 1
+	if categoryWidth < 16 {
+		categoryWidth = 16
+	}
+
+	dst = f.paint(dst, "90", log.Time.Format("15:04:05.000"))
+	dst = append(dst, ' ')
+	dst = f.paint(dst, levelColor(log.Level), fmt.Sprintf("%-7s", strings.ToUpper(log.Level)))
+	dst = append(dst, ' ')
+	dst = f.paint(dst, "1", fitCategory(log.Category, categoryWidth))
+	dst = append(dst, ' ')
+	dst = f.paint(dst, "90", chain)
+	dst = append(dst, ' ')
+	dst = f.paint(dst, "90", line)
+
+	if len(log.Meta) > 0 && f.InlineMeta {
+		e := logfmtEncoder{dst: dst}
+		for _, key := range sortedKeys(log.Meta) {
+			e.value(logfmtKey(key), log.Meta[key])
+		}
+		dst = e.dst
+	}
+	dst = append(dst, '\n')
+
+	if len(strings.TrimSpace(log.Message)) > 0 {
+		dst = append(dst, "  "...)
+		dst = f.paint(dst, levelColor(log.Level), log.Message)
+		dst = append(dst, '\n')
+	}
+	if len(log.Meta) > 0 && !f.InlineMeta {
+		out, err := json.MarshalIndent(log.Meta, "  ", "  ")
+		if err == nil {
+			dst = append(dst, "  "...)
+			dst = append(dst, out...)
+			dst = append(dst, '\n')
+		}
+	}
+	if len(strings.TrimSpace(log.Stack)) > 0 {
+		for _, frame := range strings.Split(strings.TrimSuffix(log.Stack, "\n"), "\n") {
+			dst = append(dst, "  "...)
+			dst = f.paint(dst, "90", frame)
+			dst = append(dst, '\n')
+		}
+	}
+	return dst, nil
+}
+
+// paint appends the value wrapped in the ANSI color code if colors are enabled
+func (f ConsoleFormatter) paint(dst []byte, color, value string) []byte {
+	if !f.Color || color == "" {
+		return append(dst, value...)
+	}
+	dst = append(dst, "\x1b["...)
+	dst = append(dst, color...)
+	dst = append(dst, 'm')
+	dst = append(dst, value...)
+	return append(dst, "\x1b[0m"...)
+}
+
+// A private function used to map a level onto its ANSI color code
+func levelColor(level string) string {
+	switch level {
+	case TextLevelTrace, TextLevelTraceEnter, TextLevelTraceExit:
+		return "90"
+	case TextLevelDebug:
+		return "36"
+	case TextLevelInfo:
+		return "32"
+	case TextLevelNotice:
+		return "34"
+	case TextLevelWarning:
+		return "33"
+	case TextLevelError:
+		return "31"
+	case TextLevelFatal:
+		return "1;31"
+	case TextLevelAudit:
+		return "35"
+	}
+	return ""
+}
+
+// A private function used to pad or shorten a category to exactly the given width
+// Long categories keep their most specific end, e.g. "…users.create"
+func fitCategory(category string, width int) string {
+	length := utf8.RuneCountInString(category)
+	if length <= width {
+		return category + strings.Repeat(" ", width-length)
+	}
+	runes := []rune(category)
+	return "…" + string(runes[len(runes)-width+1:])
+}
+
+// A private function used to show a "file:line" reference relative to the root or module cache
+func shortenPath(root, line string) string {
+	if root != "" {
+		if relative, err := filepath.Rel(root, line); err == nil && !strings.HasPrefix(relative, "..") {
+			return relative
+		}
+	}
+	if index := strings.Index(line, "/pkg/mod/"); index >= 0 {
+		return line[index+len("/pkg/mod/"):]
+	}
+	return line
+}
+
+// A private function used to find the root of the module that the working directory belongs to
+func moduleRoot() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// A private function used to check if colors should be used for a writer
+// Colors are only used for terminals and never when NO_COLOR is set, see https://no-color.org
+func colorEnabled(w io.Writer, mode string) bool {
+	switch mode {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	file, ok := consoleFile(w)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// A private function used to find the file behind a writer, if any
+func consoleFile(w io.Writer) (*os.File, bool) {
+	switch v := w.(type) {
+	case *os.File:
+		return v, true
+	case stdout:
+		return os.Stdout, true
+	case stderr:
+		return os.Stderr, true
+	}
+	return nil, false
+}
+
+// A private function used to detect the width of the terminal a writer is attached to
+// COLUMNS takes precedence, otherwise the terminal is asked where supported
+func consoleWidth(w io.Writer) int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	if file, ok := consoleFile(w); ok {
+		if width := terminalWidth(file); width > 0 {
+			return width
+		}
+	}
+	return ConsoleDefaultWidth
+}
+
+// ConsoleHandler returns a handler that writes compact log entries for terminals
+// Colors are used when the writer is a terminal and NO_COLOR is not set, file paths are shown relative to the module root
+//
+// - inlineMeta: A flag indicating if meta should be rendered on the same line as key=value pairs
+func ConsoleHandler(w io.Writer, inlineMeta bool) H {
+	return WriterHandler(w, ConsoleFormatter{
+		Color:      colorEnabled(w, ColorAuto),
+		Root:       moduleRoot(),
+		Width:      consoleWidth(w),
+		InlineMeta: inlineMeta,
+	})
+}
+
+// A private function used to create a handler factory for console output
+//
+// Options:
+// - inline: A flag indicating if meta should be rendered inline (may be empty)
+// - color: Either "auto", "always" or "never" [NOTE: If empty will use auto.]
+// - root: The directory file paths are shown relative to [NOTE: If empty will use the module root.]
+// - width: The width the category column is fitted to [NOTE: If empty will detect the terminal width.]
+// - output, path: See formatterHandler
+func consoleHandler(options M) (H, error) {
+	options = copyOptions(options)
+	w, err := outputOption(options)
+	if err != nil {
+		return nil, err
+	}
+
+	formatter := ConsoleFormatter{Root: moduleRoot(), Width: consoleWidth(w)}
+	mode := ColorAuto
+	if value, ok := options["inline"]; ok {
+		if formatter.InlineMeta, ok = value.(bool); !ok {
+			return nil, fmt.Errorf("inline must be a boolean")
+		}
+		delete(options, "inline")
+	}
+	if value, ok := options["color"]; ok {
+		mode, _ = value.(string)
+		if mode != ColorAuto && mode != ColorAlways && mode != ColorNever {
+			return nil, fmt.Errorf("color must be auto, always or never")
+		}
+		delete(options, "color")
+	}
+	if value, ok := options["root"]; ok {
+		if formatter.Root, ok = value.(string); !ok {
+			return nil, fmt.Errorf("root must be a string")
+		}
+		delete(options, "root")
+	}
+	if value, ok := options["width"]; ok {
+		if formatter.Width, ok = parseInt(value); !ok {
+			return nil, fmt.Errorf("width must be a number")
+		}
+		delete(options, "width")
+	}
+	if err := unknownOptions(options); err != nil {
+		return nil, err
+	}
+	formatter.Color = colorEnabled(w, mode)
+	return WriterHandler(w, formatter), nil
+}
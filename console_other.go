@@ -0,0 +1,14 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin
+
+package diary
+
+import "os"
+
+// A private function used to ask the terminal behind the file for its width, not supported on this platform
+func terminalWidth(file *os.File) int {
+	return 0
+}
@@ -0,0 +1,25 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin
+
+package diary
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// A private function used to ask the terminal behind the file for its width
+func terminalWidth(file *os.File) int {
+	var size struct {
+		rows, columns, x, y uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0
+	}
+	return int(size.columns)
+}
@@ -93,3 +93,40 @@ func IsValidLevel(value int) bool {
 	}
 	return false
 }
+
+// A private function used to convert the level of a log entry, including trace enter and exit, into its numeric form
+func logLevel(value string) int {
+	switch value {
+	case TextLevelTraceEnter, TextLevelTraceExit:
+		return LevelTrace
+	}
+	return ConvertFromTextLevel(value)
+}
+
+// A private function used to check if a category falls under the given category prefix
+// E.g. "api" matches "api" and "api.users" but not "apis"
+func matchCategory(prefix, category string) bool {
+	return category == prefix || strings.HasPrefix(category, prefix+".")
+}
+
+func ConvertToTextLevel(value int) string {
+	switch value {
+	case LevelTrace:
+		return TextLevelTrace
+	case LevelDebug:
+		return TextLevelDebug
+	case LevelInfo:
+		return TextLevelInfo
+	case LevelNotice:
+		return TextLevelNotice
+	case LevelWarning:
+		return TextLevelWarning
+	case LevelError:
+		return TextLevelError
+	case LevelFatal:
+		return TextLevelFatal
+	case LevelAudit:
+		return TextLevelAudit
+	}
+	return ""
+}
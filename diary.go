@@ -7,20 +7,16 @@
 package diary
 
 import (
-	"fmt"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"math/rand"
 	"net"
 	"os"
-	"runtime"
-	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var counter int = 0
-var flux int = 0
-
 // Dear returns a diary.Diary interface instance for consumption
 //
 // - client: The shorthand code used to identify which client the log belongs to
@@ -35,7 +31,12 @@ var flux int = 0
 //
 // - level: The default level to log at [NOTE: Normally NOTICE for production services]
 // - handler: A routine to handle log entries  [NOTE: ]
-func Dear(client, project, service string, serviceMeta M, repository, commitHash string, commitTags []string, commitMeta M, level int, handler H) IDiary {
+func Dear(client, project, service string, serviceMeta M, repository, commitHash string, commitTags []string, commitMeta M, level int, handler H) IDiaryV2 {
+	return dear(client, project, service, serviceMeta, repository, commitHash, commitTags, commitMeta, level, handler)
+}
+
+// A private function used to create a diary instance, see Dear for a description of the parameters
+func dear(client, project, service string, serviceMeta M, repository, commitHash string, commitTags []string, commitMeta M, level int, handler H) *diary {
 	if level < LevelTrace || level > LevelAudit {
 		panic("level must be a value between 0 - 7")
 	}
@@ -66,9 +67,15 @@ func Dear(client, project, service string, serviceMeta M, repository, commitHash
 		}
 	}
 
-	return &diary{
-		Level:   level,
-		Handler: handler,
+	d := &diary{
+		settings:   &atomic.Pointer[settings]{},
+		sampler:    &sampler{},
+		booster:    &booster{},
+		aggregator: &aggregator{},
+		exiter:     &exiter{},
+		lifecycle:  &lifecycle{},
+		monitor:    &monitor{},
+		auditor:    &auditor{},
 		Service: Service{
 			Client:  client,
 			Project: project,
@@ -88,14 +95,176 @@ func Dear(client, project, service string, serviceMeta M, repository, commitHash
 			Meta:       commitMeta,
 		},
 	}
+	if handler != nil {
+		d.base = d.monitor.guard(baseHandlerName, handler, LevelTrace, nil)
+	}
+	d.settings.Store(&settings{
+		Config:     Config{Level: level, Categories: map[string]int{}},
+		Level:      level,
+		Categories: map[string]int{},
+		Handler:    d.base,
+	})
+	return d
 }
 
 // A private struct to encapsulate diary instance logic
+// The settings are shared by every copy of the diary so that they can be swapped at runtime
 type diary struct {
-	Level   int
-	Handler H
-	Service Service
-	Commit  Commit
+	settings   *atomic.Pointer[settings]
+	sampler    *sampler
+	booster    *booster
+	aggregator *aggregator
+	exiter     *exiter
+	lifecycle  *lifecycle
+	monitor    *monitor
+	auditor    *auditor
+	base       H
+	Service    Service
+	Commit     Commit
+}
+
+// A private struct to encapsulate the diary settings that may be changed at runtime
+// A settings instance is never modified once published, pages hold on to the instance they were created with
+// Only the cache of the encoded service and commit details is filled in later, see fragment, and the pages using the instance are counted, see acquire
+type settings struct {
+	Config     Config
+	Level      int
+	Sample     int
+	Catch      bool
+	Categories map[string]int
+	Handler    H
+	Audit      func(log Log) error
+	Redactor   *redactor
+	Resources  []interface{}
+	static     atomic.Pointer[jsonFragment]
+	pages      atomic.Int64
+}
+
+// current returns the settings that new pages will be created with
+func (d diary) current() *settings {
+	return d.settings.Load()
+}
+
+// levelFor returns the level to log at for the given category
+// The longest matching category override wins, otherwise the given level is used
+func (s *settings) levelFor(category string, level int) int {
+	match := ""
+	for prefix, override := range s.Categories {
+		if len(prefix) > len(match) && matchCategory(prefix, category) {
+			match = prefix
+			level = override
+		}
+	}
+	return level
+}
+
+// fragment returns the service and commit details of the log entry limited and encoded with these settings
+// The result is cached for the details of the diary instance, so that they are only limited and encoded once per settings
+func (s *settings) fragment(log Log) *jsonFragment {
+	if f := s.static.Load(); f != nil && sameStatic(f.givenService, f.givenCommit, log) {
+		return f
+	}
+	limited := s.Config.Limits.apply(Log{Service: log.Service, Commit: log.Commit}, s.Config.RedactKey)
+	data, err := appendJsonStatic(nil, limited.Service, limited.Commit)
+	if err != nil {
+		return nil
+	}
+	f := &jsonFragment{givenService: log.Service, givenCommit: log.Commit, service: limited.Service, commit: limited.Commit, data: data}
+	s.static.Store(f)
+	return f
+}
+
+// handle fingerprints errors, makes the log entry safe to encode, applies redaction and passes it on to the handler of the given settings
+// Once the diary instance is closed log entries are written to stderr instead, see IDiaryV2.Close
+func (d diary) handle(s *settings, log Log) {
+	log = d.prepare(s, log)
+	d.monitor.level(logLevel(log.Level)).emitted.Add(1)
+	d.dispatch(s, log)
+}
+
+// prepare fingerprints, limits and redacts a log entry before it reaches any handler
+func (d diary) prepare(s *settings, log Log) Log {
+	fingerprinted := log.Level == TextLevelError || log.Level == TextLevelFatal
+	if fingerprinted {
+		log.Fingerprint = fingerprint(log)
+	}
+	fragment := s.fragment(log)
+	if fragment != nil {
+		// the limited details are already safe, so the limits below leave them as they are
+		log.Service, log.Commit = fragment.service, fragment.commit
+	}
+	log = s.Redactor.apply(s.Config.Limits.apply(log, s.Config.RedactKey))
+	if fragment != nil && fragment.matches(log) {
+		log.static = fragment
+	}
+	if fingerprinted {
+		d.aggregator.record(log)
+	}
+	return log
+}
+
+// dispatch sends a prepared log entry to the handlers of the settings, or to stderr once the diary instance is closed
+func (d diary) dispatch(s *settings, log Log) {
+	if d.lifecycle.closed.Load() {
+		closedHandler(log)
+	} else if s.Handler != nil {
+		s.Handler(log)
+	} else {
+		d.monitor.standard()(log)
+	}
+}
+
+// system logs an entry about the diary instance itself with the current settings
+// These entries are not linked to any page and bypass level filtering
+func (d diary) system(level, category, message string, meta M) {
+	s := d.acquire()
+	defer d.release(s)
+	d.handle(s, Log{
+		Service:  d.Service,
+		Commit:   d.Commit,
+		Chain:    Chain{Id: primitive.NewObjectID().Hex(), Meta: M{}, Auth: Auth{Meta: M{}}},
+		Level:    level,
+		Category: category,
+		Line:     callerLine(1),
+		Stack:    "",
+		Message:  message,
+		Meta:     meta,
+		Time:     time.Now(),
+	})
+}
+
+// A private struct to encapsulate the trace sampling state of a diary instance
+type sampler struct {
+	mutex   sync.Mutex
+	counter int
+	flux    int
+}
+
+// seed picks a new flux for the given sample rate
+func (s *sampler) seed(sample int) {
+	fluxRate := int(float64(sample) * 0.05) // add 5% flux to ensure that a different trace is sampled each time
+	if fluxRate > 0 {
+		s.mutex.Lock()
+		s.flux = rand.Intn(fluxRate)
+		s.mutex.Unlock()
+	}
+}
+
+// sample reports if the next trace should be captured for the given sample rate
+func (s *sampler) sample(sample int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.counter++
+	if s.counter > sample-s.flux {
+		s.counter = 0
+		fluxRate := int(float64(sample) * 0.05) // add 5% flux to ensure that a different trace is sampled each time
+		if fluxRate > 0 {
+			s.flux = rand.Intn(fluxRate)
+		}
+		return true
+	}
+	return false
 }
 
 // Page issues a diary.Page interface instance for consumption
@@ -103,8 +272,8 @@ type diary struct {
 // This allows us to trace the entire page chain easily for troubleshooting and profiling
 //
 // - level: The default level to log at [NOTE: If -1 will inherit from diary instance]
-// - sample: A per second count indicating how frequently traces should be sampled, only applicable if level is higher than DEBUG [NOTE: if value is less than zero then will sample all traces]
-// - catch: A flag indicating if the scope should automatically catch and return errors. [NOTE: If set to true panics will be caught and returned as an error.]
+// - sample: A per second count indicating how frequently traces should be sampled, only applicable if level is higher than DEBUG [NOTE: If -1 will inherit from diary instance, any other value less than zero will sample all traces]
+// - catch: A flag indicating if the scope should automatically catch and return errors. [NOTE: If set to true panics will be caught and returned as an error. Always true if the diary instance is configured to catch.]
 // - category: The shorthand code used to identify the given workflow category [NOTE: Categories will be concatenated by dot-nation: "main.sub1.sub2.sub3".]
 // - authType: The shorthand code for the type of auth account (may be empty)
 // - authIdentifier: The identifier, which can be anything, used to identify the given auth account (may be empty) [WARNING: Don't ever log personal data without first encrypting or salt-hashing the data.]
@@ -120,15 +289,17 @@ func (d diary) Page(level int, sample int, catch bool, category string, pageMeta
 // This allows us to trace the entire page chain easily for troubleshooting and profiling
 //
 // - level: The default level to log at [NOTE: If -1 will inherit from diary instance]
-// - sample: A per second count indicating how frequently traces should be sampled, only applicable if level is higher than DEBUG [NOTE: if value is less than zero then will sample all traces]
-// - catch: A flag indicating if the scope should automatically catch and return errors. [NOTE: If set to true panics will be caught and returned as an error.]
+// - sample: A per second count indicating how frequently traces should be sampled, only applicable if level is higher than DEBUG [NOTE: If -1 will inherit from diary instance, any other value less than zero will sample all traces]
+// - catch: A flag indicating if the scope should automatically catch and return errors. [NOTE: If set to true panics will be caught and returned as an error. Always true if the diary instance is configured to catch.]
 // - category: The shorthand code used to identify the given workflow category [NOTE: Categories will be concatenated by dot-nation: "main.sub1.sub2.sub3".]
 // - authType: The shorthand code for the type of auth account (may be empty)
 // - authIdentifier: The identifier, which can be anything, used to identify the given auth account (may be empty) [WARNING: Don't ever log personal data without first encrypting or salt-hashing the data.]
 // - authMeta: Can contain any other additional data that you may require on logs for troubleshooting (may be empty) [WARNING: Don't ever log personal data without first encrypting or salt-hashing the data.]
 func (d diary) PageX(level int, sample int, catch bool, category string, pageMeta M, authType, authIdentifier string, authMeta M, scope S) (response error) {
+	settings := d.acquire()
+	defer d.release(settings)
 	if level == -1 {
-		level = d.Level
+		level = settings.Level
 	}
 	if level < LevelTrace || level > LevelAudit {
 		panic("level must be a value between 0 - 7 or -1 to use default level")
@@ -140,16 +311,17 @@ func (d diary) PageX(level int, sample int, catch bool, category string, pageMet
 	if pageMeta == nil {
 		pageMeta = M{}
 	}
+	if sample == -1 {
+		sample = settings.Sample
+	}
 	if sample < 0 {
 		sample = 0
 	}
-	fluxRate := int(float64(sample) * 0.05) // add 5% flux to ensure that a different trace is sampled each time
-	if fluxRate > 0 {
-		flux = rand.Intn(fluxRate)
-	}
+	d.sampler.seed(sample)
 
 	p := page{
-		Diary: d,
+		Diary:    d,
+		settings: settings,
 
 		Chain: Chain{
 			Id:   primitive.NewObjectID().Hex(),
@@ -162,7 +334,7 @@ func (d diary) PageX(level int, sample int, catch bool, category string, pageMet
 		},
 		Sample:   sample,
 		Level:    level,
-		Catch:    catch,
+		Catch:    catch || settings.Catch,
 		Category: strings.TrimPrefix(strings.TrimPrefix(category, d.Service.Service), "."),
 	}
 
@@ -176,6 +348,11 @@ func (d diary) Load(data []byte, category string, scope S) {
 }
 
 func (d diary) LoadX(data []byte, category string, scope S) error {
+	return d.loadX(data, category, nil, scope)
+}
+
+// loadX loads the page from its JSON definition with the given fields bound to it, see IPageV2.With
+func (d diary) loadX(data []byte, category string, fields M, scope S) error {
 	if len(strings.TrimSpace(category)) == 0 {
 		panic("category may not be empty")
 	}
@@ -183,16 +360,16 @@ func (d diary) LoadX(data []byte, category string, scope S) error {
 		panic("scope must be defined")
 	}
 
-	p, err := parsePage(data, d)
+	settings := d.acquire()
+	defer d.release(settings)
+
+	p, err := parsePage(data, d, settings)
 	if err != nil {
 		return err
 	}
+	p.Fields = fields
 	if !strings.HasSuffix(p.Category, category) {
-		if p.Category != "" {
-			p.Category = fmt.Sprintf("%s.%s", p.Category, category)
-		} else {
-			p.Category = category
-		}
+		p.Category = joinCategory(p.Category, category)
 	}
 
 	return pageScope(p, scope)
@@ -207,55 +384,23 @@ func pageScope(p page, scope S) (response error) {
 	if p.Catch {
 		defer func() {
 			if r := recover(); r != nil {
-				err := fmt.Errorf("%v", r)
-				if assertedErr, ok := r.(error); ok {
-					err = assertedErr
-				}
-				response = err
-
-				if p.Level > LevelError {
-					return
-				}
-
-				_, file, line, _ := runtime.Caller(2)
-				log := Log{
-					Service:  p.Diary.Service,
-					Commit:   p.Diary.Commit,
-					Chain:    p.Chain,
-					Level:    TextLevelError,
-					Category: cat,
-					Line:     fmt.Sprintf("%s:%d", file, line),
-					Stack:    string(debug.Stack()),
-					Message:  fmt.Sprint(response),
-					Meta:     M{},
-					Time:     time.Now(),
-				}
-				if p.Diary.Handler != nil {
-					p.Diary.Handler(log)
-				} else {
-					DefaultHandler(log)
-				}
+				response = p.recovered(cat, r)
 			}
 		}()
 	}
 
 	trace := true
-	if p.Level > LevelTrace {
-		trace = false
-		counter++
-		if counter > p.Sample-flux {
-			trace = true
-			counter = 0
-			fluxRate := int(float64(p.Sample) * 0.05) // add 5% flux to ensure that a different trace is sampled each time
-			if fluxRate > 0 {
-				flux = rand.Intn(fluxRate)
-			}
+	if !p.allowed(LevelTrace, cat) {
+		trace = p.Diary.sampler.sample(p.Sample)
+		if !trace {
+			// both the enter and exit entries are suppressed
+			p.Diary.monitor.level(LevelTrace).suppressed.Add(2)
 		}
 	}
 
 	if trace {
 		defer func() func() {
-			_, file, line, _ := runtime.Caller(3)
+			line := callerLine(3)
 			enter := time.Now()
 			log := Log{
 				Service:  p.Diary.Service,
@@ -263,16 +408,13 @@ func pageScope(p page, scope S) (response error) {
 				Chain:    p.Chain,
 				Level:    TextLevelTraceEnter,
 				Category: cat,
-				Line:     fmt.Sprintf("%s:%d", file, line),
+				Line:     line,
 				Stack:    "",
 				Message:  "",
+				Meta:     p.meta(nil),
 				Time:     time.Now(),
 			}
-			if p.Diary.Handler != nil {
-				p.Diary.Handler(log)
-			} else {
-				DefaultHandler(log)
-			}
+			p.Diary.handle(p.settings, log)
 			return func() {
 				exit := time.Now()
 				var minutes = exit.Sub(enter).Minutes()
@@ -296,24 +438,20 @@ func pageScope(p page, scope S) (response error) {
 					Chain:    p.Chain,
 					Level:    TextLevelTraceExit,
 					Category: cat,
-					Line:     fmt.Sprintf("%s:%d", file, line),
+					Line:     line,
 					Stack:    "",
 					Message:  "",
-					Meta: M{
+					Meta: p.meta(M{
 						"enter":    enter,
 						"exit":     exit,
 						"durationMinutes": minutes,
 						"durationSeconds": seconds,
 						"durationMilliSeconds": milliSeconds,
 						"durationMicroSeconds": microSeconds,
-					},
+					}),
 					Time: time.Now(),
 				}
-				if p.Diary.Handler != nil {
-					p.Diary.Handler(log)
-				} else {
-					DefaultHandler(log)
-				}
+				p.Diary.handle(p.settings, log)
 			}
 		}()()
 	}
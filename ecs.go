@@ -0,0 +1,258 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The version of the Elastic Common Schema that the EcsFormatter maps to
+const EcsVersion = "8.11.0"
+
+// The namespace used for fields without an ECS equivalent when none is given
+const EcsDefaultNamespace = "diary"
+
+// The top level fields and field sets of ECS 8.11, a namespace may not reuse them
+var ecsRoots = map[string]bool{
+	"@timestamp": true, "agent": true, "as": true, "client": true, "cloud": true, "code_signature": true, "container": true,
+	"data_stream": true, "destination": true, "device": true, "dll": true, "dns": true, "ecs": true, "elf": true, "email": true,
+	"error": true, "event": true, "faas": true, "file": true, "geo": true, "group": true, "hash": true, "host": true, "http": true,
+	"interface": true, "labels": true, "log": true, "macho": true, "message": true, "network": true, "observer": true,
+	"orchestrator": true, "organization": true, "os": true, "package": true, "pe": true, "process": true, "registry": true,
+	"related": true, "risk": true, "rule": true, "server": true, "service": true, "source": true, "span": true, "tags": true,
+	"threat": true, "tls": true, "trace": true, "transaction": true, "url": true, "user": true, "user_agent": true, "vlan": true,
+	"volume": true, "vulnerability": true, "x509": true,
+}
+
+// A private function used to check that a namespace doesn't overwrite ECS fields, e.g. "log" or "event.extra"
+func validEcsNamespace(namespace string) error {
+	root, _, _ := strings.Cut(namespace, ".")
+	if ecsRoots[strings.ToLower(root)] {
+		return fmt.Errorf("namespace %q collides with the ECS field %q", namespace, root)
+	}
+	return nil
+}
+
+// A public struct used to encode log entries as Elastic Common Schema (ECS) JSON lines
+//
+// Log and page fields are mapped as follows:
+// - Time: @timestamp
+// - Level: log.level [NOTE: Trace enter and exit are logged as trace with event.action set to enter or exit.]
+// - Category: log.logger
+// - Line: log.origin.file.name and log.origin.file.line
+// - Message: message, and error.message for error and fatal entries
+// - Stack: error.stack_trace
+// - Meta.error.type: error.type [NOTE: Only set for entries logged with IPageV2.Err.]
+// - Meta.audit.action, outcome and reason: event.action, event.outcome and event.reason [NOTE: Only set for entries logged with IPageV2.AuditEvent.]
+// - Service.Client: organization.name
+// - Service.Project: labels.project
+// - Service.Service: service.name
+// - Service.Host: host.hostname and host.name
+// - Service.HostIps: host.ip
+// - Service.ProcessId: process.pid
+// - Service.ParentProcessId: process.parent.pid
+// - Commit.Repository: labels.repository
+// - Commit.Hash: service.version
+// - Commit.Tags: tags
+// - Chain.Id: trace.id
+// - Chain.Auth.Type: labels.auth_type
+// - Chain.Auth.Identifier: user.id
+//
+// Meta, the message template, the stack frames and the fingerprint have no ECS equivalent and are placed below the namespace:
+// - Template: <namespace>.template
+// - Frames: <namespace>.frames
+// - Fingerprint: <namespace>.fingerprint
+// - Meta: <namespace>.meta
+// - Service.Meta: <namespace>.service.meta
+// - Commit.Meta: <namespace>.commit.meta
+// - Chain.Meta: <namespace>.chain.meta
+// - Chain.Auth.Meta: <namespace>.auth.meta
+//
+// - Namespace: The field that meta is placed below [NOTE: If empty will use "diary", may not be an ECS field such as "log" or "event".]
+type EcsFormatter struct {
+	Namespace string
+}
+
+func (f EcsFormatter) Format(dst []byte, log Log) ([]byte, error) {
+	namespace := f.Namespace
+	if namespace == "" {
+		namespace = EcsDefaultNamespace
+	}
+	if err := validEcsNamespace(namespace); err != nil {
+		return dst, err
+	}
+
+	level := log.Level
+	event := M{
+		"kind":    "event",
+		"dataset": fmt.Sprintf("%s.log", log.Service.Service),
+	}
+	switch log.Level {
+	case TextLevelTraceEnter, TextLevelTraceExit:
+		level = TextLevelTrace
+		event["action"] = log.Level
+	case TextLevelAudit:
+		event["category"] = []string{"iam"}
+		action, _, outcome, reason := auditFields(log)
+		setNonEmpty(event, "action", action)
+		setNonEmpty(event, "outcome", outcome)
+		setNonEmpty(event, "reason", reason)
+	}
+
+	origin := M{}
+	if file, line, ok := splitLine(log.Line); ok {
+		origin["file"] = M{"name": file, "line": line}
+	} else if log.Line != "" {
+		origin["file"] = M{"name": log.Line}
+	}
+
+	labels := M{}
+	setNonEmpty(labels, "project", log.Service.Project)
+	setNonEmpty(labels, "repository", log.Commit.Repository)
+	setNonEmpty(labels, "auth_type", log.Chain.Auth.Type)
+
+	service := M{"name": log.Service.Service}
+	setNonEmpty(service, "version", log.Commit.Hash)
+
+	host := M{"hostname": log.Service.Host, "name": log.Service.Host}
+	if len(log.Service.HostIps) > 0 {
+		host["ip"] = log.Service.HostIps
+	}
+
+	doc := M{
+		"log": M{
+			"logger": log.Category,
+			"origin": origin,
+		},
+		"event":   event,
+		"service": service,
+		"host":    host,
+		"process": M{
+			"pid":    log.Service.ProcessId,
+			"parent": M{"pid": log.Service.ParentProcessId},
+		},
+		"trace": M{"id": log.Chain.Id},
+	}
+	if log.Service.Client != "" {
+		doc["organization"] = M{"name": log.Service.Client}
+	}
+	if len(labels) > 0 {
+		doc["labels"] = labels
+	}
+	if len(log.Commit.Tags) > 0 {
+		doc["tags"] = log.Commit.Tags
+	}
+	if log.Chain.Auth.Identifier != "" {
+		doc["user"] = M{"id": log.Chain.Auth.Identifier}
+	}
+
+	errorFields := M{}
+	setNonEmpty(errorFields, "stack_trace", log.Stack)
+	if log.Level == TextLevelError || log.Level == TextLevelFatal {
+		setNonEmpty(errorFields, "message", log.Message)
+	}
+	switch details := log.Meta[MetaKeyError].(type) {
+	case M:
+		kind, _ := details["type"].(string)
+		setNonEmpty(errorFields, "type", kind)
+	case map[string]interface{}:
+		kind, _ := details["type"].(string)
+		setNonEmpty(errorFields, "type", kind)
+	}
+	if len(errorFields) > 0 {
+		doc["error"] = errorFields
+	}
+
+	extra := M{}
+	if log.Template != "" {
+		extra["template"] = log.Template
+	}
+	if len(log.Frames) > 0 {
+		extra["frames"] = log.Frames
+	}
+	if log.Fingerprint != "" {
+		extra["fingerprint"] = log.Fingerprint
+	}
+	if len(log.Meta) > 0 {
+		extra["meta"] = log.Meta
+	}
+	if len(log.Service.Meta) > 0 {
+		extra["service"] = M{"meta": log.Service.Meta}
+	}
+	if len(log.Commit.Meta) > 0 {
+		extra["commit"] = M{"meta": log.Commit.Meta}
+	}
+	if len(log.Chain.Meta) > 0 {
+		extra["chain"] = M{"meta": log.Chain.Meta}
+	}
+	if len(log.Chain.Auth.Meta) > 0 {
+		extra["auth"] = M{"meta": log.Chain.Auth.Meta}
+	}
+	if len(extra) > 0 {
+		doc[namespace] = extra
+	}
+
+	rest, err := json.Marshal(doc)
+	if err != nil {
+		return dst, err
+	}
+
+	// the ecs-logging specification asks for these fields first and in dotted form
+	dst = append(dst, `{"@timestamp":`...)
+	dst = strconv.AppendQuote(dst, log.Time.UTC().Format(time.RFC3339Nano))
+	dst = append(dst, `,"log.level":`...)
+	dst = strconv.AppendQuote(dst, level)
+	dst = append(dst, `,"message":`...)
+	message, _ := json.Marshal(log.Message)
+	dst = append(dst, message...)
+	dst = append(dst, `,"ecs.version":"`+EcsVersion+`",`...)
+	dst = append(dst, rest[1:]...)
+	return append(dst, '\n'), nil
+}
+
+// A private function used to split a "file:line" reference
+func splitLine(value string) (string, int, bool) {
+	index := strings.LastIndex(value, ":")
+	if index < 0 {
+		return "", 0, false
+	}
+	line, err := strconv.Atoi(value[index+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return value[:index], line, true
+}
+
+// A private function used to only set a field when it has a value
+func setNonEmpty(m M, key, value string) {
+	if value != "" {
+		m[key] = value
+	}
+}
+
+// A private function used to create a handler factory for ECS output
+//
+// Options:
+// - namespace: The field that meta is placed below [NOTE: If empty will use "diary"]
+// - output, path: See formatterHandler
+func ecsHandler(options M) (H, error) {
+	options = copyOptions(options)
+	formatter := EcsFormatter{}
+	if namespace, ok := options["namespace"]; ok {
+		formatter.Namespace, ok = namespace.(string)
+		if !ok {
+			return nil, fmt.Errorf("namespace must be a string")
+		}
+		if err := validEcsNamespace(formatter.Namespace); err != nil {
+			return nil, err
+		}
+		delete(options, "namespace")
+	}
+	return formatterHandler(formatter)(options)
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The ECS 8.11 field definitions of the fields EcsFormatter may emit, by flat name and type
+// see https://github.com/elastic/ecs/blob/8.11/generated/csv/fields.csv
+var ecsFields = map[string]string{
+	"@timestamp":           "date",
+	"ecs.version":          "keyword",
+	"message":              "match_only_text",
+	"log.level":            "keyword",
+	"log.logger":           "keyword",
+	"log.origin.file.name": "keyword",
+	"log.origin.file.line": "long",
+	"event.kind":           "keyword",
+	"event.dataset":        "keyword",
+	"event.action":         "keyword",
+	"event.category":       "keyword",
+	"event.outcome":        "keyword",
+	"event.reason":         "keyword",
+	"service.name":         "keyword",
+	"service.version":      "keyword",
+	"host.hostname":        "keyword",
+	"host.name":            "keyword",
+	"host.ip":              "ip",
+	"process.pid":          "long",
+	"process.parent.pid":   "long",
+	"trace.id":             "keyword",
+	"organization.name":    "keyword",
+	"tags":                 "keyword",
+	"user.id":              "keyword",
+	"error.stack_trace":    "wildcard",
+	"error.message":        "match_only_text",
+	"error.type":           "keyword",
+}
+
+// The allowed values of the ECS 8.11 categorization fields
+var ecsAllowed = map[string][]string{
+	"event.kind":     {"alert", "enrichment", "event", "metric", "state", "pipeline_error", "signal"},
+	"event.category": {"api", "authentication", "configuration", "database", "driver", "email", "file", "host", "iam", "intrusion_detection", "library", "malware", "network", "package", "process", "registry", "session", "threat", "vulnerability", "web"},
+	"event.outcome":  {"failure", "success", "unknown"},
+}
+
+// flattenEcs flattens a decoded ECS document into its flat field names, arrays of values are a single field
+func flattenEcs(prefix string, value interface{}, fields map[string]interface{}) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		fields[prefix] = value
+		return
+	}
+	for key, child := range object {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		flattenEcs(key, child, fields)
+	}
+}
+
+// checkEcsType reports if a decoded JSON value is valid for an ECS field type
+func checkEcsType(kind string, value interface{}) bool {
+	if values, ok := value.([]interface{}); ok {
+		for _, v := range values {
+			if !checkEcsType(kind, v) {
+				return false
+			}
+		}
+		return true
+	}
+	switch kind {
+	case "long":
+		_, ok := value.(float64)
+		return ok
+	case "date":
+		text, ok := value.(string)
+		if !ok {
+			return false
+		}
+		_, err := time.Parse(time.RFC3339Nano, text)
+		return err == nil
+	default:
+		_, ok := value.(string)
+		return ok
+	}
+}
+
+func TestEcsFormatterFields(t *testing.T) {
+	logs := map[string]Log{
+		"error": {
+			Service:     Service{Client: "uprate", Project: "diary", Service: "api", Host: "web-1", HostIps: []string{"10.0.0.1"}, ProcessId: 42, ParentProcessId: 1, Meta: M{"region": "eu"}},
+			Commit:      Commit{Repository: "github.com/uprate/diary", Hash: "abc123", Tags: []string{"v1.0.0"}, Meta: M{"branch": "main"}},
+			Chain:       Chain{Id: "chain-1", Meta: M{"request": "r-1"}, Auth: Auth{Type: "user", Identifier: "42", Meta: M{"role": "admin"}}},
+			Level:       TextLevelError,
+			Category:    "orders.create",
+			Line:        "/app/orders.go:12",
+			Stack:       "goroutine 1 [running]:",
+			Frames:      []Frame{{Function: "main.main", File: "/app/main.go", Line: 3}},
+			Fingerprint: "f00d",
+			Message:     "order failed",
+			Template:    "order {id} failed",
+			Meta:        M{MetaKeyError: M{"type": "*errors.errorString"}},
+			Time:        time.Now(),
+		},
+		"audit": {
+			Service:  Service{Service: "api", Host: "web-1"},
+			Chain:    Chain{Id: "chain-2", Auth: Auth{Type: "user", Identifier: "42"}},
+			Level:    TextLevelAudit,
+			Category: "orders",
+			Line:     "/app/orders.go:30",
+			Message:  "42 order.delete order/7: failure",
+			Meta:     M{MetaKeyAudit: M{"action": "order.delete", "target": "order/7", "outcome": AuditFailure, "reason": "denied"}},
+			Time:     time.Now(),
+		},
+		"trace": {
+			Service: Service{Service: "api"},
+			Level:   TextLevelTraceEnter,
+			Line:    "orders.go",
+			Time:    time.Now(),
+		},
+	}
+
+	for name, log := range logs {
+		t.Run(name, func(t *testing.T) {
+			out, err := EcsFormatter{Namespace: "uprate"}.Format(nil, log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var doc map[string]interface{}
+			if err := json.Unmarshal(out, &doc); err != nil {
+				t.Fatalf("invalid json %s: %v", out, err)
+			}
+
+			fields := map[string]interface{}{}
+			flattenEcs("", doc, fields)
+			for field, value := range fields {
+				if strings.HasPrefix(field, "uprate.") || strings.HasPrefix(field, "labels.") {
+					continue
+				}
+				kind, ok := ecsFields[field]
+				if !ok {
+					t.Errorf("%s is not an ECS 8.11 field", field)
+					continue
+				}
+				if !checkEcsType(kind, value) {
+					t.Errorf("%s: %v is not a valid %s", field, value, kind)
+				}
+				if allowed, ok := ecsAllowed[field]; ok {
+					values, ok := value.([]interface{})
+					if !ok {
+						values = []interface{}{value}
+					}
+					for _, v := range values {
+						if !containsString(allowed, v) {
+							t.Errorf("%s: %v is not an allowed value", field, v)
+						}
+					}
+				}
+			}
+			for _, field := range []string{"@timestamp", "ecs.version", "message", "log.level"} {
+				if _, ok := fields[field]; !ok {
+					t.Errorf("required field %s is missing", field)
+				}
+			}
+		})
+	}
+}
+
+func TestEcsFormatterNamespace(t *testing.T) {
+	for _, namespace := range []string{"log", "event", "host", "Labels", "error.extra", "@timestamp"} {
+		if _, err := (EcsFormatter{Namespace: namespace}).Format(nil, Log{Meta: M{"a": 1}}); err == nil {
+			t.Errorf("namespace %q was accepted", namespace)
+		}
+		if _, err := ecsHandler(M{"namespace": namespace}); err == nil {
+			t.Errorf("namespace option %q was accepted", namespace)
+		}
+	}
+
+	var doc map[string]interface{}
+	out, err := EcsFormatter{}.Format(nil, Log{Meta: M{"a": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc[EcsDefaultNamespace].(map[string]interface{}); !ok {
+		t.Errorf("meta isn't below the default namespace: %s", out)
+	}
+}
+
+// containsString reports if a list of strings contains the decoded value
+func containsString(list []string, value interface{}) bool {
+	text, _ := value.(string)
+	for _, item := range list {
+		if item == text {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,396 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// A private struct to encapsulate the encoded service and commit details of a log entry
+// These rarely change within a process so they are limited and encoded once per settings of a diary instance, see settings.fragment
+// [NOTE: The service and commit meta of a diary instance must not be modified once the instance has been created.]
+//
+// - givenService: The service details as given to the diary instance
+// - givenCommit: The commit details as given to the diary instance
+// - service: The service details with the limits applied, the ones that were encoded
+// - commit: The commit details with the limits applied, the ones that were encoded
+type jsonFragment struct {
+	givenService Service
+	givenCommit  Commit
+	service      Service
+	commit       Commit
+	data         []byte
+}
+
+// matches checks if the log entry still refers to the service and commit details that were encoded
+func (f *jsonFragment) matches(log Log) bool {
+	return sameStatic(f.service, f.commit, log)
+}
+
+// A private function used to check if the log entry refers to the same service and commit details
+// Meta maps and lists are compared by identity so that the check stays cheap
+func sameStatic(service Service, commit Commit, log Log) bool {
+	return service.Client == log.Service.Client &&
+		service.Project == log.Service.Project &&
+		service.Service == log.Service.Service &&
+		service.Host == log.Service.Host &&
+		service.ProcessId == log.Service.ProcessId &&
+		service.ParentProcessId == log.Service.ParentProcessId &&
+		sameStrings(service.HostIps, log.Service.HostIps) &&
+		sameMeta(service.Meta, log.Service.Meta) &&
+		commit.Repository == log.Commit.Repository &&
+		commit.Hash == log.Commit.Hash &&
+		sameStrings(commit.Tags, log.Commit.Tags) &&
+		sameMeta(commit.Meta, log.Commit.Meta)
+}
+
+// A private function used to check if two lists share the same backing array
+func sameStrings(a, b []string) bool {
+	return (a == nil) == (b == nil) && len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// A private function used to check if two meta values are the same map
+func sameMeta(a, b M) bool {
+	return reflect.ValueOf(a).UnsafePointer() == reflect.ValueOf(b).UnsafePointer()
+}
+
+// A private function used to append a log entry as JSON with the same output as json.Marshal, without boxing the entry or its meta
+func appendJsonLog(dst []byte, log Log) ([]byte, error) {
+	var err error
+	dst = append(dst, '{')
+	if fragment := log.static; fragment != nil && fragment.matches(log) {
+		dst = append(dst, fragment.data...)
+	} else if dst, err = appendJsonStatic(dst, log.Service, log.Commit); err != nil {
+		return dst, err
+	}
+	dst = append(dst, `,"chain":{"id":`...)
+	dst = appendJsonString(dst, log.Chain.Id)
+	dst = append(dst, `,"meta":`...)
+	if dst, err = appendJsonMeta(dst, log.Chain.Meta); err != nil {
+		return dst, err
+	}
+	dst = append(dst, `,"auth":{"type":`...)
+	dst = appendJsonString(dst, log.Chain.Auth.Type)
+	dst = append(dst, `,"identifier":`...)
+	dst = appendJsonString(dst, log.Chain.Auth.Identifier)
+	dst = append(dst, `,"meta":`...)
+	if dst, err = appendJsonMeta(dst, log.Chain.Auth.Meta); err != nil {
+		return dst, err
+	}
+	dst = append(dst, `}},"level":`...)
+	dst = appendJsonString(dst, log.Level)
+	dst = append(dst, `,"category":`...)
+	dst = appendJsonString(dst, log.Category)
+	dst = append(dst, `,"line":`...)
+	dst = appendJsonString(dst, log.Line)
+	dst = append(dst, `,"stack":`...)
+	dst = appendJsonString(dst, log.Stack)
+	if len(log.Frames) > 0 {
+		dst = append(dst, `,"frames":`...)
+		dst = appendJsonFrames(dst, log.Frames)
+	}
+	if log.Fingerprint != "" {
+		dst = append(dst, `,"fingerprint":`...)
+		dst = appendJsonString(dst, log.Fingerprint)
+	}
+	dst = append(dst, `,"message":`...)
+	dst = appendJsonString(dst, log.Message)
+	if log.Template != "" {
+		dst = append(dst, `,"template":`...)
+		dst = appendJsonString(dst, log.Template)
+	}
+	dst = append(dst, `,"meta":`...)
+	if dst, err = appendJsonMeta(dst, log.Meta); err != nil {
+		return dst, err
+	}
+	dst = append(dst, `,"time":`...)
+	if dst, err = appendJsonTime(dst, log.Time); err != nil {
+		return dst, err
+	}
+	return append(dst, '}'), nil
+}
+
+// A private function used to append stack frames, optional fields are omitted like encoding/json omits them
+func appendJsonFrames(dst []byte, frames []Frame) []byte {
+	dst = append(dst, '[')
+	for i, frame := range frames {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, `{"function":`...)
+		dst = appendJsonString(dst, frame.Function)
+		dst = append(dst, `,"file":`...)
+		dst = appendJsonString(dst, frame.File)
+		dst = append(dst, `,"line":`...)
+		dst = strconv.AppendInt(dst, int64(frame.Line), 10)
+		if frame.Module != "" {
+			dst = append(dst, `,"module":`...)
+			dst = appendJsonString(dst, frame.Module)
+		}
+		if frame.Version != "" {
+			dst = append(dst, `,"version":`...)
+			dst = appendJsonString(dst, frame.Version)
+		}
+		dst = append(dst, '}')
+	}
+	return append(dst, ']')
+}
+
+// A private function used to append the service and commit details, see jsonFragment
+func appendJsonStatic(dst []byte, service Service, commit Commit) ([]byte, error) {
+	var err error
+	dst = append(dst, `"service":{"client":`...)
+	dst = appendJsonString(dst, service.Client)
+	dst = append(dst, `,"project":`...)
+	dst = appendJsonString(dst, service.Project)
+	dst = append(dst, `,"service":`...)
+	dst = appendJsonString(dst, service.Service)
+	dst = append(dst, `,"host":`...)
+	dst = appendJsonString(dst, service.Host)
+	dst = append(dst, `,"hostIps":`...)
+	dst = appendJsonStrings(dst, service.HostIps)
+	dst = append(dst, `,"pid":`...)
+	dst = strconv.AppendInt(dst, int64(service.ProcessId), 10)
+	dst = append(dst, `,"ppid":`...)
+	dst = strconv.AppendInt(dst, int64(service.ParentProcessId), 10)
+	dst = append(dst, `,"meta":`...)
+	if dst, err = appendJsonMeta(dst, service.Meta); err != nil {
+		return dst, err
+	}
+	dst = append(dst, `},"commit":{"repository":`...)
+	dst = appendJsonString(dst, commit.Repository)
+	dst = append(dst, `,"hash":`...)
+	dst = appendJsonString(dst, commit.Hash)
+	dst = append(dst, `,"tags":`...)
+	dst = appendJsonStrings(dst, commit.Tags)
+	dst = append(dst, `,"meta":`...)
+	if dst, err = appendJsonMeta(dst, commit.Meta); err != nil {
+		return dst, err
+	}
+	return append(dst, '}'), nil
+}
+
+// A private function used to append a list of strings, nil is encoded as null
+func appendJsonStrings(dst []byte, values []string) []byte {
+	if values == nil {
+		return append(dst, "null"...)
+	}
+	dst = append(dst, '[')
+	for i, value := range values {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJsonString(dst, value)
+	}
+	return append(dst, ']')
+}
+
+// A private function used to append meta with its keys in sorted order, nil is encoded as null
+func appendJsonMeta(dst []byte, meta map[string]interface{}) ([]byte, error) {
+	if meta == nil {
+		return append(dst, "null"...), nil
+	}
+	var err error
+	var buffer [16]string
+	dst = append(dst, '{')
+	for i, key := range sortKeys(buffer[:0], meta) {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJsonString(dst, key)
+		dst = append(dst, ':')
+		if dst, err = appendJsonValue(dst, meta[key]); err != nil {
+			return dst, err
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+// A private function used to append a single meta value
+// The common types are encoded directly, any other type is left to encoding/json
+func appendJsonValue(dst []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(dst, "null"...), nil
+	case bool:
+		return strconv.AppendBool(dst, v), nil
+	case string:
+		return appendJsonString(dst, v), nil
+	case int:
+		return strconv.AppendInt(dst, int64(v), 10), nil
+	case int8:
+		return strconv.AppendInt(dst, int64(v), 10), nil
+	case int16:
+		return strconv.AppendInt(dst, int64(v), 10), nil
+	case int32:
+		return strconv.AppendInt(dst, int64(v), 10), nil
+	case int64:
+		return strconv.AppendInt(dst, v, 10), nil
+	case uint:
+		return strconv.AppendUint(dst, uint64(v), 10), nil
+	case uint8:
+		return strconv.AppendUint(dst, uint64(v), 10), nil
+	case uint16:
+		return strconv.AppendUint(dst, uint64(v), 10), nil
+	case uint32:
+		return strconv.AppendUint(dst, uint64(v), 10), nil
+	case uint64:
+		return strconv.AppendUint(dst, v, 10), nil
+	case float32:
+		return appendJsonFloat(dst, float64(v), 32)
+	case float64:
+		return appendJsonFloat(dst, v, 64)
+	case time.Time:
+		return appendJsonTime(dst, v)
+	case []byte:
+		if v == nil {
+			return append(dst, "null"...), nil
+		}
+		n := len(dst) + 1
+		dst = append(dst, make([]byte, base64.StdEncoding.EncodedLen(len(v))+2)...)
+		base64.StdEncoding.Encode(dst[n:], v)
+		dst[n-1], dst[len(dst)-1] = '"', '"'
+		return dst, nil
+	case M:
+		return appendJsonMeta(dst, v)
+	case map[string]interface{}:
+		return appendJsonMeta(dst, v)
+	case []interface{}:
+		if v == nil {
+			return append(dst, "null"...), nil
+		}
+		var err error
+		dst = append(dst, '[')
+		for i, item := range v {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			if dst, err = appendJsonValue(dst, item); err != nil {
+				return dst, err
+			}
+		}
+		return append(dst, ']'), nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, data...), nil
+}
+
+// A private function used to append a float the way encoding/json formats it
+func appendJsonFloat(dst []byte, value float64, bits int) ([]byte, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return dst, &json.UnsupportedValueError{Value: reflect.ValueOf(value), Str: strconv.FormatFloat(value, 'g', -1, bits)}
+	}
+
+	// exponents are used for very small and very large values only, e.g. 1e-7 and 1e+21
+	format := byte('f')
+	if abs := math.Abs(value); abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) || bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			format = 'e'
+		}
+	}
+	dst = strconv.AppendFloat(dst, value, format, -1, bits)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst, nil
+}
+
+// A private function used to append a time the way time.Time.MarshalJSON formats it
+func appendJsonTime(dst []byte, value time.Time) ([]byte, error) {
+	if year := value.Year(); year < 0 || year > 9999 {
+		data, err := value.MarshalJSON()
+		return append(dst, data...), err
+	}
+	dst = append(dst, '"')
+	dst = value.AppendFormat(dst, time.RFC3339Nano)
+	return append(dst, '"'), nil
+}
+
+// A private function used to append a quoted string with the same escaping as encoding/json, including its HTML escaping
+func appendJsonString(dst []byte, value string) []byte {
+	const hex = "0123456789abcdef"
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(value); {
+		if b := value[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, value[start:i]...)
+			switch b {
+			case '\\', '"':
+				dst = append(dst, '\\', b)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hex[b>>4], hex[b&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(value[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, value[start:i]...)
+			dst = append(dst, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 are valid JSON but not valid JavaScript
+		if r == '\u2028' || r == '\u2029' {
+			dst = append(dst, value[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hex[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, value[start:]...)
+	return append(dst, '"')
+}
+
+// A private function used to append the keys of a map to the buffer in sorted order
+// Maps that fit the buffer are sorted in place so that a buffer on the stack avoids an allocation
+func sortKeys[T any](buffer []string, m map[string]T) []string {
+	if len(m) > cap(buffer) {
+		return sortedKeys(m)
+	}
+	for key := range m {
+		buffer = append(buffer, key)
+	}
+	for i := 1; i < len(buffer); i++ {
+		for j := i; j > 0 && buffer[j] < buffer[j-1]; j-- {
+			buffer[j], buffer[j-1] = buffer[j-1], buffer[j]
+		}
+	}
+	return buffer
+}
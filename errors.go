@@ -0,0 +1,132 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// The meta key Err logs the error details under, see IPageV2.Err
+const MetaKeyError = "error"
+
+// The most causes of an error chain that are logged, longer chains are cut off
+const maxErrorCauses = 32
+
+// An definition of an error that provides fields to merge into the meta of the log entry, see IPageV2.Err
+// [NOTE: The fields of outer errors take precedence over the fields of the errors they wrap.]
+type ErrorFields interface {
+	LogFields() M
+}
+
+// An definition of an error that captured the program counters of its creation site, see IPageV2.Err
+type ErrorCallers interface {
+	Callers() []uintptr
+}
+
+// A private function used to describe an error and its chain for the meta of a log entry
+// The chain is walked depth first through Unwrap() error and Unwrap() []error
+//
+// - return: The error details, the fields of the chain and the program counters of its deepest error with a stack [NOTE: Nil if no error in the chain captured a stack.]
+func describeError(err error) (M, M, []uintptr) {
+	causes := make([]interface{}, 0, 4)
+	var fields M
+	var stack []uintptr
+
+	pending := []error{err}
+	for visited := 0; len(pending) > 0 && visited <= maxErrorCauses; visited++ {
+		current := pending[0]
+		pending = pending[1:]
+		if current == nil {
+			continue
+		}
+		if visited > 0 {
+			causes = append(causes, M{"message": errorMessage(current), "type": fmt.Sprintf("%T", current)})
+		}
+		provided, pcs, wrapped := unwrapError(current)
+		for key, value := range provided {
+			if _, ok := fields[key]; !ok {
+				if fields == nil {
+					fields = M{}
+				}
+				fields[key] = value
+			}
+		}
+		if len(pcs) > 0 {
+			stack = pcs
+		}
+		pending = append(wrapped, pending...)
+	}
+
+	details := M{"message": errorMessage(err), "type": fmt.Sprintf("%T", err)}
+	if len(causes) > 0 {
+		details["causes"] = causes
+	}
+	return details, fields, stack
+}
+
+// A private function used to read the message of an error, recovering from a panicking Error method like fmt does, e.g. of a typed nil pointer
+func errorMessage(err error) (message string) {
+	defer func() {
+		if r := recover(); r != nil {
+			if v := reflect.ValueOf(err); v.Kind() == reflect.Pointer && v.IsNil() {
+				message = "<nil>"
+				return
+			}
+			message = fmt.Sprintf("%%!v(PANIC=Error method: %v)", r)
+		}
+	}()
+	return err.Error()
+}
+
+// A private function used to read the fields, the program counters and the wrapped errors of a single error of a chain
+// A panicking method, e.g. of a typed nil pointer, ends the chain at the error instead of failing the log entry
+func unwrapError(err error) (fields M, pcs []uintptr, wrapped []error) {
+	defer func() {
+		if recover() != nil {
+			wrapped = nil
+		}
+	}()
+	if provider, ok := err.(ErrorFields); ok {
+		fields = provider.LogFields()
+	}
+	pcs = errorCallers(err)
+	switch wrapper := err.(type) {
+	case interface{ Unwrap() error }:
+		wrapped = []error{wrapper.Unwrap()}
+	case interface{ Unwrap() []error }:
+		wrapped = append([]error{}, wrapper.Unwrap()...)
+	}
+	return fields, pcs, wrapped
+}
+
+// A private function used to read the program counters an error captured at its creation site
+// Besides ErrorCallers the StackTrace method of github.com/pkg/errors is supported, which returns a list of program counters by another type
+func errorCallers(err error) (pcs []uintptr) {
+	if callers, ok := err.(ErrorCallers); ok {
+		return callers.Callers()
+	}
+
+	method := reflect.ValueOf(err).MethodByName("StackTrace")
+	if !method.IsValid() || method.Type().NumIn() != 0 || method.Type().NumOut() != 1 {
+		return nil
+	}
+	out := method.Type().Out(0)
+	if out.Kind() != reflect.Slice || out.Elem().Kind() != reflect.Uintptr {
+		return nil
+	}
+	defer func() {
+		if recover() != nil {
+			pcs = nil
+		}
+	}()
+	frames := method.Call(nil)[0]
+	pcs = make([]uintptr, frames.Len())
+	for i := range pcs {
+		// github.com/pkg/errors stores the return address, like runtime.Callers does
+		pcs[i] = uintptr(frames.Index(i).Uint())
+	}
+	return pcs
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// A private error that provides fields, and dereferences itself so that a typed nil pointer panics
+type fieldsError struct {
+	message string
+	fields  M
+	wrapped error
+}
+
+func (e *fieldsError) Error() string {
+	return e.message
+}
+
+func (e *fieldsError) LogFields() M {
+	return e.fields
+}
+
+func (e *fieldsError) Unwrap() error {
+	return e.wrapped
+}
+
+// A private frame and stack trace that mirror the types of github.com/pkg/errors
+type pkgFrame uintptr
+type pkgStackTrace []pkgFrame
+
+// A private error with a github.com/pkg/errors style stack trace
+type pkgError struct {
+	stack pkgStackTrace
+}
+
+func (e pkgError) Error() string {
+	return "pkg"
+}
+
+func (e pkgError) StackTrace() pkgStackTrace {
+	return e.stack
+}
+
+// causeMessages returns the messages of the causes in the error details
+func causeMessages(details M) []string {
+	var messages []string
+	causes, _ := details["causes"].([]interface{})
+	for _, cause := range causes {
+		messages = append(messages, cause.(M)["message"].(string))
+	}
+	return messages
+}
+
+func TestDescribeErrorJoined(t *testing.T) {
+	first, second := errors.New("first"), errors.New("second")
+	err := fmt.Errorf("outer: %w", errors.Join(first, fmt.Errorf("wrapped: %w", second)))
+
+	details, _, _ := describeError(err)
+	if details["message"] != err.Error() || details["type"] != "*fmt.wrapError" {
+		t.Errorf("unexpected details %v", details)
+	}
+	expected := []string{"first\nwrapped: second", "first", "wrapped: second", "second"}
+	if causes := causeMessages(details); !reflect.DeepEqual(causes, expected) {
+		t.Errorf("expected causes %q but got %q", expected, causes)
+	}
+}
+
+func TestDescribeErrorFields(t *testing.T) {
+	inner := &fieldsError{message: "inner", fields: M{"user": "inner", "query": "select"}}
+	outer := &fieldsError{message: "outer", fields: M{"user": "outer", "retry": 2}, wrapped: fmt.Errorf("context: %w", inner)}
+
+	_, fields, _ := describeError(outer)
+	if expected := (M{"user": "outer", "retry": 2, "query": "select"}); !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expected fields %v but got %v", expected, fields)
+	}
+
+	var logged Log
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelError, func(log Log) {
+		if log.Level == TextLevelError {
+			logged = log
+		}
+	})
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.(IPageV2).Err("run", outer, M{"retry": 3})
+	})
+	if logged.Message != "outer" || logged.Meta["user"] != "outer" || logged.Meta["query"] != "select" {
+		t.Errorf("the error fields weren't merged: %v", logged.Meta)
+	}
+	if logged.Meta["retry"] != 3 {
+		t.Errorf("the meta doesn't take precedence over the error fields: %v", logged.Meta["retry"])
+	}
+}
+
+func TestDescribeErrorTypedNil(t *testing.T) {
+	var typedNil *fieldsError
+	err := fmt.Errorf("outer: %w", error(typedNil))
+
+	details, fields, _ := describeError(typedNil)
+	if details["message"] != "<nil>" || details["type"] != "*diary.fieldsError" || fields != nil {
+		t.Errorf("unexpected details %v and fields %v", details, fields)
+	}
+	details, _, _ = describeError(err)
+	if causes := causeMessages(details); !reflect.DeepEqual(causes, []string{"<nil>"}) {
+		t.Errorf("unexpected causes %q", causes)
+	}
+
+	var logged Log
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelError, func(log Log) {
+		if log.Level == TextLevelError {
+			logged = log
+		}
+	})
+	err = d.PageX(-1, 0, true, "jobs", nil, "", "", nil, func(p IPage) {
+		p.(IPageV2).Err("run", typedNil, nil)
+	})
+	if err != nil || logged.Message != "<nil>" {
+		t.Errorf("a typed nil error wasn't logged: %v %+v", err, logged)
+	}
+}
+
+func TestDescribeErrorPkgStackTrace(t *testing.T) {
+	pcs := make([]uintptr, 16)
+	pcs = pcs[:runtime.Callers(1, pcs)]
+	stack := make(pkgStackTrace, len(pcs))
+	for i, pc := range pcs {
+		stack[i] = pkgFrame(pc)
+	}
+
+	_, _, captured := describeError(fmt.Errorf("wrapped: %w", pkgError{stack: stack}))
+	if !reflect.DeepEqual(captured, pcs) {
+		t.Errorf("expected the program counters of the stack trace %v but got %v", pcs, captured)
+	}
+	frames := runtime.CallersFrames(captured)
+	if frame, _ := frames.Next(); frame.Function != "github.com/go-diary/diary.TestDescribeErrorPkgStackTrace" {
+		t.Errorf("expected the creation site first but got %s", frame.Function)
+	}
+}
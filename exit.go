@@ -0,0 +1,101 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// The time the exit hooks are given to finish when no other value has been given, see Config.ExitTimeout
+const DefaultExitTimeout = 5 * time.Second
+
+// A package shorthand for a routine that runs before the process exits, e.g. to flush a handler or close a file
+// [NOTE: Hooks should give up once the context is done, the process exits regardless.]
+type ExitHook func(ctx context.Context) error
+
+// A private struct to encapsulate how a diary instance exits the process
+//
+// - exit: The function used to exit [NOTE: If nil will use os.Exit]
+type exiter struct {
+	mutex sync.Mutex
+	hooks []ExitHook
+	exit  func(code int)
+}
+
+// OnExit registers a hook that runs before the diary exits the process, e.g. on Fatal
+// Hooks run one after another in the order they were registered and share a single timeout, see Config.ExitTimeout
+func (d diary) OnExit(hook ExitHook) {
+	if hook == nil {
+		panic("hook must be defined")
+	}
+	d.exiter.mutex.Lock()
+	d.exiter.hooks = append(d.exiter.hooks, hook)
+	d.exiter.mutex.Unlock()
+}
+
+// SetExit replaces the function used to exit the process, so that code paths using Fatal can be tested
+//
+// - exit: (may be nil) [NOTE: If nil will restore os.Exit.]
+func (d diary) SetExit(exit func(code int)) {
+	d.exiter.mutex.Lock()
+	d.exiter.exit = exit
+	d.exiter.mutex.Unlock()
+}
+
+// exit runs the exit hooks and closes the diary instance within the exit timeout, and then exits the process, see IDiaryV2.Close
+// Hook errors and hooks that don't finish in time are reported on stderr, since the handlers may no longer be usable
+func (d diary) exit(code int) {
+	d.exiter.mutex.Lock()
+	hooks := append([]ExitHook{}, d.exiter.hooks...)
+	exit := d.exiter.exit
+	d.exiter.mutex.Unlock()
+	// an injected exit may return, e.g. in tests, so the diary is only flushed instead of closed
+	finish := d.Flush
+	if exit == nil {
+		exit = os.Exit
+		finish = d.Close
+	}
+
+	timeout := d.current().Config.ExitTimeout
+	if timeout <= 0 {
+		timeout = DefaultExitTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i, hook := range hooks {
+			if err := runExitHook(ctx, hook); err != nil {
+				fmt.Fprintf(os.Stderr, "diary: exit hook %d failed: %v\n", i, err)
+			}
+		}
+		// the handlers are closed last so that the hooks can still log
+		if err := finish(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "diary: closing the handlers failed: %v\n", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		fmt.Fprintf(os.Stderr, "diary: exit hooks did not finish within %s\n", timeout)
+	}
+	cancel()
+
+	exit(code)
+}
+
+// A private function used to run a single exit hook, a panicking hook is reported as an error so the remaining hooks still run
+func runExitHook(ctx context.Context, hook ExitHook) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return hook(ctx)
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFatalRunsExitHooks(t *testing.T) {
+	recorder := &logRecorder{}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, recorder.handler)
+	var calls []string
+	d.OnExit(func(ctx context.Context) error {
+		calls = append(calls, "first")
+		d.Page(-1, 0, false, "hooks", nil, "", "", nil, func(p IPage) {
+			p.Notice("flush", nil)
+		})
+		return nil
+	})
+	d.OnExit(func(ctx context.Context) error {
+		calls = append(calls, "failing")
+		panic("hook failed")
+	})
+	d.OnExit(func(ctx context.Context) error {
+		calls = append(calls, "last")
+		return errors.New("ignored")
+	})
+	exited := -1
+	d.SetExit(func(code int) {
+		calls = append(calls, "exit")
+		exited = code
+	})
+
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Fatal("run", "unrecoverable", 4, nil)
+	})
+	if exited != 4 {
+		t.Errorf("expected the process to exit with 4 but got %d", exited)
+	}
+	if expected := []string{"first", "failing", "last", "exit"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected the calls %q but got %q", expected, calls)
+	}
+	if len(recorder.find("jobs.run", "unrecoverable")) != 1 || len(recorder.find("hooks.flush", "")) != 1 {
+		t.Errorf("expected the fatal entry and the entry of the hook to be logged")
+	}
+
+	d.SetExit(nil)
+	if d.(*diary).exiter.exit != nil {
+		t.Errorf("SetExit(nil) didn't restore os.Exit")
+	}
+}
+
+func TestExitTimeout(t *testing.T) {
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, func(log Log) {})
+	config := DefaultConfig()
+	config.ExitTimeout = 20 * time.Millisecond
+	if err := d.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	deadlines := make(chan time.Time, 1)
+	d.OnExit(func(ctx context.Context) error {
+		deadline, _ := ctx.Deadline()
+		deadlines <- deadline
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	exited := make(chan int, 1)
+	d.SetExit(func(code int) {
+		exited <- code
+	})
+
+	start := time.Now()
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Fatal("run", "stuck", 1, nil)
+	})
+	select {
+	case code := <-exited:
+		if code != 1 {
+			t.Errorf("expected the process to exit with 1 but got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("a hook that doesn't finish kept the process from exiting")
+	}
+	if deadline := <-deadlines; deadline.IsZero() || deadline.Sub(start) > time.Second {
+		t.Errorf("expected the hook context to end with the exit timeout, got the deadline %s", deadline)
+	}
+}
+
+func TestPanicExit(t *testing.T) {
+	for _, c := range []struct {
+		code     int
+		expected int
+	}{{0, 2}, {3, 3}} {
+		// the exit policy can only be tested with an injected exit
+		d, panics := panicDiary(t, PanicConfig{Policy: PanicExit, ExitCode: c.code})
+		exited := -1
+		d.SetExit(func(code int) {
+			if len(*panics) != 1 {
+				t.Errorf("the process exited before the panic was logged")
+			}
+			exited = code
+		})
+		err := d.PageX(-1, 0, true, "jobs", nil, "", "", nil, func(p IPage) {
+			panic("fatal")
+		})
+		if exited != c.expected {
+			t.Errorf("exit code %d: expected the process to exit with %d, got %d", c.code, c.expected, exited)
+		}
+		// an injected exit returns, so the scope still returns the panic
+		if err == nil || err.Error() != "fatal" {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+}
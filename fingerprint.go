@@ -0,0 +1,252 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The number of in-app stack frames that are part of a fingerprint
+const fingerprintFrames = 3
+
+// The most fingerprints an aggregator keeps track of, once it's reached the least recently seen group makes way for a new fingerprint
+const maxErrorGroups = 1024
+
+// A public struct to encapsulate the occurrences of the errors sharing a fingerprint, see IDiaryV2.AggregateErrors
+//
+// - Message: The message of the first occurrence
+// - Count: The number of occurrences since the previous report
+// - Total: The number of occurrences since the aggregation started
+type ErrorGroup struct {
+	Fingerprint string    `json:"fingerprint"`
+	Level       string    `json:"level"`
+	Category    string    `json:"category"`
+	Message     string    `json:"message"`
+	Count       int       `json:"count"`
+	Total       int       `json:"total"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// A private function used to compute the stable fingerprint of an error or fatal log entry
+// The fingerprint is built from the category, the message template and the functions of the top in-app stack frames, see appFrame
+// Messages without a template are normalized first, see normalizeMessage, line numbers are left out so a fingerprint survives unrelated changes
+func fingerprint(log Log) string {
+	template := log.Template
+	if template == "" {
+		template = normalizeMessage(log.Message)
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(log.Category))
+	h.Write([]byte{0})
+	h.Write([]byte(template))
+	frames := 0
+	for _, frame := range log.Frames {
+		if frames == fingerprintFrames {
+			break
+		}
+		if !appFrame(frame) {
+			continue
+		}
+		h.Write([]byte{0})
+		h.Write([]byte(frame.Function))
+		frames++
+	}
+
+	sum := strconv.FormatUint(h.Sum64(), 16)
+	return strings.Repeat("0", 16-len(sum)) + sum
+}
+
+// A private function used to replace the variable parts of a message, so that messages of the same error share a fingerprint
+// Quoted strings are replaced with "{s}" and words containing a digit, e.g. ids, numbers and addresses, are replaced with "{n}"
+func normalizeMessage(message string) string {
+	var builder strings.Builder
+	for i := 0; i < len(message); {
+		c := message[i]
+		if c == '"' || c == '\'' || c == '`' {
+			if end := strings.IndexByte(message[i+1:], c); end >= 0 {
+				builder.WriteString("{s}")
+				i += end + 2
+				continue
+			}
+		}
+		if !wordByte(c) {
+			builder.WriteByte(c)
+			i++
+			continue
+		}
+
+		start, digit := i, false
+		for i < len(message) && wordByte(message[i]) {
+			digit = digit || (message[i] >= '0' && message[i] <= '9')
+			i++
+		}
+		if digit {
+			builder.WriteString("{n}")
+		} else {
+			builder.WriteString(message[start:i])
+		}
+	}
+	return builder.String()
+}
+
+// A private function used to check if a byte is part of a word, see normalizeMessage
+func wordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.' || c == ':' || c >= 0x80
+}
+
+// A private function used to check if a frame is in-app, i.e. belongs to the main module of the binary, so that frames of dependencies don't split or merge fingerprints
+// [NOTE: Without build info every frame outside of the standard library is considered in-app.]
+func appFrame(frame Frame) bool {
+	pkg := framePackage(frame.Function)
+	module := frameModule(pkg)
+	if buildModules.main.path == "" {
+		return !standardPackage(pkg)
+	}
+	return module.path == buildModules.main.path
+}
+
+// A private function used to check if a package belongs to the standard library, whose import paths have no dot in their first element
+func standardPackage(pkg string) bool {
+	if pkg == "main" {
+		return false
+	}
+	first, _, _ := strings.Cut(pkg, "/")
+	return !strings.Contains(first, ".")
+}
+
+// A private struct to encapsulate the error groups of a diary instance, see IDiaryV2.AggregateErrors
+// Log entries are only recorded while at least one aggregation is running
+type aggregator struct {
+	running atomic.Int32
+	mutex   sync.Mutex
+	groups  map[string]*ErrorGroup
+}
+
+// record counts a fingerprinted log entry against its group
+func (a *aggregator) record(log Log) {
+	if a.running.Load() == 0 || log.Fingerprint == "" {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	group, ok := a.groups[log.Fingerprint]
+	if !ok {
+		if a.groups == nil {
+			a.groups = map[string]*ErrorGroup{}
+		}
+		if len(a.groups) >= maxErrorGroups {
+			a.evict()
+		}
+		group = &ErrorGroup{
+			Fingerprint: log.Fingerprint,
+			Level:       log.Level,
+			Category:    log.Category,
+			Message:     log.Message,
+			FirstSeen:   log.Time,
+		}
+		a.groups[log.Fingerprint] = group
+	}
+	group.Count++
+	group.Total++
+	group.LastSeen = log.Time
+}
+
+// evict forgets the least recently seen group, its occurrences since the previous report are lost
+func (a *aggregator) evict() {
+	var oldest *ErrorGroup
+	for _, group := range a.groups {
+		if oldest == nil || group.LastSeen.Before(oldest.LastSeen) {
+			oldest = group
+		}
+	}
+	if oldest != nil {
+		delete(a.groups, oldest.Fingerprint)
+	}
+}
+
+// report returns the groups that occurred since the previous report, most frequent first, and resets their count
+func (a *aggregator) report() []ErrorGroup {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	groups := make([]ErrorGroup, 0, len(a.groups))
+	for _, group := range a.groups {
+		if group.Count > 0 {
+			groups = append(groups, *group)
+			group.Count = 0
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].Fingerprint < groups[j].Fingerprint
+	})
+	return groups
+}
+
+// AggregateErrors groups error and fatal log entries by their fingerprint and reports the groups that occurred at every interval
+// A final report is made when the aggregation is stopped, intervals without errors aren't reported
+//
+// - interval: How frequently the groups are reported
+// - report: A routine to receive the groups (may be nil) [NOTE: If nil the groups will be logged as a NOTICE.]
+func (d diary) AggregateErrors(interval time.Duration, report func(groups []ErrorGroup)) (stop func()) {
+	if interval <= 0 {
+		panic("interval must be greater than zero")
+	}
+	if report == nil {
+		report = func(groups []ErrorGroup) {
+			total := 0
+			for _, group := range groups {
+				total += group.Count
+			}
+			d.system(TextLevelNotice, "diary.errors", fmt.Sprintf("%d errors in %d groups", total, len(groups)), M{
+				"groups": groups,
+			})
+		}
+	}
+
+	a := d.aggregator
+	a.running.Add(1)
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-ticker.C:
+				if groups := a.report(); len(groups) > 0 {
+					report(groups)
+				}
+			case <-done:
+				if groups := a.report(); len(groups) > 0 {
+					report(groups)
+				}
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return d.background(func() {
+		once.Do(func() {
+			ticker.Stop()
+			a.running.Add(-1)
+			close(done)
+			<-finished
+		})
+	})
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNormalizeMessage(t *testing.T) {
+	cases := []struct {
+		message    string
+		normalized string
+	}{
+		{"connection refused", "connection refused"},
+		{"user 42 not found", "user {n} not found"},
+		{"order ord_8f3a2 failed after 3.5s", "order {n} failed after {n}"},
+		{`unknown key "colour" in 'config'`, "unknown key {s} in {s}"},
+		{"dial tcp 10.0.0.1:5432: i/o timeout", "dial tcp {n} i/o timeout"},
+		{"id 6ad5bdfec8d74fad36431afb is taken", "id {n} is taken"},
+		{"a `raw` value", "a {s} value"},
+		{`unterminated "quote 1`, `unterminated "quote {n}`},
+		{"négatif -7", "négatif {n}"},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if normalized := normalizeMessage(c.message); normalized != c.normalized {
+			t.Errorf("%q normalized as %q, expected %q", c.message, normalized, c.normalized)
+		}
+	}
+}
+
+// fingerprintLog returns an error entry raised through the given in-app functions
+func fingerprintLog(message string, line int, functions ...string) Log {
+	log := Log{Level: TextLevelError, Category: "orders", Message: message}
+	for i, function := range functions {
+		log.Frames = append(log.Frames, Frame{Function: function, File: fmt.Sprintf("/app/%d.go", i), Line: line + i})
+	}
+	return log
+}
+
+func TestFingerprintStable(t *testing.T) {
+	app := buildModule{path: "github.com/go-diary/diary"}
+	frameModule("main") // loads the build info
+	if buildModules.main.path != app.path {
+		t.Skipf("the main module is %q", buildModules.main.path)
+	}
+
+	handler, store := app.path+"/internal/api.(*Orders).Create", app.path+"/internal/store.Insert"
+	base := fingerprint(fingerprintLog("order 42 failed", 10, handler, store))
+	cases := []struct {
+		name string
+		log  Log
+		same bool
+	}{
+		{"other line numbers", fingerprintLog("order 42 failed", 99, handler, store), true},
+		{"other ids", fingerprintLog("order 7 failed", 10, handler, store), true},
+		{"dependency frames", fingerprintLog("order 42 failed", 10, "github.com/lib/pq.(*conn).Exec", handler, "database/sql.(*DB).Exec", store), true},
+		{"frames past the top three", fingerprintLog("order 42 failed", 10, handler, store, app.path+"/internal/a.A", app.path+"/internal/b.B"), false},
+		{"other function", fingerprintLog("order 42 failed", 10, handler, app.path+"/internal/store.Update"), false},
+		{"other message", fingerprintLog("order 42 timed out", 10, handler, store), false},
+	}
+	for _, c := range cases {
+		if same := fingerprint(c.log) == base; same != c.same {
+			t.Errorf("%s: expected the same fingerprint %t", c.name, c.same)
+		}
+	}
+
+	templated := fingerprintLog("order 42 failed", 10, handler)
+	templated.Template = "order {id} failed"
+	other := fingerprintLog("order 43 broke", 12, handler)
+	other.Template = "order {id} failed"
+	if fingerprint(templated) != fingerprint(other) {
+		t.Errorf("entries with the same template have different fingerprints")
+	}
+}
+
+func TestAggregatorEvictsLeastRecentlySeen(t *testing.T) {
+	a := &aggregator{}
+	a.running.Add(1)
+	start := time.Now()
+	for i := 0; i < maxErrorGroups; i++ {
+		a.record(Log{Level: TextLevelError, Fingerprint: fmt.Sprintf("group-%d", i), Time: start.Add(time.Duration(i) * time.Second)})
+	}
+	// the first group is seen again, so the second is the least recently seen one
+	a.record(Log{Level: TextLevelError, Fingerprint: "group-0", Time: start.Add(time.Hour)})
+	a.record(Log{Level: TextLevelError, Fingerprint: "new", Time: start.Add(2 * time.Hour)})
+
+	if len(a.groups) != maxErrorGroups {
+		t.Errorf("expected %d groups but got %d", maxErrorGroups, len(a.groups))
+	}
+	for fingerprint, expected := range map[string]bool{"new": true, "group-0": true, "group-1": false, "group-2": true} {
+		if _, ok := a.groups[fingerprint]; ok != expected {
+			t.Errorf("%s: expected to be kept %t", fingerprint, expected)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An definition of a routine used to encode log entries, independent of where they are written to
+// Formatters must be safe for concurrent use
+type Formatter interface {
+	// Format appends the encoded log entry, including its record terminator, to dst and returns the extended buffer
+	// A formatter may skip an entry by returning dst unchanged
+	Format(dst []byte, log Log) ([]byte, error)
+}
+
+// A private pool of buffers shared by all formatters to avoid an allocation per log entry
+var buffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, 0, 1024)
+		return &buffer
+	},
+}
+
+// The largest buffer that will be returned to the pool, larger buffers are left for the garbage collector
+const maxPooledBuffer = 64 * 1024
+
+// WriterHandler returns a handler that encodes log entries with the formatter and writes them to the writer
+// Each log entry is written with a single call to Write and writes are serialized, entries a formatter skips are not written
+// Entries a formatter fails to encode are retried with DefaultLimits applied, entries that still fail and failed writes are reported with ReportFailure
+func WriterHandler(w io.Writer, formatter Formatter) H {
+	if w == nil {
+		panic("writer must be defined")
+	}
+	if formatter == nil {
+		panic("formatter must be defined")
+	}
+
+	mutex := sync.Mutex{}
+	return func(log Log) {
+		buffer := buffers.Get().(*[]byte)
+		defer func() {
+			if cap(*buffer) <= maxPooledBuffer {
+				*buffer = (*buffer)[:0]
+				buffers.Put(buffer)
+			}
+		}()
+
+		data, err := formatter.Format((*buffer)[:0], log)
+		if err != nil {
+			// entries that didn't pass through a diary instance, e.g. when the handler is called directly, may not be safe yet
+			data, err = formatter.Format((*buffer)[:0], DefaultLimits().Apply(log))
+		}
+		if err != nil {
+			ReportFailure(log, fmt.Errorf("unable to format log entry: %w", err))
+			return
+		}
+		*buffer = data
+		if len(data) == 0 {
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if _, err := w.Write(data); err != nil {
+			ReportFailure(log, fmt.Errorf("unable to write log entry: %w", err))
+		}
+	}
+}
+
+// A private writer that resolves os.Stdout on every write so that redirecting it at runtime is honoured
+type stdout struct{}
+
+func (stdout) Write(data []byte) (int, error) {
+	return os.Stdout.Write(data)
+}
+
+// A private writer that resolves os.Stderr on every write so that redirecting it at runtime is honoured
+type stderr struct{}
+
+func (stderr) Write(data []byte) (int, error) {
+	return os.Stderr.Write(data)
+}
+
+// A public struct used to encode log entries as a single line of JSON
+// The output is the same as json.Marshal of the entry, but is appended without intermediate allocations
+type JsonFormatter struct{}
+
+func (JsonFormatter) Format(dst []byte, log Log) ([]byte, error) {
+	out, err := appendJsonLog(dst, log)
+	if err != nil {
+		return dst, err
+	}
+	return append(out, '\n'), nil
+}
+
+// A public struct used to encode log entries in a human readable, multi-line form
+type HumanFormatter struct{}
+
+func (HumanFormatter) Format(dst []byte, log Log) ([]byte, error) {
+	dst = fmt.Appendf(dst, "[%s] %-8s %-90s %s %s\n", log.Time.Format(time.RFC3339), strings.ToUpper(log.Level), log.Category, log.Chain.Id, log.Line)
+	if log.Meta != nil && len(log.Meta) > 0 {
+		out, err := json.MarshalIndent(log.Meta, "", "    ")
+		if err == nil && out != nil {
+			dst = append(dst, out...)
+			dst = append(dst, '\n')
+		}
+	}
+	if len(strings.TrimSpace(log.Message)) > 0 {
+		dst = fmt.Appendf(dst, "**> %s\n", log.Message)
+	}
+	if len(strings.TrimSpace(log.Stack)) > 0 {
+		dst = append(dst, strings.TrimSuffix(log.Stack, "\n")...)
+		dst = append(dst, '\n')
+	}
+	return dst, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// A private writer that fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write(data []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+// A private formatter that fails every entry
+type failingFormatter struct{}
+
+func (failingFormatter) Format(dst []byte, log Log) ([]byte, error) {
+	return dst, errors.New("unencodable")
+}
+
+func TestWriterHandlerUnguarded(t *testing.T) {
+	handlers := map[string]H{
+		"write":  WriterHandler(failingWriter{}, JsonFormatter{}),
+		"format": WriterHandler(&bytes.Buffer{}, failingFormatter{}),
+	}
+	for name, handler := range handlers {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: handler called directly panicked: %v", name, r)
+				}
+			}()
+			handler(Log{Level: TextLevelInfo, Meta: M{}})
+		}()
+	}
+}
+
+func TestWriterHandlerReportsFailures(t *testing.T) {
+	var fallback []Log
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelNotice, WriterHandler(failingWriter{}, JsonFormatter{}))
+	d.SetFallback(func(log Log) {
+		if log.Level == TextLevelNotice {
+			fallback = append(fallback, log)
+		}
+	})
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Notice("run", nil)
+	})
+
+	if len(fallback) != 1 {
+		t.Fatalf("expected the failed entry at the fallback sink, got %v", fallback)
+	}
+	failure, _ := fallback[0].Meta[MetaKeyHandlerError].(M)
+	if failure["error"] != "unable to write log entry: disk full" {
+		t.Errorf("unexpected handler error %v", failure)
+	}
+	if counts := d.Stats().Levels[TextLevelNotice]; counts.Failed != 1 {
+		t.Errorf("expected 1 failed notice, got %+v", counts)
+	}
+}
+
+func TestReportFailureAfterReturn(t *testing.T) {
+	var kept Log
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelTrace, func(log Log) { kept = log })
+	var fallback []Log
+	d.SetFallback(func(log Log) { fallback = append(fallback, log) })
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Notice("run", nil)
+	})
+
+	// a handler that keeps the entry can't fail it once it has returned
+	ReportFailure(kept, errors.New("too late"))
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Notice("run", nil)
+	})
+	if len(fallback) != 0 {
+		t.Errorf("expected late reports to be ignored, got %v", fallback)
+	}
+}
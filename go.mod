@@ -2,6 +2,11 @@ module github.com/go-diary/diary
 
 go 1.20
 
+require (
+	go.mongodb.org/mongo-driver v1.11.3
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require (
 	github.com/aws/aws-sdk-go v1.34.28 // indirect
 	github.com/go-stack/stack v1.8.0 // indirect
@@ -12,6 +17,5 @@ require (
 	github.com/sirupsen/logrus v1.4.2 // indirect
 	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c // indirect
 	github.com/xdg/stringprep v0.0.0-20180714160509-73f8eece6fdc // indirect
-	go.mongodb.org/mongo-driver v1.11.3
 	golang.org/x/tools v0.0.0-20190531172133-b3315ee88b7d // indirect
 )
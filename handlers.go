@@ -1,32 +1,15 @@
 package diary
 
-import (
-	"encoding/json"
-	"fmt"
-	"strings"
-	"time"
-)
+var defaultHandler = WriterHandler(stdout{}, JsonFormatter{})
 
+var humanReadableHandler = WriterHandler(stdout{}, HumanFormatter{})
+
+// DefaultHandler writes each log entry to stdout as a single line of JSON
 func DefaultHandler(log Log) {
-	data, err := json.Marshal(log)
-	if err != nil {
-		panic(err)
-	}
-	fmt.Println(string(data))
+	defaultHandler(log)
 }
 
+// HumanReadableHandler writes each log entry to stdout in a human readable, multi-line form
 func HumanReadableHandler(log Log) {
-	fmt.Printf("[%s] %-8s %-90s %s %s\n", log.Time.Format(time.RFC3339), strings.ToUpper(log.Level), log.Category, log.Chain.Id, log.Line)
-	if log.Meta != nil && len(log.Meta) > 0 {
-		out, err := json.MarshalIndent(log.Meta, "", "    ")
-		if err == nil && out != nil {
-			fmt.Println(string(out))
-		}
-	}
-	if len(strings.TrimSpace(log.Message)) > 0 {
-		fmt.Printf("**> %s\n", log.Message)
-	}
-	if len(strings.TrimSpace(log.Stack)) > 0 {
-		fmt.Println(strings.TrimSuffix(log.Stack, "\n"))
-	}
-}
\ No newline at end of file
+	humanReadableHandler(log)
+}
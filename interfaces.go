@@ -1,5 +1,10 @@
 package diary
 
+import (
+	"context"
+	"time"
+)
+
 // An definition of the public functions for a diary instance
 type IDiary interface {
 	// Page returns a diary.Page interface instance for consumption
@@ -7,8 +12,8 @@ type IDiary interface {
 	// This allows us to trace the entire page chain easily for troubleshooting and profiling
 	//
 	// - level: The default level to log at [NOTE: If -1 will inherit from diary instance]
-	// - sample: A per second count indicating how frequently traces should be sampled, only applicable if level is higher than DEBUG [NOTE: if value is less than zero then will sample all traces]
-	// - catch: A flag indicating if the scope should automatically catch and return errors. [NOTE: If set to true panics will be caught and returned as an error.]
+	// - sample: A per second count indicating how frequently traces should be sampled, only applicable if level is higher than DEBUG [NOTE: If -1 will inherit from diary instance, any other value less than zero will sample all traces]
+	// - catch: A flag indicating if the scope should automatically catch and return errors. [NOTE: If set to true panics will be caught and returned as an error. Always true if the diary instance is configured to catch.]
 	// - category: The shorthand code used to identify the given workflow category [NOTE: Categories will be concatenated by dot-nation: "main.sub1.sub2.sub3".]
 	// - authType: The shorthand code for the type of auth account (may be empty)
 	// - authIdentifier: The identifier, which can be anything, used to identify the given auth account (may be empty) [WARNING: Don't ever log personal data without first encrypting or salt-hashing the data.]
@@ -20,8 +25,8 @@ type IDiary interface {
 	// This allows us to trace the entire page chain easily for troubleshooting and profiling
 	//
 	// - level: The default level to log at [NOTE: If -1 will inherit from diary instance]
-	// - sample: A per second count indicating how frequently traces should be sampled, only applicable if level is higher than DEBUG [NOTE: if value is less than zero then will sample all traces]
-	// - catch: A flag indicating if the scope should automatically catch and return errors. [NOTE: If set to true panics will be caught and returned as an error.]
+	// - sample: A per second count indicating how frequently traces should be sampled, only applicable if level is higher than DEBUG [NOTE: If -1 will inherit from diary instance, any other value less than zero will sample all traces]
+	// - catch: A flag indicating if the scope should automatically catch and return errors. [NOTE: If set to true panics will be caught and returned as an error. Always true if the diary instance is configured to catch.]
 	// - category: The shorthand code used to identify the given workflow category [NOTE: Categories will be concatenated by dot-nation: "main.sub1.sub2.sub3".]
 	// - authType: The shorthand code for the type of auth account (may be empty)
 	// - authIdentifier: The identifier, which can be anything, used to identify the given auth account (may be empty) [WARNING: Don't ever log personal data without first encrypting or salt-hashing the data.]
@@ -35,6 +40,64 @@ type IDiary interface {
 	LoadX(data []byte, category string, scope S) error
 }
 
+// An definition of the public functions for a diary instance that were added after IDiary
+// The instances returned by Dear and DearConfig implement IDiaryV2, IDiary is kept as it was so that existing implementations and mocks still satisfy it
+type IDiaryV2 interface {
+	IDiary
+
+	// Configure atomically swaps the runtime settings of the diary instance, pages already in flight keep their settings
+	Configure(config Config) error
+
+	// WatchConfig reloads the configuration file whenever it changes or the process receives SIGHUP
+	//
+	// - file: The path of the configuration file [NOTE: If empty will use DIARY_CONFIG]
+	// - interval: How frequently the file is checked for changes [NOTE: If zero or less the file is only reloaded on SIGHUP]
+	WatchConfig(file string, interval time.Duration) (stop func())
+
+	// Boost steps the effective level down one step toward TRACE for the given duration
+	Boost(duration time.Duration) error
+
+	// ResetBoost immediately reverts any active verbosity boost
+	ResetBoost()
+
+	// BoostOnSignal opts in to SIGUSR1 boosting the verbosity for the given duration and SIGUSR2 resetting it
+	BoostOnSignal(duration time.Duration) (stop func(), err error)
+
+	// AggregateErrors groups error and fatal log entries by their fingerprint and reports the groups that occurred at every interval
+	//
+	// - report: A routine to receive the groups (may be nil) [NOTE: If nil the groups will be logged as a NOTICE.]
+	AggregateErrors(interval time.Duration, report func(groups []ErrorGroup)) (stop func())
+
+	// OnExit registers a hook that runs before the diary exits the process, e.g. on Fatal
+	OnExit(hook ExitHook)
+
+	// Manage registers a resource of a handler given to Dear, so that it's flushed and closed with the diary instance
+	//
+	// - resource: A Flusher, a value with a Flush() error method and/or an io.Closer [NOTE: Other values are ignored.]
+	Manage(resource interface{})
+
+	// Flush drains the handler resources in order, configured handlers first
+	Flush(ctx context.Context) error
+
+	// Close stops the background routines and any active boost, and then flushes and closes the handler resources in order, log entries written after Close are written to stderr as JSON
+	Close(ctx context.Context) error
+
+	// SetExit replaces the function used to exit the process, so that code paths using Fatal can be tested [NOTE: If nil will restore os.Exit.]
+	SetExit(exit func(code int))
+
+	// Stats returns the emitted, suppressed, failed and dropped log entry counts of the diary instance by level and handler
+	Stats() Stats
+
+	// ReportStats logs the statistics of the diary instance as a NOTICE at every interval
+	ReportStats(interval time.Duration) (stop func())
+
+	// SetFallback replaces the sink that the log entries handlers fail on are passed on to [NOTE: If nil will write to stderr as JSON.]
+	SetFallback(fallback H)
+
+	// SetAuditHandler sets the handler that audit entries are delivered to synchronously, failures are returned by IPageV2.AuditEvent [NOTE: If nil audit entries are only sent to the regular handlers.]
+	SetAuditHandler(handler H)
+}
+
 // An definition of the public functions for a page instance
 type IPage interface {
 	Parent() IDiary
@@ -48,3 +111,16 @@ type IPage interface {
 	ToJson() []byte
 	Scope(category string, scope S) error
 }
+
+// An definition of the public functions for a page instance that were added after IPage
+// The pages passed to scopes implement IPageV2, e.g. p.(diary.IPageV2), IPage is kept as it was so that existing implementations and mocks still satisfy it
+type IPageV2 interface {
+	IPage
+	Infof(category, format string, args ...interface{})
+	Warningf(category, format string, args ...interface{})
+	Errorf(category, format string, args ...interface{})
+	Err(category string, err error, meta M)
+	AuditEvent(category string, event AuditEvent) error
+	With(meta M) IPageV2
+	WithPropagated(meta M) IPageV2
+}
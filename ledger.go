@@ -0,0 +1,582 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of audit entries between two checkpoints of a ledger when no other value has been given
+const DefaultLedgerCheckpoint = 100
+
+const (
+	// The kind of a ledger record holding an audit entry
+	ledgerEntry = "entry"
+	// The kind of a ledger record holding a checkpoint
+	ledgerCheckpoint = "checkpoint"
+	// The kind of a ledger record noting a torn record that was cut off when the ledger was reopened
+	ledgerRecovery = "recovery"
+)
+
+// An definition of how the records of a ledger are signed and verified, see HmacSigner, Ed25519Signer and Ed25519Verifier
+type LedgerSigner interface {
+	// Algorithm returns the name of the signature algorithm that is written with every record
+	Algorithm() string
+	// Sign signs the hash of a record
+	Sign(hash []byte) ([]byte, error)
+	// Verify checks the signature of the hash of a record
+	Verify(hash, signature []byte) bool
+}
+
+// A private struct used to sign ledger records with HMAC-SHA256
+type hmacSigner struct {
+	key []byte
+}
+
+// HmacSigner returns a signer that signs and verifies ledger records with HMAC-SHA256
+// [WARNING: Anyone holding the key can forge records, keep it out of reach of the writers of the ledger file.]
+func HmacSigner(key []byte) LedgerSigner {
+	if len(key) == 0 {
+		panic("key must be defined")
+	}
+	return hmacSigner{key: append([]byte{}, key...)}
+}
+
+func (s hmacSigner) Algorithm() string {
+	return "hmac-sha256"
+}
+
+func (s hmacSigner) Sign(hash []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(hash)
+	return mac.Sum(nil), nil
+}
+
+func (s hmacSigner) Verify(hash, signature []byte) bool {
+	expected, _ := s.Sign(hash)
+	return hmac.Equal(expected, signature)
+}
+
+// A private struct used to sign ledger records with Ed25519
+//
+// - private: The key records are signed with (may be nil) [NOTE: If nil the signer can only verify.]
+type ed25519Signer struct {
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// Ed25519Signer returns a signer that signs and verifies ledger records with Ed25519
+func Ed25519Signer(key ed25519.PrivateKey) LedgerSigner {
+	if len(key) != ed25519.PrivateKeySize {
+		panic("key must be an ed25519 private key")
+	}
+	return ed25519Signer{private: key, public: key.Public().(ed25519.PublicKey)}
+}
+
+// Ed25519Verifier returns a signer that only verifies ledger records signed with Ed25519, so that auditors don't need the private key
+func Ed25519Verifier(key ed25519.PublicKey) LedgerSigner {
+	if len(key) != ed25519.PublicKeySize {
+		panic("key must be an ed25519 public key")
+	}
+	return ed25519Signer{public: key}
+}
+
+func (s ed25519Signer) Algorithm() string {
+	return "ed25519"
+}
+
+func (s ed25519Signer) Sign(hash []byte) ([]byte, error) {
+	if s.private == nil {
+		return nil, errors.New("ed25519 verifier can't sign")
+	}
+	return ed25519.Sign(s.private, hash), nil
+}
+
+func (s ed25519Signer) Verify(hash, signature []byte) bool {
+	return ed25519.Verify(s.public, hash, signature)
+}
+
+// A private struct to encapsulate a single line of a ledger file
+//
+// - Sequence: The position of the record in the ledger, starting at 1 for the first record
+// - Previous: The hash of the previous record [NOTE: Empty for the first record.]
+// - Hash: The SHA-256 hash of the sequence, kind, previous hash and data, see ledgerHash
+// - Data: The audit entry as JSON, or the checkpoint
+type ledgerRecord struct {
+	Sequence  uint64          `json:"seq"`
+	Kind      string          `json:"kind"`
+	Previous  string          `json:"prev"`
+	Hash      string          `json:"hash"`
+	Algorithm string          `json:"alg"`
+	Signature string          `json:"sig"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// A private struct to encapsulate the data of a checkpoint record
+//
+// - Entries: The number of audit entries that precede the checkpoint in the ledger
+type ledgerCheckpointData struct {
+	Entries uint64    `json:"entries"`
+	Time    time.Time `json:"time"`
+}
+
+// The error returned by OpenLedger for a ledger whose last record is torn, see RecoverLedger
+var ErrLedgerTorn = errors.New("last record is torn")
+
+// A private struct to encapsulate the data of a recovery record, see Ledger.resume
+//
+// - Bytes: The length of the torn record that was cut off
+// - Hash: The SHA-256 hash of the torn record, so that a copy of it can be matched
+type ledgerRecoveryData struct {
+	Bytes int       `json:"bytes"`
+	Hash  string    `json:"hash"`
+	Time  time.Time `json:"time"`
+}
+
+// A private function used to hash a ledger record, the data is hashed exactly as it's written
+func ledgerHash(sequence uint64, kind, previous string, data []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "diary-ledger\n%d\n%s\n%s\n", sequence, kind, previous)
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// A public struct used to append audit entries to a tamper-evident file
+// Every audit entry is written as a record with a sequence number, the hash of the previous record and a signature, see VerifyLedger
+// A checkpoint record with the number of entries is written every so many entries and when the ledger is closed, so that the checkpoints can be kept elsewhere to detect a truncated ledger
+type Ledger struct {
+	mutex      sync.Mutex
+	file       *os.File
+	signer     LedgerSigner
+	checkpoint int
+	sequence   uint64
+	previous   string
+	entries    uint64
+	pending    int
+	closed     bool
+	recovery   bool
+}
+
+// OpenLedger opens a ledger file for appending, an existing ledger is continued from its last record once its hash and signature are verified
+// A ledger whose last record is torn isn't opened, ErrLedgerTorn is returned instead, see RecoverLedger
+//
+// - path: The file the records are appended to
+// - signer: Signs every record, see HmacSigner and Ed25519Signer
+// - checkpoint: The number of audit entries between two checkpoints [NOTE: If zero or less will use DefaultLedgerCheckpoint]
+func OpenLedger(path string, signer LedgerSigner, checkpoint int) (*Ledger, error) {
+	return openLedger(path, signer, checkpoint, false)
+}
+
+// RecoverLedger opens a ledger file like OpenLedger, a torn last record, e.g. of a crash during a write, is cut off and noted with a recovery record
+// [WARNING: The audit entry of the torn record is lost and VerifyLedger reports the recovery as a problem, only recover a ledger once the cause is known.]
+func RecoverLedger(path string, signer LedgerSigner, checkpoint int) (*Ledger, error) {
+	return openLedger(path, signer, checkpoint, true)
+}
+
+// A private function used to open a ledger file, see OpenLedger and RecoverLedger
+//
+// - recovery: A flag indicating if a torn last record may be cut off
+func openLedger(path string, signer LedgerSigner, checkpoint int, recovery bool) (*Ledger, error) {
+	if signer == nil {
+		panic("signer must be defined")
+	}
+	if checkpoint <= 0 {
+		checkpoint = DefaultLedgerCheckpoint
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Ledger{file: file, signer: signer, checkpoint: checkpoint, recovery: recovery}
+	if err := l.resume(); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("ledger %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// resume reads the existing records of the ledger file, so that the chain continues from the last record
+// Only the last record is verified, see VerifyLedger, so that the ledger never signs on top of a record it didn't write
+// A torn last record is cut off and replaced by a recovery record if recovery is enabled
+func (l *Ledger) resume() error {
+	reader := bufio.NewReader(l.file)
+	offset := int64(0)
+	var last *ledgerRecord
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			var record ledgerRecord
+			if jsonErr := json.Unmarshal(data, &record); jsonErr != nil {
+				if _, next := reader.Peek(1); next != io.EOF {
+					// only the last record can be torn, an unreadable record in between is left to VerifyLedger
+					return fmt.Errorf("line %d: unreadable record: %w", line, jsonErr)
+				}
+				if !l.recovery {
+					return fmt.Errorf("line %d: %w", line, ErrLedgerTorn)
+				}
+				if err := l.verify(last); err != nil {
+					return err
+				}
+				return l.recover(offset, data)
+			}
+			last = &record
+			l.sequence = record.Sequence
+			l.previous = record.Hash
+			switch record.Kind {
+			case ledgerEntry:
+				l.entries++
+				l.pending++
+			case ledgerCheckpoint:
+				l.pending = 0
+			}
+		}
+		if err == io.EOF {
+			if err := l.verify(last); err != nil {
+				return err
+			}
+			if len(data) > 0 {
+				// the record is whole, only its line ending is missing
+				_, err := l.file.Write([]byte("\n"))
+				return err
+			}
+			return nil
+		}
+		offset += int64(len(data))
+	}
+}
+
+// verify checks the hash and signature of the record the ledger continues from
+//
+// - record: (may be nil) [NOTE: If nil the ledger is empty.]
+func (l *Ledger) verify(record *ledgerRecord) error {
+	if record == nil {
+		return nil
+	}
+	if ledgerHash(record.Sequence, record.Kind, record.Previous, record.Data) != record.Hash {
+		return fmt.Errorf("last record %d has been modified", record.Sequence)
+	}
+	signature, err := base64.StdEncoding.DecodeString(record.Signature)
+	if record.Algorithm != l.signer.Algorithm() {
+		return fmt.Errorf("last record %d is signed with %q instead of %q", record.Sequence, record.Algorithm, l.signer.Algorithm())
+	} else if err != nil || !l.signer.Verify([]byte(record.Hash), signature) {
+		return fmt.Errorf("last record %d has an invalid signature", record.Sequence)
+	}
+	return nil
+}
+
+// recover cuts off a torn last record at the given offset and appends a recovery record in its place
+func (l *Ledger) recover(offset int64, torn []byte) error {
+	if err := l.file.Truncate(offset); err != nil {
+		return fmt.Errorf("unable to cut off torn record: %w", err)
+	}
+	hash := sha256.Sum256(torn)
+	data, err := json.Marshal(ledgerRecoveryData{Bytes: len(torn), Hash: hex.EncodeToString(hash[:]), Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return l.append(ledgerRecovery, data)
+}
+
+// Handle appends an audit entry to the ledger, entries of other levels are skipped
+// Failures are reported with ReportFailure, so that they're returned by IPageV2.AuditEvent when the ledger is an audit handler
+func (l *Ledger) Handle(log Log) {
+	if log.Level != TextLevelAudit {
+		return
+	}
+	data, err := JsonFormatter{}.Format(nil, log)
+	if err != nil {
+		ReportFailure(log, fmt.Errorf("unable to format audit entry: %w", err))
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		ReportFailure(log, ErrClosed)
+		return
+	}
+	if err := l.append(ledgerEntry, bytes.TrimRight(data, "\n")); err != nil {
+		ReportFailure(log, err)
+		return
+	}
+	l.entries++
+	l.pending++
+	if l.pending >= l.checkpoint {
+		if err := l.appendCheckpoint(); err != nil {
+			ReportFailure(log, err)
+		}
+	}
+}
+
+// Checkpoint appends a checkpoint record with the number of audit entries written so far
+func (l *Ledger) Checkpoint() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.appendCheckpoint()
+}
+
+// Flush commits the records written so far to stable storage
+func (l *Ledger) Flush(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil
+	}
+	return l.file.Sync()
+}
+
+// Close appends a final checkpoint if any audit entries were written since the last one and closes the file
+func (l *Ledger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	var err error
+	if l.pending > 0 {
+		err = l.appendCheckpoint()
+	}
+	return errors.Join(err, l.file.Sync(), l.file.Close())
+}
+
+// appendCheckpoint appends a checkpoint record [NOTE: Must be called with the mutex locked.]
+func (l *Ledger) appendCheckpoint() error {
+	data, err := json.Marshal(ledgerCheckpointData{Entries: l.entries, Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := l.append(ledgerCheckpoint, data); err != nil {
+		return err
+	}
+	l.pending = 0
+	return nil
+}
+
+// append signs and writes a single record, the chain only moves on once the record is written [NOTE: Must be called with the mutex locked.]
+// The line is built by hand so that the data is written exactly as it was hashed
+func (l *Ledger) append(kind string, data []byte) error {
+	sequence := l.sequence + 1
+	hash := ledgerHash(sequence, kind, l.previous, data)
+	signature, err := l.signer.Sign([]byte(hash))
+	if err != nil {
+		return err
+	}
+
+	line := make([]byte, 0, len(data)+256)
+	line = append(line, `{"seq":`...)
+	line = strconv.AppendUint(line, sequence, 10)
+	line = append(line, `,"kind":`...)
+	line = strconv.AppendQuote(line, kind)
+	line = append(line, `,"prev":`...)
+	line = strconv.AppendQuote(line, l.previous)
+	line = append(line, `,"hash":`...)
+	line = strconv.AppendQuote(line, hash)
+	line = append(line, `,"alg":`...)
+	line = strconv.AppendQuote(line, l.signer.Algorithm())
+	line = append(line, `,"sig":`...)
+	line = strconv.AppendQuote(line, base64.StdEncoding.EncodeToString(signature))
+	line = append(line, `,"data":`...)
+	line = append(line, data...)
+	line = append(line, "}\n"...)
+	if _, err := l.file.Write(line); err != nil {
+		return fmt.Errorf("unable to write ledger record %d: %w", sequence, err)
+	}
+
+	l.sequence = sequence
+	l.previous = hash
+	return nil
+}
+
+// A private function used by the "ledger" handler factory
+//
+// Options:
+// - path: The ledger file, required
+// - keyEnv: The environment variable holding the HMAC key records are signed with, required
+// - checkpoint: The number of audit entries between two checkpoints [NOTE: If empty will use DefaultLedgerCheckpoint]
+// - recover: A flag indicating if a torn last record is cut off, see RecoverLedger [NOTE: If empty will refuse to open a torn ledger]
+func ledgerHandler(options M) (H, error) {
+	options = copyOptions(options)
+	path, _ := options["path"].(string)
+	keyEnv, _ := options["keyEnv"].(string)
+	delete(options, "path")
+	delete(options, "keyEnv")
+	if path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	if keyEnv == "" {
+		return nil, fmt.Errorf("keyEnv is required")
+	}
+	key := os.Getenv(keyEnv)
+	if key == "" {
+		return nil, fmt.Errorf("environment variable %s is empty", keyEnv)
+	}
+	checkpoint := 0
+	if value, ok := options["checkpoint"]; ok {
+		if checkpoint, ok = parseInt(value); !ok {
+			return nil, fmt.Errorf("checkpoint must be a number")
+		}
+		delete(options, "checkpoint")
+	}
+	recovery := false
+	if value, ok := options["recover"]; ok {
+		if recovery, ok = value.(bool); !ok {
+			return nil, fmt.Errorf("recover must be a boolean")
+		}
+		delete(options, "recover")
+	}
+	if err := unknownOptions(options); err != nil {
+		return nil, err
+	}
+
+	l, err := openLedger(path, HmacSigner([]byte(key)), checkpoint, recovery)
+	if err != nil {
+		return nil, err
+	}
+	manage(l)
+	return l.Handle, nil
+}
+
+// A public struct to encapsulate the result of verifying a ledger, see VerifyLedger
+//
+// - Records: The number of records read, entries and checkpoints
+// - Entries: The number of audit entry records
+// - Checkpoints: The number of checkpoint records
+// - Recoveries: The torn records that were cut off by RecoverLedger, e.g. after a crash [NOTE: The audit entries of these records are lost, each is reported as a problem as well.]
+// - Sequence: The sequence number of the last record [NOTE: Compare with a checkpoint kept elsewhere to detect a truncated ledger.]
+// - Hash: The hash of the last record
+type LedgerReport struct {
+	Records     int
+	Entries     int
+	Checkpoints int
+	Recoveries  []string
+	Sequence    uint64
+	Hash        string
+}
+
+// A public struct to encapsulate every problem found while verifying a ledger
+type LedgerError struct {
+	Problems []string
+}
+
+func (e LedgerError) Error() string {
+	return fmt.Sprintf("ledger verification failed:\n - %s", strings.Join(e.Problems, "\n - "))
+}
+
+// VerifyLedger reads a ledger and reports missing, reordered and modified records
+// Every record is checked, verification continues after a problem so that all problems are reported
+//
+// - signer: The signer the ledger was written with, see Ed25519Verifier
+// - return: A LedgerError listing every problem, or the error of the reader
+func VerifyLedger(r io.Reader, signer LedgerSigner) (LedgerReport, error) {
+	if signer == nil {
+		panic("signer must be defined")
+	}
+
+	var report LedgerReport
+	var problems []string
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			problems = append(problems, verifyLedgerRecord(&report, line, data, signer)...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if len(problems) > 0 {
+		return report, LedgerError{Problems: problems}
+	}
+	return report, nil
+}
+
+// A private function used to verify a single ledger record against the record before it
+func verifyLedgerRecord(report *LedgerReport, line int, data []byte, signer LedgerSigner) []string {
+	var record ledgerRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return []string{fmt.Sprintf("line %d: unreadable record: %v", line, err)}
+	}
+
+	var problems []string
+	expected := report.Sequence + 1
+	switch {
+	case record.Sequence < expected:
+		problems = append(problems, fmt.Sprintf("line %d: record %d is out of order after record %d", line, record.Sequence, report.Sequence))
+	case record.Sequence == expected+1:
+		problems = append(problems, fmt.Sprintf("line %d: record %d is missing or out of order", line, expected))
+	case record.Sequence > expected:
+		problems = append(problems, fmt.Sprintf("line %d: records %d - %d are missing or out of order", line, expected, record.Sequence-1))
+	case record.Previous != report.Hash:
+		problems = append(problems, fmt.Sprintf("line %d: record %d doesn't follow the hash of record %d", line, record.Sequence, report.Sequence))
+	}
+	if ledgerHash(record.Sequence, record.Kind, record.Previous, record.Data) != record.Hash {
+		problems = append(problems, fmt.Sprintf("line %d: record %d has been modified", line, record.Sequence))
+	}
+	signature, err := base64.StdEncoding.DecodeString(record.Signature)
+	if record.Algorithm != signer.Algorithm() {
+		problems = append(problems, fmt.Sprintf("line %d: record %d is signed with %q instead of %q", line, record.Sequence, record.Algorithm, signer.Algorithm()))
+	} else if err != nil || !signer.Verify([]byte(record.Hash), signature) {
+		problems = append(problems, fmt.Sprintf("line %d: record %d has an invalid signature", line, record.Sequence))
+	}
+
+	switch record.Kind {
+	case ledgerEntry:
+		report.Entries++
+	case ledgerCheckpoint:
+		report.Checkpoints++
+		var checkpoint ledgerCheckpointData
+		if err := json.Unmarshal(record.Data, &checkpoint); err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: checkpoint %d is unreadable: %v", line, record.Sequence, err))
+		} else if checkpoint.Entries != uint64(report.Entries) {
+			problems = append(problems, fmt.Sprintf("line %d: checkpoint %d counts %d entries but %d precede it", line, record.Sequence, checkpoint.Entries, report.Entries))
+		}
+	case ledgerRecovery:
+		var recovery ledgerRecoveryData
+		if err := json.Unmarshal(record.Data, &recovery); err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: recovery %d is unreadable: %v", line, record.Sequence, err))
+		} else {
+			note := fmt.Sprintf("line %d: a torn record of %d bytes (sha256 %s) was cut off at %s", line, recovery.Bytes, recovery.Hash, recovery.Time.Format(time.RFC3339))
+			report.Recoveries = append(report.Recoveries, note)
+			// a recovery loses an audit entry, which is never a clean ledger even if the recovery is signed
+			problems = append(problems, note)
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("line %d: record %d has unknown kind %q", line, record.Sequence, record.Kind))
+	}
+
+	report.Records++
+	report.Sequence = record.Sequence
+	report.Hash = record.Hash
+	return problems
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeLedger appends the given number of audit entries to a ledger and closes it
+func writeLedger(t *testing.T, path string, signer LedgerSigner, entries int) {
+	t.Helper()
+	l, err := OpenLedger(path, signer, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < entries; i++ {
+		l.Handle(Log{Level: TextLevelAudit, Category: "orders", Meta: M{"i": i}, Time: time.Now()})
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// verifyLedgerFile verifies a ledger file and fails the test on any problem
+func verifyLedgerFile(t *testing.T, path string, signer LedgerSigner) LedgerReport {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	report, err := VerifyLedger(file, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestLedgerTornRecord(t *testing.T) {
+	signer := HmacSigner([]byte("secret"))
+	path := filepath.Join(t.TempDir(), "audit.ledger")
+	writeLedger(t, path, signer, 3)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a crash in the middle of a write leaves half a record behind
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	torn := append(append([]byte{}, data...), lines[0][:len(lines[0])/2]...)
+	if err := os.WriteFile(path, torn, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenLedger(path, signer, 2); !errors.Is(err, ErrLedgerTorn) {
+		t.Fatalf("expected ErrLedgerTorn, got %v", err)
+	}
+	l, err := RecoverLedger(path, signer, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeLedger(t, path, signer, 2)
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	report, err := VerifyLedger(file, signer)
+	var ledgerErr LedgerError
+	if !errors.As(err, &ledgerErr) || len(ledgerErr.Problems) != 1 {
+		t.Errorf("expected the recovery as the only problem, got %v", err)
+	}
+	if len(report.Recoveries) != 1 {
+		t.Errorf("expected 1 recovery, got %v", report.Recoveries)
+	}
+	if report.Entries != 5 {
+		t.Errorf("expected 5 entries, got %d", report.Entries)
+	}
+}
+
+func TestLedgerModifiedLastRecord(t *testing.T) {
+	signer := HmacSigner([]byte("secret"))
+	path := filepath.Join(t.TempDir(), "audit.ledger")
+	writeLedger(t, path, signer, 1)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a record appended by someone without the key must not be signed over
+	forged := bytes.Replace(data, []byte(`"entries":1`), []byte(`"entries":0`), 1)
+	if bytes.Equal(forged, data) {
+		t.Fatal("checkpoint not found")
+	}
+	if err := os.WriteFile(path, forged, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLedger(path, signer, 2); err == nil {
+		t.Error("expected an error for a modified last record")
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLedger(path, HmacSigner([]byte("other")), 2); err == nil {
+		t.Error("expected an error for a last record signed with another key")
+	}
+}
+
+func TestLedgerMissingLineEnding(t *testing.T) {
+	signer := HmacSigner([]byte("secret"))
+	path := filepath.Join(t.TempDir(), "audit.ledger")
+	writeLedger(t, path, signer, 1)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, bytes.TrimSuffix(data, []byte("\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	writeLedger(t, path, signer, 1)
+	report := verifyLedgerFile(t, path, signer)
+	if len(report.Recoveries) != 0 || report.Entries != 2 {
+		t.Errorf("expected 2 entries without recoveries, got %d entries and %v", report.Entries, report.Recoveries)
+	}
+}
+
+func TestLedgerUnreadableRecord(t *testing.T) {
+	signer := HmacSigner([]byte("secret"))
+	path := filepath.Join(t.TempDir(), "audit.ledger")
+	writeLedger(t, path, signer, 2)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the last record can be torn, damage in between is never cut off
+	if err := os.WriteFile(path, append([]byte("{garbage\n"), data...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLedger(path, signer, 2); err == nil {
+		t.Error("expected an error for an unreadable record before the last one")
+	}
+}
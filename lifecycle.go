@@ -0,0 +1,210 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// An definition of a handler resource that buffers log entries, see IDiaryV2.Flush
+// Resources may also implement io.Closer to be closed by IDiaryV2.Close, or Flush() error like bufio.Writer
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// The error returned once the diary instance is closed, e.g. by IDiaryV2.Boost, or by IPageV2.AuditEvent since the audit handlers can no longer be used
+var ErrClosed = errors.New("diary is closed")
+
+// The handler used for log entries of a closed diary instance, they are written to stderr as JSON
+var closedHandler = WriterHandler(stderr{}, JsonFormatter{})
+
+// A private collector of the resources opened by handler factories while a configuration is built, see Config.handler
+// [NOTE: Factories only run while the collector is locked, see manage.]
+var opening struct {
+	sync.Mutex
+	resources []interface{}
+}
+
+// A private function used by handler factories to hand the resources they open over to the diary instance
+func manage(resource interface{}) {
+	opening.resources = append(opening.resources, resource)
+}
+
+// The page count of settings that have been replaced, pages may no longer acquire them once it's added, see retire
+const retiredPages = math.MinInt64 / 2
+
+// A private struct to encapsulate the lifecycle of a diary instance
+//
+// - retired: The settings that have been replaced but are still used by pages in flight, see IDiaryV2.Configure
+// - resources: The resources registered with Manage, in the order they were registered
+// - stops: The stop functions of the background routines, see background
+// - stopping: Whether Close has stopped the background routines, routines started afterwards are stopped right away
+type lifecycle struct {
+	mutex     sync.Mutex
+	retired   []*settings
+	resources []interface{}
+	stops     []func()
+	stopping  bool
+	closed    atomic.Bool
+}
+
+// Manage registers a resource of a handler given to Dear, so that it's flushed and closed with the diary instance
+// Resources of configured handlers, e.g. files, are managed automatically
+//
+// - resource: A Flusher, a value with a Flush() error method and/or an io.Closer [NOTE: Other values are ignored.]
+func (d diary) Manage(resource interface{}) {
+	d.lifecycle.mutex.Lock()
+	d.lifecycle.resources = append(d.lifecycle.resources, resource)
+	d.lifecycle.mutex.Unlock()
+}
+
+// background registers the stop function of a background routine, e.g. WatchConfig, so that Close stops the routine before the resources are closed
+// The stop function is returned as it is, it must be safe to call more than once
+func (d diary) background(stop func()) func() {
+	d.lifecycle.mutex.Lock()
+	stopping := d.lifecycle.stopping
+	if !stopping {
+		d.lifecycle.stops = append(d.lifecycle.stops, stop)
+	}
+	d.lifecycle.mutex.Unlock()
+	if stopping {
+		stop()
+	}
+	return stop
+}
+
+// acquire returns the current settings and counts the page using them, every call must be paired with a call to release
+func (d diary) acquire() *settings {
+	for {
+		s := d.current()
+		pages := s.pages.Load()
+		// retired settings have already been replaced, so loading them again returns the new settings
+		if pages >= 0 && s.pages.CompareAndSwap(pages, pages+1) {
+			return s
+		}
+	}
+}
+
+// release stops counting a page using the settings, the resources of retired settings are closed once their last page is done
+func (d diary) release(s *settings) {
+	if s.pages.Add(-1) == retiredPages {
+		d.dispose(s)
+	}
+}
+
+// retire keeps the settings of a replaced configuration until the pages in flight are done, see release
+// Until then their resources are still flushed and closed with the diary instance
+func (d diary) retire(s *settings) {
+	d.lifecycle.mutex.Lock()
+	d.lifecycle.retired = append(d.lifecycle.retired, s)
+	d.lifecycle.mutex.Unlock()
+	if s.pages.Add(retiredPages) == retiredPages {
+		d.dispose(s)
+	}
+}
+
+// dispose flushes and closes the resources of retired settings that are no longer used, failures are logged as an ERROR
+// Once the diary instance is closed the resources are left to Close instead
+func (d diary) dispose(s *settings) {
+	d.lifecycle.mutex.Lock()
+	if d.lifecycle.closed.Load() {
+		d.lifecycle.mutex.Unlock()
+		return
+	}
+	for i, retired := range d.lifecycle.retired {
+		if retired == s {
+			d.lifecycle.retired = append(d.lifecycle.retired[:i], d.lifecycle.retired[i+1:]...)
+			break
+		}
+	}
+	d.lifecycle.mutex.Unlock()
+
+	if err := closeAll(context.Background(), s.Resources); err != nil {
+		d.system(TextLevelError, "diary.config", fmt.Sprintf("unable to close the handlers of the previous configuration: %v", err), M{
+			"error": err.Error(),
+		})
+	}
+}
+
+// resources returns the resources of replaced configurations, of the configured handlers and the registered resources, in that order
+func (d diary) resources() []interface{} {
+	d.lifecycle.mutex.Lock()
+	defer d.lifecycle.mutex.Unlock()
+	settings := d.current()
+	resources := make([]interface{}, 0, len(settings.Resources)+len(d.lifecycle.resources))
+	for _, retired := range d.lifecycle.retired {
+		resources = append(resources, retired.Resources...)
+	}
+	resources = append(resources, settings.Resources...)
+	return append(resources, d.lifecycle.resources...)
+}
+
+// Flush drains the handler resources in order, configured handlers first
+// Every resource is flushed even if one fails, the errors are joined
+func (d diary) Flush(ctx context.Context) error {
+	return flushResources(ctx, d.resources())
+}
+
+// Close stops the background routines and any active verbosity boost, and then flushes and closes the handler resources in order
+// The routines are stopped first, so that their final entries, e.g. the last error report, still reach the handlers
+// Log entries written after Close are written to stderr as JSON instead of the handlers, closing again does nothing
+func (d diary) Close(ctx context.Context) error {
+	d.lifecycle.mutex.Lock()
+	stops := d.lifecycle.stops
+	d.lifecycle.stops, d.lifecycle.stopping = nil, true
+	d.lifecycle.mutex.Unlock()
+	for i := len(stops) - 1; i >= 0; i-- {
+		stops[i]()
+	}
+	d.booster.stop()
+
+	d.lifecycle.mutex.Lock()
+	closing := d.lifecycle.closed.CompareAndSwap(false, true)
+	d.lifecycle.mutex.Unlock()
+	if !closing {
+		return nil
+	}
+	return closeAll(ctx, d.resources())
+}
+
+// A private function used to flush and then close resources in order
+func closeAll(ctx context.Context, resources []interface{}) error {
+	err := flushResources(ctx, resources)
+	for i, resource := range resources {
+		if closer, ok := resource.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil {
+				err = errors.Join(err, fmt.Errorf("resource %d: %w", i, closeErr))
+			}
+		}
+	}
+	return err
+}
+
+// A private function used to flush resources in order, stopping early once the context is done
+func flushResources(ctx context.Context, resources []interface{}) error {
+	var err error
+	for i, resource := range resources {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return errors.Join(err, ctxErr)
+		}
+		var flushErr error
+		switch flusher := resource.(type) {
+		case Flusher:
+			flushErr = flusher.Flush(ctx)
+		case interface{ Flush() error }:
+			flushErr = flusher.Flush()
+		}
+		if flushErr != nil {
+			err = errors.Join(err, fmt.Errorf("resource %d: %w", i, flushErr))
+		}
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A private resource that counts how often it's closed
+type closeCounter struct {
+	closed atomic.Int32
+}
+
+func (c *closeCounter) Close() error {
+	c.closed.Add(1)
+	return nil
+}
+
+func TestConfigureClosesRetiredResources(t *testing.T) {
+	var opened []*closeCounter
+	RegisterHandler("test-counted", func(options M) (H, error) {
+		resource := &closeCounter{}
+		opened = append(opened, resource)
+		manage(resource)
+		return func(log Log) {}, nil
+	})
+	defer func() {
+		handlerFactories.Lock()
+		delete(handlerFactories.factories, "test-counted")
+		handlerFactories.Unlock()
+	}()
+
+	config := Config{Level: LevelInfo, Handlers: []HandlerConfig{{Type: "test-counted", Level: -1}}}
+	d, err := DearConfig("uprate", "diary", "test", nil, "", "", nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Page(-1, 0, false, "reload", nil, "", "", nil, func(p IPage) {
+		if err := d.Configure(config); err != nil {
+			t.Fatal(err)
+		}
+		if closed := opened[0].closed.Load(); closed != 0 {
+			t.Errorf("the resource of a page in flight was closed %d times", closed)
+		}
+		p.Info("still", nil)
+	})
+	if closed := opened[0].closed.Load(); closed != 1 {
+		t.Errorf("the retired resource was closed %d times once its page was done, expected once", closed)
+	}
+
+	// without pages in flight the resources are closed right away
+	for i := 0; i < 10; i++ {
+		if err := d.Configure(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, resource := range opened[:len(opened)-1] {
+		if closed := resource.closed.Load(); closed != 1 {
+			t.Errorf("retired resource %d was closed %d times, expected once", i, closed)
+		}
+	}
+
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i, resource := range opened {
+		if closed := resource.closed.Load(); closed != 1 {
+			t.Errorf("resource %d was closed %d times after Close, expected once", i, closed)
+		}
+	}
+}
+
+func TestCloseStopsBackgroundRoutines(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "diary.json")
+	if err := os.WriteFile(file, []byte(`{"level": "info"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &logRecorder{}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, recorder.handler)
+	var reports atomic.Int32
+	d.WatchConfig(file, time.Millisecond)
+	d.ReportStats(time.Hour)
+	d.AggregateErrors(time.Hour, func(groups []ErrorGroup) {
+		reports.Add(1)
+	})
+	if err := d.Boost(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Error("run", "failed", nil)
+	})
+
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if reports.Load() != 1 {
+		t.Errorf("expected the final error report before Close returned, got %d reports", reports.Load())
+	}
+	if timer := d.(*diary).booster.timer; timer != nil {
+		t.Errorf("the boost timer is still pending after Close")
+	}
+	if err := d.Boost(time.Hour); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed from a boost after Close but got %v", err)
+	}
+
+	// the watcher no longer reloads the file
+	if err := os.WriteFile(file, []byte(`{"level": "error"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if reloads := recorder.find("diary.config", "configuration reloaded"); len(reloads) != 0 {
+		t.Errorf("the file was reloaded after Close")
+	}
+
+	// routines started after Close are stopped right away
+	d.AggregateErrors(time.Hour, nil)
+	if running := d.(*diary).aggregator.running.Load(); running != 0 {
+		t.Errorf("%d aggregations are still running after Close", running)
+	}
+}
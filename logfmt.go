@@ -0,0 +1,433 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A public struct used to encode log entries as logfmt "key=value" lines
+// Nested structs and meta are flattened into dotted keys, e.g. "service.client=uprate chain.auth.type=user meta.order.id=42"
+// Dots and backslashes within meta keys are escaped with a backslash, other characters that can't appear in a key are replaced with "_"
+// Meta strings that would read as another value, e.g. "42" or "true", are quoted, so that ParseLogfmt restores the type of every scalar
+//
+// - Fields: An allowlist of keys to include, a key also allows every key nested below it [NOTE: If empty all keys are included, e.g. ["time", "level", "meta"].]
+type LogfmtFormatter struct {
+	Fields []string
+}
+
+func (f LogfmtFormatter) Format(dst []byte, log Log) ([]byte, error) {
+	e := logfmtEncoder{dst: dst, fields: f.Fields}
+	e.pair("time", log.Time.Format(time.RFC3339Nano))
+	e.pair("level", log.Level)
+	e.pair("category", log.Category)
+	e.pair("message", log.Message)
+	e.pair("template", log.Template)
+	e.pair("line", log.Line)
+	e.pair("fingerprint", log.Fingerprint)
+	e.pair("chain.id", log.Chain.Id)
+	e.pair("chain.auth.type", log.Chain.Auth.Type)
+	e.pair("chain.auth.identifier", log.Chain.Auth.Identifier)
+	e.meta("chain.auth.meta", log.Chain.Auth.Meta)
+	e.meta("chain.meta", log.Chain.Meta)
+	e.pair("service.client", log.Service.Client)
+	e.pair("service.project", log.Service.Project)
+	e.pair("service.service", log.Service.Service)
+	e.pair("service.host", log.Service.Host)
+	e.pair("service.hostIps", strings.Join(log.Service.HostIps, ","))
+	e.pair("service.pid", strconv.Itoa(log.Service.ProcessId))
+	e.pair("service.ppid", strconv.Itoa(log.Service.ParentProcessId))
+	e.meta("service.meta", log.Service.Meta)
+	e.pair("commit.repository", log.Commit.Repository)
+	e.pair("commit.hash", log.Commit.Hash)
+	e.pair("commit.tags", strings.Join(log.Commit.Tags, ","))
+	e.meta("commit.meta", log.Commit.Meta)
+	e.meta("meta", log.Meta)
+	e.pair("stack", log.Stack)
+	return append(e.dst, '\n'), nil
+}
+
+// A private struct used to append logfmt pairs to a buffer
+type logfmtEncoder struct {
+	dst    []byte
+	fields []string
+}
+
+// allowed checks the key against the field allowlist
+func (e *logfmtEncoder) allowed(key string) bool {
+	if len(e.fields) == 0 {
+		return true
+	}
+	for _, field := range e.fields {
+		if key == field || strings.HasPrefix(key, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// pair appends a single key value pair, empty values are omitted
+func (e *logfmtEncoder) pair(key, value string) {
+	if value == "" {
+		return
+	}
+	e.append(key, value, false)
+}
+
+// append appends a single key value pair, quoting the value if it's forced to or if required
+func (e *logfmtEncoder) append(key, value string, quote bool) {
+	if !e.allowed(key) {
+		return
+	}
+	if len(e.dst) > 0 && e.dst[len(e.dst)-1] != '\n' {
+		e.dst = append(e.dst, ' ')
+	}
+	e.dst = append(e.dst, key...)
+	e.dst = append(e.dst, '=')
+	if quote {
+		e.dst = strconv.AppendQuote(e.dst, value)
+		return
+	}
+	e.dst = appendLogfmtValue(e.dst, value)
+}
+
+// meta flattens the meta into dotted keys below the prefix, in key order
+func (e *logfmtEncoder) meta(prefix string, meta map[string]interface{}) {
+	for _, key := range sortedKeys(meta) {
+		e.value(prefix+"."+logfmtKey(key), meta[key])
+	}
+}
+
+// value appends a single meta value, scalars are written so that they're read back with their type
+// Maps are flattened and other composite values are written as quoted JSON, strings that would read as another value are quoted
+func (e *logfmtEncoder) value(key string, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		e.append(key, "null", false)
+	case string:
+		_, literal := logfmtLiteral(v)
+		e.append(key, v, v == "" || literal)
+	case M:
+		e.nested(key, v)
+	case map[string]interface{}:
+		e.nested(key, v)
+	case time.Time:
+		e.value(key, v.Format(time.RFC3339Nano))
+	case error:
+		e.value(key, v.Error())
+	case fmt.Stringer:
+		e.value(key, v.String())
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		e.append(key, fmt.Sprint(v), false)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			e.value(key, fmt.Sprint(v))
+			return
+		}
+		e.append(key, string(data), true)
+	}
+}
+
+// nested flattens a map within the meta, an empty map is written as {} so that it isn't lost
+func (e *logfmtEncoder) nested(key string, meta map[string]interface{}) {
+	if len(meta) == 0 {
+		e.append(key, "{}", false)
+		return
+	}
+	e.meta(key, meta)
+}
+
+// A private function used to read a bare meta value that isn't a string, e.g. null, true, 42, 4.2 or {} for an empty map
+//
+// - return: The value and a flag indicating if the text is such a value
+func logfmtLiteral(text string) (interface{}, bool) {
+	switch text {
+	case "null":
+		return nil, true
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	case "{}":
+		return M{}, true
+	case "":
+		return nil, false
+	}
+	if c := text[0]; c != '-' && (c < '0' || c > '9') || !json.Valid([]byte(text)) {
+		return nil, false
+	}
+	if value, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return value, true
+	}
+	if value, err := strconv.ParseUint(text, 10, 64); err == nil {
+		return value, true
+	}
+	if value, err := strconv.ParseFloat(text, 64); err == nil {
+		return value, true
+	}
+	return nil, false
+}
+
+// A private function used to escape the dots and backslashes of a meta key and replace the characters that may not appear in a logfmt key
+func logfmtKey(key string) string {
+	if key == "" {
+		return "_"
+	}
+	var out strings.Builder
+	for _, r := range key {
+		switch {
+		case r == '.' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || !unicode.IsPrint(r):
+			out.WriteByte('_')
+		default:
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
+
+// A private function used to split a flattened meta key at its unescaped dots, see logfmtKey
+func splitLogfmtKey(key string) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch {
+		case key[i] == '\\' && i+1 < len(key):
+			i++
+			part.WriteByte(key[i])
+		case key[i] == '.':
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(key[i])
+		}
+	}
+	return append(parts, part.String())
+}
+
+// A private function used to append a logfmt value, quoting and escaping it when required
+func appendLogfmtValue(dst []byte, value string) []byte {
+	for _, r := range value {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || r == utf8.RuneError || !unicode.IsPrint(r) {
+			return strconv.AppendQuote(dst, value)
+		}
+	}
+	return append(dst, value...)
+}
+
+// ParseLogfmt reads a single logfmt line written by the LogfmtFormatter back into a log entry
+// Dotted meta keys are restored as nested meta, meta values as nil, bool, int64 (uint64 or float64 if they don't fit) or string
+// [NOTE: Times, errors and other values written as text are restored as strings, lists and other composite values as their JSON text.]
+func ParseLogfmt(line []byte) (Log, error) {
+	log := Log{}
+	pairs, err := scanLogfmt(strings.TrimRight(string(line), "\r\n"))
+	if err != nil {
+		return log, err
+	}
+
+	for _, pair := range pairs {
+		key, value := pair.key, pair.value
+		switch key {
+		case "time":
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return log, fmt.Errorf("time: %v", err)
+			}
+			log.Time = t
+		case "level":
+			log.Level = value
+		case "category":
+			log.Category = value
+		case "message":
+			log.Message = value
+		case "template":
+			log.Template = value
+		case "line":
+			log.Line = value
+		case "fingerprint":
+			log.Fingerprint = value
+		case "stack":
+			log.Stack = value
+		case "chain.id":
+			log.Chain.Id = value
+		case "chain.auth.type":
+			log.Chain.Auth.Type = value
+		case "chain.auth.identifier":
+			log.Chain.Auth.Identifier = value
+		case "service.client":
+			log.Service.Client = value
+		case "service.project":
+			log.Service.Project = value
+		case "service.service":
+			log.Service.Service = value
+		case "service.host":
+			log.Service.Host = value
+		case "service.hostIps":
+			log.Service.HostIps = strings.Split(value, ",")
+		case "service.pid":
+			if log.Service.ProcessId, err = strconv.Atoi(value); err != nil {
+				return log, fmt.Errorf("service.pid: %v", err)
+			}
+		case "service.ppid":
+			if log.Service.ParentProcessId, err = strconv.Atoi(value); err != nil {
+				return log, fmt.Errorf("service.ppid: %v", err)
+			}
+		case "commit.repository":
+			log.Commit.Repository = value
+		case "commit.hash":
+			log.Commit.Hash = value
+		case "commit.tags":
+			log.Commit.Tags = strings.Split(value, ",")
+		default:
+			switch {
+			case strings.HasPrefix(key, "chain.auth.meta."):
+				log.Chain.Auth.Meta, err = setLogfmtMeta(log.Chain.Auth.Meta, strings.TrimPrefix(key, "chain.auth.meta."), pair.literal())
+			case strings.HasPrefix(key, "chain.meta."):
+				log.Chain.Meta, err = setLogfmtMeta(log.Chain.Meta, strings.TrimPrefix(key, "chain.meta."), pair.literal())
+			case strings.HasPrefix(key, "service.meta."):
+				log.Service.Meta, err = setLogfmtMeta(log.Service.Meta, strings.TrimPrefix(key, "service.meta."), pair.literal())
+			case strings.HasPrefix(key, "commit.meta."):
+				log.Commit.Meta, err = setLogfmtMeta(log.Commit.Meta, strings.TrimPrefix(key, "commit.meta."), pair.literal())
+			case strings.HasPrefix(key, "meta."):
+				log.Meta, err = setLogfmtMeta(log.Meta, strings.TrimPrefix(key, "meta."), pair.literal())
+			default:
+				return log, fmt.Errorf("unknown key %q", key)
+			}
+			if err != nil {
+				return log, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+	return log, nil
+}
+
+// A private function used to restore a flattened meta key as nested meta
+// A key that extends the path of a value that isn't a map, or a value that replaces a nested map, is rejected instead of overwriting it
+func setLogfmtMeta(meta M, key string, value interface{}) (M, error) {
+	if meta == nil {
+		meta = M{}
+	}
+	current := meta
+	parts := splitLogfmtKey(key)
+	for i, part := range parts[:len(parts)-1] {
+		existing, ok := current[part]
+		if !ok {
+			next := M{}
+			current[part] = next
+			current = next
+			continue
+		}
+		next, ok := existing.(M)
+		if !ok {
+			return meta, fmt.Errorf("conflicts with the value of %s", strings.Join(parts[:i+1], "."))
+		}
+		current = next
+	}
+	last := parts[len(parts)-1]
+	if _, ok := current[last].(M); ok {
+		return meta, fmt.Errorf("conflicts with the nested values of %s", strings.Join(parts, "."))
+	}
+	current[last] = value
+	return meta, nil
+}
+
+// A private struct to encapsulate a scanned logfmt pair
+//
+// - quoted: A flag indicating if the value was quoted, quoted values are always strings
+type logfmtPair struct {
+	key    string
+	value  string
+	quoted bool
+}
+
+// literal returns the meta value of the pair, see logfmtLiteral
+func (p logfmtPair) literal() interface{} {
+	if !p.quoted {
+		if value, ok := logfmtLiteral(p.value); ok {
+			return value
+		}
+	}
+	return p.value
+}
+
+// A private function used to split a logfmt line into its key value pairs
+func scanLogfmt(line string) ([]logfmtPair, error) {
+	var pairs []logfmtPair
+	i := 0
+	for i < len(line) {
+		if line[i] == ' ' {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' {
+			i++
+		}
+		key := line[start:i]
+		if i >= len(line) || line[i] != '=' {
+			pairs = append(pairs, logfmtPair{key: key})
+			continue
+		}
+		i++
+
+		if i < len(line) && line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("%s: unterminated quoted value", key)
+			}
+			value, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			pairs = append(pairs, logfmtPair{key: key, value: value, quoted: true})
+			i = end + 1
+			continue
+		}
+
+		start = i
+		for i < len(line) && line[i] != ' ' {
+			i++
+		}
+		pairs = append(pairs, logfmtPair{key: key, value: line[start:i]})
+	}
+	return pairs, nil
+}
+
+// A private function used to create a handler factory for logfmt output
+//
+// Options:
+// - fields: The field allowlist, see LogfmtFormatter (may be empty)
+// - output, path: See formatterHandler
+func logfmtHandler(options M) (H, error) {
+	options = copyOptions(options)
+	formatter := LogfmtFormatter{}
+	if fields, ok := options["fields"]; ok {
+		list, ok := fields.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("fields must be a list of keys")
+		}
+		for _, field := range list {
+			formatter.Fields = append(formatter.Fields, fmt.Sprint(field))
+		}
+		delete(options, "fields")
+	}
+	return formatterHandler(formatter)(options)
+}
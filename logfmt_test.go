@@ -0,0 +1,76 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogfmtRoundTrip(t *testing.T) {
+	moment := time.Date(2023, 11, 14, 22, 13, 20, 123456789, time.UTC)
+	log := Log{
+		Service:  Service{Client: "uprate", Project: "diary", Service: "api", Host: "web 1", HostIps: []string{"10.0.0.1", "fd00::2"}, ProcessId: 42, ParentProcessId: 1, Meta: M{"region": "eu=west"}},
+		Commit:   Commit{Repository: "github.com/uprate/diary", Hash: "abc123", Tags: []string{"v1.0.0"}, Meta: M{"branch": "main"}},
+		Chain:    Chain{Id: "chain-1", Meta: M{"request": "r 1"}, Auth: Auth{Type: "user", Identifier: "jürgen", Meta: M{"role": "admin"}}},
+		Level:    TextLevelError,
+		Category: "orders.create",
+		Line:     "/app/orders.go:12",
+		Stack:    "goroutine 1 [running]:\n\tmain.main()",
+		Message:  `said "hi" \ left=right`,
+		Template: "order {id} failed",
+		Meta: M{
+			"id":         int64(-7),
+			"big":        uint64(18446744073709551615),
+			"total":      19.5,
+			"paid":       false,
+			"note":       nil,
+			"empty":      "",
+			"number":     "42",
+			"truth":      "true",
+			"braces":     "{}",
+			"unicode":    "héllo ☃ 日本",
+			"escapes":    "tab\there\nnewline \"quoted\" back\\slash",
+			"equals":     "a=b",
+			"dotted.key": "not nested",
+			`back\slash`: "key",
+			"order":      M{"id": int64(7), "lines": M{}, "sku.code": "x-1"},
+		},
+		Time: moment,
+	}
+
+	line, err := LogfmtFormatter{}.Format(nil, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(line), "\n") != 1 {
+		t.Fatalf("expected a single line: %q", line)
+	}
+	parsed, err := ParseLogfmt(line)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, line)
+	}
+	if !parsed.Time.Equal(moment) {
+		t.Errorf("time %s parsed as %s", moment, parsed.Time)
+	}
+	parsed.Time = log.Time
+	if !reflect.DeepEqual(parsed, log) {
+		t.Errorf("parsed\n%#v\nexpected\n%#v\nfrom %s", parsed, log, line)
+	}
+}
+
+func TestLogfmtConflicts(t *testing.T) {
+	for _, line := range []string{
+		`meta.a=1 meta.a.b=2`,
+		`meta.a.b=2 meta.a=1`,
+		`meta.a="x" meta.a.b=2`,
+	} {
+		if _, err := ParseLogfmt([]byte(line)); err == nil {
+			t.Errorf("%s: expected a conflict", line)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The meta key the failure of a handler is logged under when its log entry is passed on to the fallback sink
+const MetaKeyHandlerError = "handlerError"
+
+const (
+	// The name of the handler given to Dear in the diary statistics
+	baseHandlerName = "handler"
+	// The name of DefaultHandler in the diary statistics, used when no handler is given or configured
+	defaultHandlerName = "default"
+)
+
+// A public struct to encapsulate the log entry counts of a level or handler, see IDiaryV2.Stats
+//
+// - Emitted: The entries passed on to handlers, for a handler the entries it handled without failing
+// - Suppressed: The entries filtered out by the level or sampling of a page, for a handler the entries its route filtered out
+// - Failed: The entries a handler panicked on or reported as failed, see ReportFailure [NOTE: These entries are passed on to the fallback sink.]
+// - Dropped: The failed entries that the fallback sink couldn't handle either and are lost
+type Counts struct {
+	Emitted    uint64 `json:"emitted"`
+	Suppressed uint64 `json:"suppressed"`
+	Failed     uint64 `json:"failed"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+// A public struct to encapsulate the statistics of a diary instance, see IDiaryV2.Stats
+//
+// - Levels: The counts by level, e.g. "error"
+// - Handlers: The counts by configured handler, e.g. "handlers[0].json", the handler given to Dear is named "handler" and DefaultHandler "default"
+type Stats struct {
+	Levels   map[string]Counts `json:"levels"`
+	Handlers map[string]Counts `json:"handlers"`
+}
+
+// A private struct of atomic counts, see Counts
+type counters struct {
+	emitted    atomic.Uint64
+	suppressed atomic.Uint64
+	failed     atomic.Uint64
+	dropped    atomic.Uint64
+}
+
+// counts returns a snapshot of the counters
+func (c *counters) counts() Counts {
+	return Counts{
+		Emitted:    c.emitted.Load(),
+		Suppressed: c.suppressed.Load(),
+		Failed:     c.failed.Load(),
+		Dropped:    c.dropped.Load(),
+	}
+}
+
+// A private struct to encapsulate the failure a handler reported for the log entry it's handling, see ReportFailure
+// The guard of a handler installs one in the log entry it passes on and reads it once the handler returns
+//
+// - generation: Moved on whenever the failure is installed or read, so that reports of a log entry that is no longer being handled are ignored
+type handlerFailure struct {
+	mutex      sync.Mutex
+	generation uint64
+	err        error
+}
+
+// A private pool of handler failures to avoid an allocation for every guarded log entry
+var failures = sync.Pool{
+	New: func() interface{} {
+		return &handlerFailure{}
+	},
+}
+
+// install resets the failure and returns the generation a log entry has to report for
+func (f *handlerFailure) install() uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.generation++
+	f.err = nil
+	return f.generation
+}
+
+// collect returns the reported failure and ignores any later report
+func (f *handlerFailure) collect() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.generation++
+	err := f.err
+	f.err = nil
+	return err
+}
+
+// ReportFailure reports that a handler failed to handle a log entry, the diary instance counts the failure and passes the entry on to its fallback sink
+// The handler should return after reporting, only the first failure is kept
+// [NOTE: Failures of handlers called directly, outside of a diary instance, and reports made after the handler returned are ignored.]
+//
+// - log: The log entry the handler was given
+func ReportFailure(log Log, err error) {
+	f := log.failure
+	if f == nil || err == nil {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.generation == log.generation && f.err == nil {
+		f.err = err
+	}
+}
+
+// call passes a log entry on to a handler with a failure installed
+//
+// - return: The failure the handler reported, or its panic
+func call(handler H, log Log) (err error) {
+	f := failures.Get().(*handlerFailure)
+	log.failure, log.generation = f, f.install()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		if reported := f.collect(); err == nil {
+			err = reported
+		}
+		failures.Put(f)
+	}()
+	handler(log)
+	return nil
+}
+
+// A private struct to encapsulate the fault isolation and statistics of a diary instance
+//
+// - levels: The counts by level, indexed by level
+// - handlers: The counts by handler name, kept across configuration reloads
+// - fallback: The sink that failed entries are passed on to [NOTE: If nil will write to stderr as JSON.]
+// - defaults: The guarded DefaultHandler, see standard
+type monitor struct {
+	levels   [LevelAudit + 1]counters
+	mutex    sync.Mutex
+	handlers map[string]*counters
+	fallback atomic.Pointer[H]
+	once     sync.Once
+	defaults H
+}
+
+// standard returns the guarded DefaultHandler, it's only counted once it's used
+func (m *monitor) standard() H {
+	m.once.Do(func() {
+		m.defaults = m.guard(defaultHandlerName, DefaultHandler, LevelTrace, nil)
+	})
+	return m.defaults
+}
+
+// level returns the counters of a level, unknown levels are counted as trace
+func (m *monitor) level(level int) *counters {
+	if level < LevelTrace || level > LevelAudit {
+		level = LevelTrace
+	}
+	return &m.levels[level]
+}
+
+// handler returns the counters of a handler by name
+func (m *monitor) handler(name string) *counters {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.handlers == nil {
+		m.handlers = map[string]*counters{}
+	}
+	c, ok := m.handlers[name]
+	if !ok {
+		c = &counters{}
+		m.handlers[name] = c
+	}
+	return c
+}
+
+// guard returns a handler that contains the panics and reported failures of the handler, counts its entries and passes failed entries on to the fallback sink
+//
+// - level: The minimum level routed to the handler [NOTE: If -1 all levels will be routed]
+// - categories: The category prefixes routed to the handler (may be empty)
+func (m *monitor) guard(name string, handler H, level int, categories []string) H {
+	c := m.handler(name)
+	return func(log Log) {
+		if !routed(log, level, categories) {
+			c.suppressed.Add(1)
+			return
+		}
+		if err := call(handler, log); err != nil {
+			c.failed.Add(1)
+			m.level(logLevel(log.Level)).failed.Add(1)
+			if !m.fail(name, log, err) {
+				c.dropped.Add(1)
+				m.level(logLevel(log.Level)).dropped.Add(1)
+			}
+			return
+		}
+		c.emitted.Add(1)
+	}
+}
+
+// deliver returns a synchronous handler that returns the panics and reported failures of the handler instead of passing the entry on to the fallback sink, see IPageV2.AuditEvent
+//
+// - level: The minimum level routed to the handler [NOTE: If -1 all levels will be routed]
+// - categories: The category prefixes routed to the handler (may be empty)
+func (m *monitor) deliver(name string, handler H, level int, categories []string) func(log Log) error {
+	c := m.handler(name)
+	return func(log Log) error {
+		if !routed(log, level, categories) {
+			c.suppressed.Add(1)
+			return nil
+		}
+		if err := call(handler, log); err != nil {
+			c.failed.Add(1)
+			m.level(logLevel(log.Level)).failed.Add(1)
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		c.emitted.Add(1)
+		return nil
+	}
+}
+
+// fail passes a failed log entry on to the fallback sink, with the failure added to its meta
+//
+// - return: A flag indicating if the fallback sink handled the entry
+func (m *monitor) fail(name string, log Log, err error) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+		}
+	}()
+
+	meta := make(M, len(log.Meta)+1)
+	for key, value := range log.Meta {
+		meta[key] = value
+	}
+	meta[MetaKeyHandlerError] = M{"handler": name, "error": err.Error()}
+	log.Meta = meta
+
+	fallback := closedHandler
+	if h := m.fallback.Load(); h != nil {
+		fallback = *h
+	}
+	fallback(log)
+	return true
+}
+
+// A private function used to check if a log entry is routed to a handler with the given level and categories
+func routed(log Log, level int, categories []string) bool {
+	if level > LevelTrace && logLevel(log.Level) < level {
+		return false
+	}
+	if len(categories) == 0 {
+		return true
+	}
+	for _, category := range categories {
+		if matchCategory(category, log.Category) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFallback replaces the sink that the log entries handlers fail on are passed on to
+//
+// - fallback: (may be nil) [NOTE: If nil will write to stderr as JSON.]
+func (d diary) SetFallback(fallback H) {
+	if fallback == nil {
+		d.monitor.fallback.Store(nil)
+		return
+	}
+	d.monitor.fallback.Store(&fallback)
+}
+
+// Stats returns the log entry counts of the diary instance by level and handler since it was created
+func (d diary) Stats() Stats {
+	stats := Stats{Levels: map[string]Counts{}, Handlers: map[string]Counts{}}
+	for level := LevelTrace; level <= LevelAudit; level++ {
+		stats.Levels[ConvertToTextLevel(level)] = d.monitor.levels[level].counts()
+	}
+	d.monitor.mutex.Lock()
+	defer d.monitor.mutex.Unlock()
+	for name, c := range d.monitor.handlers {
+		stats.Handlers[name] = c.counts()
+	}
+	return stats
+}
+
+// ReportStats logs the statistics of the diary instance as a NOTICE at every interval
+// Intervals in which no handler failed or dropped an entry are reported as well, so that a missing report stands out
+func (d diary) ReportStats(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		panic("interval must be greater than zero")
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-ticker.C:
+				stats := d.Stats()
+				failed, dropped := uint64(0), uint64(0)
+				for _, counts := range stats.Handlers {
+					failed += counts.Failed
+					dropped += counts.Dropped
+				}
+				d.system(TextLevelNotice, "diary.stats", fmt.Sprintf("%d failed and %d dropped log entries", failed, dropped), M{
+					"levels":   stats.Levels,
+					"handlers": stats.Handlers,
+				})
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return d.background(func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			<-finished
+		})
+	})
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandlerFaultsAreContained(t *testing.T) {
+	recorder := &logRecorder{}
+	RegisterHandler("test-panicking", func(options M) (H, error) {
+		return func(log Log) {
+			if log.Level == TextLevelWarning {
+				panic("boom")
+			}
+		}, nil
+	})
+	RegisterHandler("test-recording", func(options M) (H, error) {
+		return recorder.handler, nil
+	})
+	defer func() {
+		handlerFactories.Lock()
+		delete(handlerFactories.factories, "test-panicking")
+		delete(handlerFactories.factories, "test-recording")
+		handlerFactories.Unlock()
+	}()
+
+	config := DefaultConfig()
+	config.Level = LevelInfo
+	config.Handlers = []HandlerConfig{
+		{Type: "test-panicking", Level: -1},
+		{Type: "test-recording", Level: LevelWarning},
+	}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, nil)
+	if err := d.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	fallback := &logRecorder{}
+	d.SetFallback(fallback.handler)
+
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Debug("skipped", 1)
+		p.Info("run", nil)
+		p.Warning("slow", "took long", nil)
+	})
+
+	if len(recorder.find("jobs.slow", "took long")) != 1 {
+		t.Errorf("a panicking handler kept the entry from the other handlers")
+	}
+	failed := fallback.find("jobs.slow", "took long")
+	if len(failed) != 1 {
+		t.Fatalf("expected the failed entry at the fallback sink but got %d", len(failed))
+	}
+	failure, _ := failed[0].Meta[MetaKeyHandlerError].(M)
+	if failure["handler"] != "handlers[0].test-panicking" || failure["error"] != "panic: boom" {
+		t.Errorf("unexpected handler error %v", failure)
+	}
+
+	stats := d.Stats()
+	if counts := stats.Levels[TextLevelWarning]; counts.Emitted != 1 || counts.Failed != 1 || counts.Dropped != 0 {
+		t.Errorf("unexpected warning counts %+v", counts)
+	}
+	if counts := stats.Levels[TextLevelDebug]; counts.Suppressed != 1 || counts.Emitted != 0 {
+		t.Errorf("unexpected debug counts %+v", counts)
+	}
+	all := stats.Handlers["handlers[0].test-panicking"]
+	if all.Failed != 1 || all.Emitted == 0 || all.Suppressed != 0 {
+		t.Errorf("unexpected counts of the panicking handler %+v", all)
+	}
+	// the recording handler only routes warnings, so every other entry the first handler got is suppressed
+	if counts := stats.Handlers["handlers[1].test-recording"]; counts.Emitted != 1 || counts.Suppressed != all.Emitted || counts.Failed != 0 {
+		t.Errorf("unexpected counts of the recording handler %+v", counts)
+	}
+}
+
+func TestFallbackFailuresAreDropped(t *testing.T) {
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, func(log Log) {
+		panic("handler")
+	})
+	d.SetFallback(func(log Log) {
+		panic("fallback")
+	})
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Notice("run", nil)
+	})
+
+	if counts := d.Stats().Handlers[baseHandlerName]; counts.Failed != 3 || counts.Dropped != 3 || counts.Emitted != 0 {
+		t.Errorf("unexpected handler counts %+v", counts)
+	}
+	if counts := d.Stats().Levels[TextLevelNotice]; counts.Failed != 1 || counts.Dropped != 1 {
+		t.Errorf("unexpected notice counts %+v", counts)
+	}
+}
+
+func TestReportStats(t *testing.T) {
+	recorder := &logRecorder{}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, recorder.handler)
+	stop := d.ReportStats(5 * time.Millisecond)
+	defer stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reports := recorder.find("diary.stats", "0 failed and 0 dropped log entries")
+		if len(reports) > 0 {
+			if _, ok := reports[0].Meta["levels"]; !ok || reports[0].Level != TextLevelNotice {
+				t.Errorf("unexpected report %+v", reports[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no statistics were reported")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	stop()
+	recorder.mutex.Lock()
+	count := len(recorder.logs)
+	recorder.mutex.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if len(recorder.logs) != count || recorder.logs[count-1].Category != "diary.stats" {
+		t.Errorf("statistics were reported after the reporter was stopped")
+	}
+}
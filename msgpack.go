@@ -0,0 +1,295 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// A public struct used to encode log entries as MessagePack maps
+// Records are self-delimiting so a stream of them can be decoded with DecodeMsgpack, times use the timestamp extension type (-1)
+type MsgpackFormatter struct{}
+
+func (MsgpackFormatter) Format(dst []byte, log Log) ([]byte, error) {
+	return appendBinaryLog(msgpack{}, dst, log)
+}
+
+// DecodeMsgpack reads a single log entry written by the MsgpackFormatter, returning the bytes that follow it
+func DecodeMsgpack(data []byte) (Log, []byte, error) {
+	return decodeBinaryLog(msgpack{}, data)
+}
+
+// A private struct implementing the MessagePack primitives, see https://github.com/msgpack/msgpack/blob/master/spec.md
+type msgpack struct{}
+
+func (msgpack) appendMap(dst []byte, size int) []byte {
+	switch {
+	case size < 16:
+		return append(dst, 0x80|byte(size))
+	case size <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xde), uint16(size))
+	}
+	return binary.BigEndian.AppendUint32(append(dst, 0xdf), uint32(size))
+}
+
+func (msgpack) appendArray(dst []byte, size int) []byte {
+	switch {
+	case size < 16:
+		return append(dst, 0x90|byte(size))
+	case size <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xdc), uint16(size))
+	}
+	return binary.BigEndian.AppendUint32(append(dst, 0xdd), uint32(size))
+}
+
+func (msgpack) appendString(dst []byte, value string) []byte {
+	switch size := len(value); {
+	case size < 32:
+		dst = append(dst, 0xa0|byte(size))
+	case size <= math.MaxUint8:
+		dst = append(dst, 0xd9, byte(size))
+	case size <= math.MaxUint16:
+		dst = binary.BigEndian.AppendUint16(append(dst, 0xda), uint16(size))
+	default:
+		dst = binary.BigEndian.AppendUint32(append(dst, 0xdb), uint32(size))
+	}
+	return append(dst, value...)
+}
+
+func (msgpack) appendBytes(dst []byte, value []byte) []byte {
+	switch size := len(value); {
+	case size <= math.MaxUint8:
+		dst = append(dst, 0xc4, byte(size))
+	case size <= math.MaxUint16:
+		dst = binary.BigEndian.AppendUint16(append(dst, 0xc5), uint16(size))
+	default:
+		dst = binary.BigEndian.AppendUint32(append(dst, 0xc6), uint32(size))
+	}
+	return append(dst, value...)
+}
+
+func (m msgpack) appendInt(dst []byte, value int64) []byte {
+	switch {
+	case value >= 0:
+		return m.appendUint(dst, uint64(value))
+	case value >= -32:
+		return append(dst, byte(value))
+	case value >= math.MinInt8:
+		return append(dst, 0xd0, byte(value))
+	case value >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xd1), uint16(value))
+	case value >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xd2), uint32(value))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, 0xd3), uint64(value))
+}
+
+func (msgpack) appendUint(dst []byte, value uint64) []byte {
+	switch {
+	case value <= math.MaxInt8:
+		return append(dst, byte(value))
+	case value <= math.MaxUint8:
+		return append(dst, 0xcc, byte(value))
+	case value <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xcd), uint16(value))
+	case value <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xce), uint32(value))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, 0xcf), value)
+}
+
+func (msgpack) appendFloat(dst []byte, value float64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, 0xcb), math.Float64bits(value))
+}
+
+func (msgpack) appendBool(dst []byte, value bool) []byte {
+	if value {
+		return append(dst, 0xc3)
+	}
+	return append(dst, 0xc2)
+}
+
+func (msgpack) appendNil(dst []byte) []byte {
+	return append(dst, 0xc0)
+}
+
+// appendTime uses the smallest of the timestamp 32, 64 and 96 formats that can hold the time
+func (msgpack) appendTime(dst []byte, value time.Time) []byte {
+	seconds := value.Unix()
+	nanoseconds := int64(value.Nanosecond())
+	if seconds>>34 == 0 {
+		data := uint64(nanoseconds)<<34 | uint64(seconds)
+		if data&0xffffffff00000000 == 0 {
+			return binary.BigEndian.AppendUint32(append(dst, 0xd6, 0xff), uint32(data))
+		}
+		return binary.BigEndian.AppendUint64(append(dst, 0xd7, 0xff), data)
+	}
+	dst = binary.BigEndian.AppendUint32(append(dst, 0xc7, 12, 0xff), uint32(nanoseconds))
+	return binary.BigEndian.AppendUint64(dst, uint64(seconds))
+}
+
+func (m msgpack) decodeValue(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, data, fmt.Errorf("msgpack: unexpected end of data")
+	}
+	if depth > binaryMaxDepth {
+		return nil, data, fmt.Errorf("msgpack: nesting exceeds %d levels", binaryMaxDepth)
+	}
+	b, data := data[0], data[1:]
+	switch {
+	case b <= 0x7f:
+		return int64(b), data, nil
+	case b >= 0xe0:
+		return int64(int8(b)), data, nil
+	case b&0xf0 == 0x80:
+		return m.decodeMap(data, int(b&0x0f), depth)
+	case b&0xf0 == 0x90:
+		return m.decodeArray(data, int(b&0x0f), depth)
+	case b&0xe0 == 0xa0:
+		return m.decodeString(data, int(b&0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, data, nil
+	case 0xc2:
+		return false, data, nil
+	case 0xc3:
+		return true, data, nil
+	case 0xc4, 0xc5, 0xc6:
+		size, data, err := msgpackSize(data, b-0xc4)
+		if err != nil {
+			return nil, data, err
+		}
+		if len(data) < size {
+			return nil, data, fmt.Errorf("msgpack: unexpected end of data")
+		}
+		return append([]byte(nil), data[:size]...), data[size:], nil
+	case 0xc7, 0xc8, 0xc9:
+		size, data, err := msgpackSize(data, b-0xc7)
+		if err != nil {
+			return nil, data, err
+		}
+		return m.decodeExtension(data, size)
+	case 0xca:
+		value, data, err := binaryUint(data, 4)
+		return float64(math.Float32frombits(uint32(value))), data, err
+	case 0xcb:
+		value, data, err := binaryUint(data, 8)
+		return math.Float64frombits(value), data, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		value, data, err := binaryUint(data, 1<<(b-0xcc))
+		if value <= math.MaxInt64 {
+			return int64(value), data, err
+		}
+		return value, data, err
+	case 0xd0:
+		value, data, err := binaryUint(data, 1)
+		return int64(int8(value)), data, err
+	case 0xd1:
+		value, data, err := binaryUint(data, 2)
+		return int64(int16(value)), data, err
+	case 0xd2:
+		value, data, err := binaryUint(data, 4)
+		return int64(int32(value)), data, err
+	case 0xd3:
+		value, data, err := binaryUint(data, 8)
+		return int64(value), data, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return m.decodeExtension(data, 1<<(b-0xd4))
+	case 0xd9, 0xda, 0xdb:
+		size, data, err := msgpackSize(data, b-0xd9)
+		if err != nil {
+			return nil, data, err
+		}
+		return m.decodeString(data, size)
+	case 0xdc, 0xdd:
+		size, data, err := msgpackSize(data, b-0xdc+1)
+		if err != nil {
+			return nil, data, err
+		}
+		return m.decodeArray(data, size, depth)
+	case 0xde, 0xdf:
+		size, data, err := msgpackSize(data, b-0xde+1)
+		if err != nil {
+			return nil, data, err
+		}
+		return m.decodeMap(data, size, depth)
+	}
+	return nil, data, fmt.Errorf("msgpack: unsupported type 0x%02x", b)
+}
+
+func (msgpack) decodeString(data []byte, size int) (interface{}, []byte, error) {
+	if len(data) < size {
+		return nil, data, fmt.Errorf("msgpack: unexpected end of data")
+	}
+	return string(data[:size]), data[size:], nil
+}
+
+func (m msgpack) decodeArray(data []byte, size, depth int) (interface{}, []byte, error) {
+	list := make([]interface{}, 0, size)
+	for i := 0; i < size; i++ {
+		var value interface{}
+		var err error
+		if value, data, err = m.decodeValue(data, depth+1); err != nil {
+			return nil, data, err
+		}
+		list = append(list, value)
+	}
+	return list, data, nil
+}
+
+func (m msgpack) decodeMap(data []byte, size, depth int) (interface{}, []byte, error) {
+	values := make(map[string]interface{}, size)
+	for i := 0; i < size; i++ {
+		var key, value interface{}
+		var err error
+		if key, data, err = m.decodeValue(data, depth+1); err != nil {
+			return nil, data, err
+		}
+		if value, data, err = m.decodeValue(data, depth+1); err != nil {
+			return nil, data, err
+		}
+		values[fmt.Sprint(key)] = value
+	}
+	return values, data, nil
+}
+
+// decodeExtension reads the extension type and payload, only the timestamp extension (-1) is supported
+func (msgpack) decodeExtension(data []byte, size int) (interface{}, []byte, error) {
+	if len(data) < size+1 {
+		return nil, data, fmt.Errorf("msgpack: unexpected end of data")
+	}
+	kind, payload, data := int8(data[0]), data[1:size+1], data[size+1:]
+	if kind != -1 {
+		return nil, data, fmt.Errorf("msgpack: unsupported extension type %d", kind)
+	}
+	switch size {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(payload)), 0).UTC(), data, nil
+	case 8:
+		value := binary.BigEndian.Uint64(payload)
+		return time.Unix(int64(value&0x3ffffffff), int64(value>>34)).UTC(), data, nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(payload[4:])), int64(binary.BigEndian.Uint32(payload[:4]))).UTC(), data, nil
+	}
+	return nil, data, fmt.Errorf("msgpack: invalid timestamp size %d", size)
+}
+
+// A private function used to read a big endian length of 1, 2 or 4 bytes, selected by 0, 1 or 2
+// Lengths beyond the remaining data are rejected, every string byte and every array or map item takes at least a byte
+func msgpackSize(data []byte, width byte) (int, []byte, error) {
+	value, data, err := binaryUint(data, 1<<width)
+	if err != nil {
+		return 0, data, err
+	}
+	if value > uint64(len(data)) {
+		return 0, data, fmt.Errorf("msgpack: length %d exceeds the data", value)
+	}
+	return int(value), data, nil
+}
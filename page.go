@@ -8,31 +8,103 @@ package diary
 
 import (
 	"encoding/json"
-	"fmt"
-	"os"
-	"runtime"
-	"runtime/debug"
 	"time"
 )
 
 // A private function used to parse a page instance from its JSON definition
-var parsePage = func(data []byte, d diary) (page, error) {
+var parsePage = func(data []byte, d diary, s *settings) (page, error) {
 	var p page
 	if err := json.Unmarshal(data, &p); err != nil {
 		return page{}, err
 	}
 	p.Diary = d
+	p.settings = s
+	if len(p.Propagated) > 0 {
+		// the definition may come from another service with different limits
+		p.Propagated = p.settings.Config.Limits.propagated(p.Propagated)
+	}
 	return p, nil
 }
 
 // A private struct to encapsulate page instance logic
+//
+// - Fields: The bound fields merged into the meta of every log entry, see With
+// - Propagated: The bound fields that are also carried across ToJson and Load, see WithPropagated
 type page struct {
-	Diary    diary
-	Chain    Chain
-	Category string
-	Sample   int
-	Level    int
-	Catch    bool
+	Diary      diary
+	settings   *settings
+	Chain      Chain
+	Category   string
+	Sample     int
+	Level      int
+	Catch      bool
+	Fields     M
+	Propagated M
+}
+
+// write passes a log entry of the page on to the handler, the caller of the page method is used as its line
+// [NOTE: Must only be called directly from the page methods, see callerLine.]
+//
+// - template: (may be empty) The raw format of the formatted page methods, e.g. Infof
+// - frames: (may be nil) The stack of the log entry, also rendered as its legacy string form
+// - meta: (may be nil) [NOTE: If nil will log an empty map.]
+func (p page) write(level, category, message, template string, frames []Frame, meta M) {
+	meta = p.meta(meta)
+	if meta == nil {
+		meta = M{}
+	}
+	p.Diary.handle(p.settings, Log{
+		Service:  p.Diary.Service,
+		Commit:   p.Diary.Commit,
+		Chain:    p.Chain,
+		Level:    level,
+		Category: category,
+		Line:     callerLine(2),
+		Stack:    renderFrames(frames),
+		Frames:   frames,
+		Message:  message,
+		Template: template,
+		Meta:     meta,
+		Time:     time.Now(),
+	})
+}
+
+// meta merges the bound fields into the meta of a log entry, the meta takes precedence over the bound fields
+// The meta is returned as is if the page has no bound fields
+func (p page) meta(meta M) M {
+	if len(p.Fields) == 0 && len(p.Propagated) == 0 {
+		return meta
+	}
+	merged := make(M, len(p.Propagated)+len(p.Fields)+len(meta))
+	for key, value := range p.Propagated {
+		merged[key] = value
+	}
+	for key, value := range p.Fields {
+		merged[key] = value
+	}
+	for key, value := range meta {
+		merged[key] = value
+	}
+	return merged
+}
+
+// frames captures the stack of the caller, limited to the MaxFrames of the diary instance
+func (p page) frames() []Frame {
+	return callerFrames(p.settings.Config.Limits.resolve().MaxFrames)
+}
+
+// enabled checks if a log entry of the given level should be logged for the given category, entries that aren't are counted as suppressed
+func (p page) enabled(level int, category string) bool {
+	if p.allowed(level, category) {
+		return true
+	}
+	p.Diary.monitor.level(level).suppressed.Add(1)
+	return false
+}
+
+// allowed checks if a log entry of the given level should be logged for the given category, without counting it
+func (p page) allowed(level int, category string) bool {
+	return level >= p.Diary.booster.level(p.settings.levelFor(category, p.Level))
 }
 
 // return parent diary
@@ -42,254 +114,180 @@ func (p page) Parent() IDiary {
 
 // normally only used for troubleshooting
 func (p page) Debug(key string, value interface{}) {
-	if p.Level > LevelDebug {
+	cat := joinCategory(p.Category, key)
+	if !p.enabled(LevelDebug, cat) {
 		return
 	}
 
-	cat := key
-	if p.Category != "" {
-		cat = fmt.Sprintf("%s.%s", p.Category, key)
-	}
-
-	_, file, line, _ := runtime.Caller(1)
-	log := Log{
-		Service:  p.Diary.Service,
-		Commit:   p.Diary.Commit,
-		Chain:    p.Chain,
-		Level:    TextLevelDebug,
-		Category: cat,
-		Line:     fmt.Sprintf("%s:%d", file, line),
-		Stack:    "",
-		Message:  "",
-		Meta: M{
-			key: value,
-		},
-		Time: time.Now(),
-	}
-	if p.Diary.Handler != nil {
-		p.Diary.Handler(log)
-	} else {
-		DefaultHandler(log)
-	}
+	p.write(TextLevelDebug, cat, "", "", nil, M{key: value})
 }
 
 // normally inside of a loop
 func (p page) Info(category string, meta M) {
-	if p.Level > LevelInfo {
+	cat := joinCategory(p.Category, category)
+	if !p.enabled(LevelInfo, cat) {
 		return
 	}
 
-	cat := category
-	if p.Category != "" {
-		cat = fmt.Sprintf("%s.%s", p.Category, category)
-	}
-
-	_, file, line, _ := runtime.Caller(1)
-	if meta == nil {
-		meta = M{}
-	}
-	log := Log{
-		Service:  p.Diary.Service,
-		Commit:   p.Diary.Commit,
-		Chain:    p.Chain,
-		Level:    TextLevelInfo,
-		Category: cat,
-		Line:     fmt.Sprintf("%s:%d", file, line),
-		Stack:    "",
-		Message:  "",
-		Meta:     meta,
-		Time:     time.Now(),
-	}
-	if p.Diary.Handler != nil {
-		p.Diary.Handler(log)
-	} else {
-		DefaultHandler(log)
-	}
+	p.write(TextLevelInfo, cat, "", "", nil, meta)
 }
 
 // normally outside of a loop
 func (p page) Notice(category string, meta M) {
-	if p.Level > LevelNotice {
+	cat := joinCategory(p.Category, category)
+	if !p.enabled(LevelNotice, cat) {
 		return
 	}
 
-	cat := category
-	if p.Category != "" {
-		cat = fmt.Sprintf("%s.%s", p.Category, category)
-	}
-
-	_, file, line, _ := runtime.Caller(1)
-	if meta == nil {
-		meta = M{}
-	}
-	log := Log{
-		Service:  p.Diary.Service,
-		Commit:   p.Diary.Commit,
-		Chain:    p.Chain,
-		Level:    TextLevelNotice,
-		Category: cat,
-		Line:     fmt.Sprintf("%s:%d", file, line),
-		Stack:    "",
-		Message:  "",
-		Meta:     meta,
-		Time:     time.Now(),
-	}
-	if p.Diary.Handler != nil {
-		p.Diary.Handler(log)
-	} else {
-		DefaultHandler(log)
-	}
+	p.write(TextLevelNotice, cat, "", "", nil, meta)
 }
 
 // - category: (may be empty)
 func (p page) Warning(category, message string, meta M) {
-	if p.Level > LevelWarning {
+	cat := joinCategory(p.Category, category)
+	if !p.enabled(LevelWarning, cat) {
 		return
 	}
 
-	cat := category
-	if p.Category != "" {
-		cat = fmt.Sprintf("%s.%s", p.Category, category)
-	}
+	p.write(TextLevelWarning, cat, message, "", nil, meta)
+}
 
-	_, file, line, _ := runtime.Caller(1)
-	if meta == nil {
-		meta = M{}
+func (p page) Error(category, message string, meta M) {
+	cat := joinCategory(p.Category, category)
+	if !p.enabled(LevelError, cat) {
+		return
 	}
-	log := Log{
-		Service:  p.Diary.Service,
-		Commit:   p.Diary.Commit,
-		Chain:    p.Chain,
-		Level:    TextLevelWarning,
-		Category: cat,
-		Line:     fmt.Sprintf("%s:%d", file, line),
-		Stack:    "",
-		Message:  message,
-		Meta:     meta,
-		Time:     time.Now(),
+
+	p.write(TextLevelError, cat, message, "", p.frames(), meta)
+}
+
+// the same as Info with a message formatted from the arguments
+// - format: A fmt format or a message template, e.g. "user {user} failed login {attempts} times" [NOTE: Template placeholders are captured into the meta and the raw format is logged as the template.]
+func (p page) Infof(category, format string, args ...interface{}) {
+	cat := joinCategory(p.Category, category)
+	if !p.enabled(LevelInfo, cat) {
+		return
 	}
-	if p.Diary.Handler != nil {
-		p.Diary.Handler(log)
-	} else {
-		DefaultHandler(log)
+
+	message, fields := renderMessage(format, args)
+	p.write(TextLevelInfo, cat, message, format, nil, fields)
+}
+
+// the same as Warning with a message formatted from the arguments, see Infof
+func (p page) Warningf(category, format string, args ...interface{}) {
+	cat := joinCategory(p.Category, category)
+	if !p.enabled(LevelWarning, cat) {
+		return
 	}
+
+	message, fields := renderMessage(format, args)
+	p.write(TextLevelWarning, cat, message, format, nil, fields)
 }
 
-func (p page) Error(category, message string, meta M) {
-	if p.Level > LevelError {
+// the same as Error with a message formatted from the arguments, see Infof
+func (p page) Errorf(category, format string, args ...interface{}) {
+	cat := joinCategory(p.Category, category)
+	if !p.enabled(LevelError, cat) {
 		return
 	}
 
-	cat := category
-	if p.Category != "" {
-		cat = fmt.Sprintf("%s.%s", p.Category, category)
+	message, fields := renderMessage(format, args)
+	p.write(TextLevelError, cat, message, format, p.frames(), fields)
+}
+
+// the same as Error for an error, its chain of causes is logged below the MetaKeyError meta key
+// The fields of errors implementing ErrorFields are merged into the meta and the stack of an error implementing ErrorCallers is preferred
+// - err: (may be nil) [NOTE: If nil nothing is logged.]
+// - meta: (may be nil) [NOTE: The meta takes precedence over the error fields.]
+func (p page) Err(category string, err error, meta M) {
+	if err == nil {
+		return
+	}
+	cat := joinCategory(p.Category, category)
+	if !p.enabled(LevelError, cat) {
+		return
 	}
 
-	_, file, line, _ := runtime.Caller(1)
-	if meta == nil {
-		meta = M{}
+	details, fields, pcs := describeError(err)
+	frames := p.frames()
+	if len(pcs) > 0 {
+		frames = framesOf(pcs, p.settings.Config.Limits.resolve().MaxFrames)
 	}
-	log := Log{
-		Service:  p.Diary.Service,
-		Commit:   p.Diary.Commit,
-		Chain:    p.Chain,
-		Level:    TextLevelError,
-		Category: cat,
-		Line:     fmt.Sprintf("%s:%d", file, line),
-		Stack:    string(debug.Stack()),
-		Message:  message,
-		Meta:     meta,
-		Time:     time.Now(),
+	merged := make(M, len(fields)+len(meta)+1)
+	for key, value := range fields {
+		merged[key] = value
 	}
-	if p.Diary.Handler != nil {
-		p.Diary.Handler(log)
-	} else {
-		DefaultHandler(log)
+	merged[MetaKeyError] = details
+	for key, value := range meta {
+		merged[key] = value
 	}
+	p.write(TextLevelError, cat, details["message"].(string), "", frames, merged)
 }
 
-// application will be force to exit
+// application will be force to exit, after the exit hooks of the diary instance have run, see IDiaryV2.OnExit
+// [NOTE: If the exit function of the diary instance returns, e.g. in tests, Fatal returns as well.]
 func (p page) Fatal(category, message string, code int, meta M) {
-	cat := category
-	if p.Category != "" {
-		cat = fmt.Sprintf("%s.%s", p.Category, category)
-	}
+	cat := joinCategory(p.Category, category)
 
-	_, file, line, _ := runtime.Caller(1)
-	if meta == nil {
-		meta = M{}
-	}
-	log := Log{
-		Service:  p.Diary.Service,
-		Commit:   p.Diary.Commit,
-		Chain:    p.Chain,
-		Level:    TextLevelFatal,
-		Category: cat,
-		Line:     fmt.Sprintf("%s:%d", file, line),
-		Stack:    "",
-		Message:  "",
-		Meta:     meta,
-		Time:     time.Now(),
-	}
-	if p.Diary.Handler != nil {
-		p.Diary.Handler(log)
-	} else {
-		DefaultHandler(log)
-	}
-	os.Exit(code)
+	p.write(TextLevelFatal, cat, message, "", p.frames(), meta)
+	p.Diary.exit(code)
 }
 
-// used to track specific events for auditing
-func (p page) Audit(category string, meta M) {
-	cat := category
-	if p.Category != "" {
-		cat = fmt.Sprintf("%s.%s", p.Category, category)
-	}
+// With returns a page that merges the given fields into the meta of all its log entries
+// The fields are also bound to the pages created with Scope, but aren't carried across ToJson and Load
+//
+// - meta: The fields to bind [NOTE: The meta given to a log call takes precedence over bound fields with the same key.]
+func (p page) With(meta M) IPageV2 {
+	p.Fields = bind(p.Fields, meta)
+	return p
+}
 
-	_, file, line, _ := runtime.Caller(1)
-	if meta == nil {
-		meta = M{}
-	}
-	log := Log{
-		Service:  p.Diary.Service,
-		Commit:   p.Diary.Commit,
-		Chain:    p.Chain,
-		Level:    TextLevelNotice,
-		Category: cat,
-		Line:     fmt.Sprintf("%s:%d", file, line),
-		Stack:    "",
-		Message:  "",
-		Meta:     meta,
-		Time:     time.Now(),
+// WithPropagated returns a page that merges the given fields into the meta of all its log entries
+// Unlike With the fields are also carried across ToJson and Load, limited to the MaxPropagated size of the diary instance
+func (p page) WithPropagated(meta M) IPageV2 {
+	p.Propagated = bind(p.Propagated, meta)
+	return p
+}
+
+// A private function used to copy the bound fields with the given fields added, so that pages never share their bound fields
+func bind(fields M, meta M) M {
+	out := make(M, len(fields)+len(meta))
+	for key, value := range fields {
+		out[key] = value
 	}
-	if p.Diary.Handler != nil {
-		p.Diary.Handler(log)
-	} else {
-		DefaultHandler(log)
+	for key, value := range meta {
+		out[key] = value
 	}
+	return out
 }
 
 func (p page) Scope(category string, scope S) error {
-	return p.Diary.LoadX(p.ToJson(), category, scope)
+	return p.Diary.loadX(p.ToJson(), category, p.Fields, scope)
 }
 
 func (p page) ToJson() []byte {
+	var propagated M
+	if len(p.Propagated) > 0 {
+		propagated = p.settings.Config.Limits.propagated(p.Propagated)
+	}
 	data, err := json.Marshal(struct {
-		Service  Service `json:"service"`
-		Commit   Commit  `json:"commit"`
-		Chain    Chain   `json:"chain"`
-		Category string  `json:"category"`
-		Sample   int     `json:"sample"`
-		Level    int     `json:"level"`
-		Catch    bool    `json:"catch"`
+		Service    Service `json:"service"`
+		Commit     Commit  `json:"commit"`
+		Chain      Chain   `json:"chain"`
+		Category   string  `json:"category"`
+		Sample     int     `json:"sample"`
+		Level      int     `json:"level"`
+		Catch      bool    `json:"catch"`
+		Propagated M       `json:"propagated,omitempty"`
 	}{
-		Service:  p.Diary.Service,
-		Commit:   p.Diary.Commit,
-		Chain:    p.Chain,
-		Category: p.Category,
-		Sample:   p.Sample,
-		Level:    p.Level,
-		Catch:    p.Catch,
+		Service:    p.Diary.Service,
+		Commit:     p.Diary.Commit,
+		Chain:      p.Chain,
+		Category:   p.Category,
+		Sample:     p.Sample,
+		Level:      p.Level,
+		Catch:      p.Catch,
+		Propagated: propagated,
 	})
 	if err != nil {
 		panic(err)
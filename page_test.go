@@ -0,0 +1,97 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWithFields(t *testing.T) {
+	recorder := &logRecorder{}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, recorder.handler)
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		order := p.(IPageV2).With(M{"order": 7, "user": "bound"})
+		paid := order.With(M{"state": "paid"})
+		order.Info("created", M{"user": "meta"})
+		paid.Info("paid", nil)
+		p.Info("plain", nil)
+		order.Scope("db", func(s IPage) {
+			s.Info("insert", nil)
+		})
+	})
+
+	cases := []struct {
+		category string
+		expected M
+	}{
+		{"jobs.created", M{"order": 7, "user": "meta"}},
+		{"jobs.paid", M{"order": 7, "user": "bound", "state": "paid"}},
+		{"jobs.plain", M{}},
+		{"jobs.db.insert", M{"order": 7, "user": "bound"}},
+	}
+	for _, c := range cases {
+		found := recorder.find(c.category, "")
+		if len(found) != 1 {
+			t.Errorf("%s: expected a single entry but got %d", c.category, len(found))
+			continue
+		}
+		if meta := found[0].Meta; len(meta) != len(c.expected) {
+			t.Errorf("%s: expected meta %v but got %v", c.category, c.expected, meta)
+		}
+		for key, value := range c.expected {
+			if found[0].Meta[key] != value {
+				t.Errorf("%s: expected %s to be %v but got %v", c.category, key, value, found[0].Meta[key])
+			}
+		}
+	}
+}
+
+func TestWithPropagatedFields(t *testing.T) {
+	recorder := &logRecorder{}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, recorder.handler)
+	var data []byte
+	d.Page(-1, 0, false, "client", nil, "", "", nil, func(p IPage) {
+		data = p.(IPageV2).With(M{"local": true}).WithPropagated(M{"tenant": "acme"}).ToJson()
+	})
+	d.Load(data, "server", func(p IPage) {
+		p.Info("handle", nil)
+	})
+
+	found := recorder.find("client.server.handle", "")
+	if len(found) != 1 {
+		t.Fatalf("expected a single entry but got %d", len(found))
+	}
+	if found[0].Meta["tenant"] != "acme" {
+		t.Errorf("the propagated field wasn't carried across ToJson and Load: %v", found[0].Meta)
+	}
+	if _, ok := found[0].Meta["local"]; ok {
+		t.Errorf("a field bound with With was carried across ToJson: %v", found[0].Meta)
+	}
+}
+
+func TestWithPropagatedLimit(t *testing.T) {
+	config := DefaultConfig()
+	config.Limits.MaxPropagated = 64
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, func(log Log) {})
+	if err := d.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	d.Page(-1, 0, false, "client", nil, "", "", nil, func(p IPage) {
+		data = p.(IPageV2).WithPropagated(M{"tenant": "acme", "token": strings.Repeat("x", 10000)}).ToJson()
+	})
+
+	var definition struct {
+		Propagated json.RawMessage `json:"propagated"`
+	}
+	if err := json.Unmarshal(data, &definition); err != nil {
+		t.Fatal(err)
+	}
+	if size := len(definition.Propagated); size == 0 || size > 256 {
+		t.Errorf("expected the propagated fields to be limited to about 64 bytes, got %d: %s", size, definition.Propagated)
+	}
+}
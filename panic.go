@@ -0,0 +1,115 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+const (
+	// PanicRecover logs the panic and returns it from the page scope as an error
+	PanicRecover = "recover"
+	// PanicRepanic logs the panic and panics again with the same value
+	PanicRepanic = "repanic"
+	// PanicExit logs the panic and exits the process
+	PanicExit = "exit"
+)
+
+// The meta key a recovered panic is logged under
+const MetaKeyPanic = "panic"
+
+// The largest dump of all goroutines that is logged, larger dumps are cut
+const maxGoroutineDump = 1024 * 1024
+
+// A public struct to encapsulate how pages that catch panics handle them, see the catch parameter of IDiary.Page
+//
+// - Policy: What happens once the panic is logged, either PanicRecover, PanicRepanic or PanicExit [NOTE: If empty will use PanicRecover.]
+// - Goroutines: A flag indicating if the stacks of all goroutines are logged as the stack of the panic, instead of only the panicking goroutine
+// - ExitCode: The code the process exits with for PanicExit, after the exit hooks have run [NOTE: If zero will use 2, the same as an unrecovered panic.]
+type PanicConfig struct {
+	Policy     string
+	Goroutines bool
+	ExitCode   int
+}
+
+// recovered logs a panic caught by a page scope and applies the panic policy
+// The panic site is logged as the line of the entry rather than the recovering frame
+// [NOTE: Must only be called from the deferred function of pageScope, see callerFrames.]
+//
+// - category: The category of the page scope
+// - value: The value the scope panicked with
+func (p page) recovered(category string, value interface{}) error {
+	err, ok := value.(error)
+	if !ok {
+		err = fmt.Errorf("%v", value)
+	}
+	config := p.settings.Config.Panic
+
+	if p.enabled(LevelError, category) {
+		meta := M{}
+		if valueErr, ok := value.(error); ok {
+			details, fields, _ := describeError(valueErr)
+			for key, value := range fields {
+				meta[key] = value
+			}
+			meta[MetaKeyError] = details
+		}
+		meta[MetaKeyPanic] = M{
+			"type":  fmt.Sprintf("%T", value),
+			"value": value,
+		}
+
+		// the frames of the runtime and diary are trimmed, so the first frame is the panic site
+		frames := p.frames()
+		line := callerLine(2)
+		if len(frames) > 0 {
+			line = fmt.Sprintf("%s:%d", frames[0].File, frames[0].Line)
+		}
+		stack := renderFrames(frames)
+		if config.Goroutines {
+			stack = goroutineDump()
+		}
+
+		p.Diary.handle(p.settings, Log{
+			Service:  p.Diary.Service,
+			Commit:   p.Diary.Commit,
+			Chain:    p.Chain,
+			Level:    TextLevelError,
+			Category: category,
+			Line:     line,
+			Stack:    stack,
+			Frames:   frames,
+			Message:  errorMessage(err),
+			Meta:     p.meta(meta),
+			Time:     time.Now(),
+		})
+	}
+
+	switch config.Policy {
+	case PanicRepanic:
+		panic(value)
+	case PanicExit:
+		code := config.ExitCode
+		if code == 0 {
+			code = 2
+		}
+		p.Diary.exit(code)
+	}
+	return err
+}
+
+// A private function used to dump the stacks of all goroutines, in the format of an unrecovered panic
+func goroutineDump() string {
+	buffer := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buffer, true)
+		if n < len(buffer) || len(buffer) >= maxGoroutineDump {
+			return string(buffer[:n])
+		}
+		buffer = make([]byte, len(buffer)*2)
+	}
+}
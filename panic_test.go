@@ -0,0 +1,99 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// panicDiary returns a diary instance with the given panic settings that records the panics it logs
+func panicDiary(t *testing.T, config PanicConfig) (IDiaryV2, *[]Log) {
+	var panics []Log
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, func(log Log) {
+		if _, ok := log.Meta[MetaKeyPanic]; ok {
+			panics = append(panics, log)
+		}
+	})
+	configuration := DefaultConfig()
+	configuration.Level = LevelInfo
+	configuration.Panic = config
+	if err := d.Configure(configuration); err != nil {
+		t.Fatal(err)
+	}
+	return d, &panics
+}
+
+func TestPanicSite(t *testing.T) {
+	d, panics := panicDiary(t, PanicConfig{})
+	err := d.PageX(-1, 0, true, "jobs", nil, "", "", nil, func(p IPage) {
+		// the frames of diary are left out, so the panic is raised by the standard library to have a site to attribute it to
+		_ = strings.Repeat("x", -1)
+	})
+	if err == nil || err.Error() != "strings: negative Repeat count" {
+		t.Fatalf("expected the panic to be returned, got %v", err)
+	}
+	if len(*panics) != 1 {
+		t.Fatalf("expected a single panic entry but got %d", len(*panics))
+	}
+
+	log := (*panics)[0]
+	if len(log.Frames) == 0 || log.Frames[0].Function != "strings.Repeat" {
+		t.Fatalf("expected the panicking frame first, got %+v", log.Frames)
+	}
+	if expected := fmt.Sprintf("%s:%d", log.Frames[0].File, log.Frames[0].Line); log.Line != expected {
+		t.Errorf("expected the panic site %s as the line but got %s", expected, log.Line)
+	}
+	if !strings.HasPrefix(log.Stack, "strings.Repeat(...)\n") {
+		t.Errorf("expected the stack to start at the panic site: %s", log.Stack)
+	}
+	value, _ := log.Meta[MetaKeyPanic].(M)
+	if value["type"] != "string" || value["value"] != "strings: negative Repeat count" || log.Level != TextLevelError {
+		t.Errorf("unexpected panic entry %+v", log)
+	}
+}
+
+func TestPanicErrorValue(t *testing.T) {
+	d, panics := panicDiary(t, PanicConfig{Goroutines: true})
+	cause := &fieldsError{message: "broken", fields: M{"order": 7}}
+	err := d.PageX(-1, 0, true, "jobs", nil, "", "", nil, func(p IPage) {
+		panic(cause)
+	})
+	if !errors.Is(err, cause) {
+		t.Errorf("expected the panic error to be returned, got %v", err)
+	}
+	if len(*panics) != 1 {
+		t.Fatalf("expected a single panic entry but got %d", len(*panics))
+	}
+	log := (*panics)[0]
+	details, _ := log.Meta[MetaKeyError].(M)
+	if log.Message != "broken" || log.Meta["order"] != 7 || details["type"] != "*diary.fieldsError" {
+		t.Errorf("the error details weren't logged: %+v", log.Meta)
+	}
+	if !strings.HasPrefix(log.Stack, "goroutine ") {
+		t.Errorf("expected a dump of all goroutines as the stack: %.100s", log.Stack)
+	}
+}
+
+func TestPanicRepanic(t *testing.T) {
+	d, panics := panicDiary(t, PanicConfig{Policy: PanicRepanic})
+	value := func() (value interface{}) {
+		defer func() {
+			value = recover()
+		}()
+		_ = d.PageX(-1, 0, true, "jobs", nil, "", "", nil, func(p IPage) {
+			panic("again")
+		})
+		return nil
+	}()
+	if value != "again" {
+		t.Errorf("expected the same panic value again but got %v", value)
+	}
+	if len(*panics) != 1 {
+		t.Errorf("expected the panic to be logged once before panicking again, got %d entries", len(*panics))
+	}
+}
@@ -0,0 +1,414 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	RedactMask = "mask"
+	RedactHash = "hash"
+	RedactDrop = "drop"
+)
+
+// The value used to replace masked data
+const RedactedValue = "[REDACTED]"
+
+// The built-in detectors of personal data and secrets, see RedactRule.Detect
+const (
+	RedactEmail  = "email"
+	RedactCard   = "card"
+	RedactIban   = "iban"
+	RedactJwt    = "jwt"
+	RedactBearer = "bearer"
+	RedactIp     = "ip"
+)
+
+// The struct tag used to redact a field wherever the struct is logged, e.g. `diary:"redact"`, `diary:"redact,hash"` or `diary:"redact,drop"`
+const RedactTag = "diary"
+
+// A private struct to encapsulate a built-in detector
+//
+// - validate: Checks a match, so that e.g. numbers that fail the Luhn check aren't redacted as cards (may be nil)
+type redactDetector struct {
+	pattern  *regexp.Regexp
+	validate func(match string) bool
+}
+
+var redactDetectors = map[string]redactDetector{
+	RedactEmail:  {pattern: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)},
+	RedactCard:   {pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), validate: luhnValid},
+	RedactIban:   {pattern: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`), validate: ibanValid},
+	RedactJwt:    {pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)},
+	RedactBearer: {pattern: regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`)},
+	RedactIp:     {pattern: regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b|(?:[0-9A-Fa-f]{0,4}:){2,7}[0-9A-Fa-f]{0,4}`), validate: ipValid},
+}
+
+// The key used to hash redacted values when Config.RedactKey is empty, hashes then only correlate within the process
+var processRedactKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("diary: failed to generate a redaction key: %v", err))
+	}
+	return key
+}()
+
+// A public struct to encapsulate a single redaction rule
+// Rules apply to the meta, chain meta and auth meta of log entries, rules without a key also apply to the message and stack
+//
+// - Key: A glob pattern matched against meta key names, case-insensitive (may be empty) [NOTE: e.g. "password" or "*token*"]
+// - Pattern: A regular expression matched against string values, numbers and raw JSON (may be empty) [NOTE: Numbers are matched in their decimal form, e.g. 4111111111111111.]
+// - Detect: A built-in detector matched like Pattern, one of email, card, iban, jwt, bearer or ip (may be empty) [NOTE: Can't be combined with Pattern.]
+// - Action: The action to take on a match, one of mask, hash or drop [NOTE: If empty will default to mask. Drop removes the meta key, or the match from a message or stack.]
+type RedactRule struct {
+	Key     string `json:"key" yaml:"key"`
+	Pattern string `json:"pattern" yaml:"pattern"`
+	Detect  string `json:"detect" yaml:"detect"`
+	Action  string `json:"action" yaml:"action"`
+}
+
+// A private struct to encapsulate a compiled redaction rule
+//
+// - validate: Checks a match of the pattern, see redactDetector (may be nil)
+type redactRule struct {
+	key      string
+	pattern  *regexp.Regexp
+	validate func(match string) bool
+	action   string
+}
+
+// A private struct to encapsulate the compiled redaction rules of a diary instance
+//
+// - key: The HMAC key of the hash action, see Config.RedactKey (may be empty)
+type redactor struct {
+	rules []redactRule
+	key   []byte
+}
+
+// A private function used to compile a set of redaction rules
+//
+// - key: The HMAC key of the hash action (may be empty) [NOTE: If empty will use a random key of the process.]
+func newRedactor(rules []RedactRule, key []byte) (*redactor, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	r := &redactor{key: key}
+	for i, rule := range rules {
+		compiled, err := compileRedactRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("redact[%d]: %v", i, err)
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+// A private function used to validate and compile a single redaction rule
+func compileRedactRule(rule RedactRule) (redactRule, error) {
+	compiled := redactRule{
+		key:    strings.ToLower(rule.Key),
+		action: strings.ToLower(rule.Action),
+	}
+	if compiled.action == "" {
+		compiled.action = RedactMask
+	}
+	switch compiled.action {
+	case RedactMask, RedactHash, RedactDrop:
+	default:
+		return redactRule{}, fmt.Errorf("unknown action %q (expected mask, hash or drop)", rule.Action)
+	}
+	if rule.Key == "" && rule.Pattern == "" && rule.Detect == "" {
+		return redactRule{}, fmt.Errorf("either key, pattern or detect must be defined")
+	}
+	if rule.Pattern != "" && rule.Detect != "" {
+		return redactRule{}, fmt.Errorf("pattern and detect can't be combined")
+	}
+	if rule.Detect != "" {
+		detector, ok := redactDetectors[strings.ToLower(rule.Detect)]
+		if !ok {
+			return redactRule{}, fmt.Errorf("unknown detector %q (expected email, card, iban, jwt, bearer or ip)", rule.Detect)
+		}
+		compiled.pattern = detector.pattern
+		compiled.validate = detector.validate
+	}
+	if rule.Key != "" {
+		if _, err := path.Match(compiled.key, ""); err != nil {
+			return redactRule{}, fmt.Errorf("invalid key glob %q: %v", rule.Key, err)
+		}
+	}
+	if rule.Pattern != "" {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return redactRule{}, fmt.Errorf("invalid pattern %q: %v", rule.Pattern, err)
+		}
+		compiled.pattern = pattern
+	}
+	return compiled, nil
+}
+
+// apply returns a copy of the log with all rules applied to its meta, chain meta, auth meta, message and stack
+func (r *redactor) apply(log Log) Log {
+	if r == nil {
+		return log
+	}
+	log.Message = r.text(log.Message)
+	log.Stack = r.text(log.Stack)
+	log.Chain.Meta = r.meta(log.Chain.Meta)
+	log.Chain.Auth.Meta = r.meta(log.Chain.Auth.Meta)
+	log.Meta = r.meta(log.Meta)
+	return log
+}
+
+// text applies the rules without a key to free text, e.g. a message
+func (r *redactor) text(text string) string {
+	if text == "" {
+		return text
+	}
+	for _, rule := range r.rules {
+		if rule.key != "" || rule.pattern == nil {
+			continue
+		}
+		if redacted, changed := rule.replace(r.key, text); changed {
+			text = redacted
+		}
+	}
+	return text
+}
+
+// meta returns a redacted copy of the given meta, the original is never modified
+func (r *redactor) meta(meta M) M {
+	if meta == nil {
+		return nil
+	}
+	out := make(M, len(meta))
+	for key, value := range meta {
+		value, keep := r.value(key, value)
+		if keep {
+			out[key] = value
+		}
+	}
+	return out
+}
+
+// value applies the rules to a single keyed value and reports if the key should be kept
+// Numbers are matched in their decimal form and raw JSON is decoded, so that e.g. a card number logged as an int64 is redacted as well
+func (r *redactor) value(key string, value interface{}) (interface{}, bool) {
+	lower := strings.ToLower(key)
+	for _, rule := range r.rules {
+		if rule.key == "" || rule.pattern != nil {
+			continue
+		}
+		if ok, _ := path.Match(rule.key, lower); ok {
+			return rule.redact(r.key, value)
+		}
+	}
+
+	switch v := value.(type) {
+	case M:
+		return r.meta(v), true
+	case map[string]interface{}:
+		return map[string]interface{}(r.meta(v)), true
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			if item, keep := r.value(key, item); keep {
+				out = append(out, item)
+			}
+		}
+		return out, true
+	case json.RawMessage:
+		decoder := json.NewDecoder(bytes.NewReader(v))
+		decoder.UseNumber()
+		var decoded interface{}
+		if err := decoder.Decode(&decoded); err != nil {
+			// invalid JSON is still matched as text
+			return r.scalar(lower, value, string(v))
+		}
+		redacted, keep := r.value(key, decoded)
+		if !keep {
+			return nil, false
+		}
+		data, err := json.Marshal(redacted)
+		if err != nil {
+			return RedactedValue, true
+		}
+		return json.RawMessage(data), true
+	case string:
+		return r.scalar(lower, v, v)
+	case json.Number:
+		return r.scalar(lower, v, string(v))
+	case int:
+		return r.scalar(lower, v, strconv.FormatInt(int64(v), 10))
+	case int8:
+		return r.scalar(lower, v, strconv.FormatInt(int64(v), 10))
+	case int16:
+		return r.scalar(lower, v, strconv.FormatInt(int64(v), 10))
+	case int32:
+		return r.scalar(lower, v, strconv.FormatInt(int64(v), 10))
+	case int64:
+		return r.scalar(lower, v, strconv.FormatInt(v, 10))
+	case uint:
+		return r.scalar(lower, v, strconv.FormatUint(uint64(v), 10))
+	case uint8:
+		return r.scalar(lower, v, strconv.FormatUint(uint64(v), 10))
+	case uint16:
+		return r.scalar(lower, v, strconv.FormatUint(uint64(v), 10))
+	case uint32:
+		return r.scalar(lower, v, strconv.FormatUint(uint64(v), 10))
+	case uint64:
+		return r.scalar(lower, v, strconv.FormatUint(v, 10))
+	case float32:
+		return r.scalar(lower, v, strconv.FormatFloat(float64(v), 'f', -1, 32))
+	case float64:
+		return r.scalar(lower, v, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return value, true
+}
+
+// scalar applies the pattern rules matching the lowercase key to the text of a single value
+//
+// - value: The original value, returned as it is if no rule matched
+// - text: The value as it's matched, e.g. the decimal form of a number
+func (r *redactor) scalar(lower string, value interface{}, text string) (interface{}, bool) {
+	changed := false
+	for _, rule := range r.rules {
+		if rule.pattern == nil {
+			continue
+		}
+		if rule.key != "" {
+			if ok, _ := path.Match(rule.key, lower); !ok {
+				continue
+			}
+		}
+		if redacted, matched := rule.replace(r.key, text); matched {
+			if rule.action == RedactDrop {
+				return nil, false
+			}
+			text, changed = redacted, true
+		}
+	}
+	if !changed {
+		return value, true
+	}
+	return text, true
+}
+
+// redact applies the rule action to a whole value
+func (rule redactRule) redact(key []byte, value interface{}) (interface{}, bool) {
+	switch rule.action {
+	case RedactDrop:
+		return nil, false
+	case RedactHash:
+		return hashValue(key, fmt.Sprint(value)), true
+	}
+	return RedactedValue, true
+}
+
+// replace applies the rule action to the matches of its pattern in a string, matches that fail validation are kept
+//
+// - return: The redacted string and a flag indicating if anything matched
+func (rule redactRule) replace(key []byte, value string) (string, bool) {
+	changed := false
+	out := rule.pattern.ReplaceAllStringFunc(value, func(match string) string {
+		if rule.validate != nil && !rule.validate(match) {
+			return match
+		}
+		changed = true
+		switch rule.action {
+		case RedactDrop:
+			return ""
+		case RedactHash:
+			return hashValue(key, match)
+		}
+		return RedactedValue
+	})
+	return out, changed
+}
+
+// A private function used to check a card number with the Luhn algorithm
+func luhnValid(match string) bool {
+	sum, count := 0, 0
+	for i := len(match) - 1; i >= 0; i-- {
+		c := match[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if count%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		count++
+	}
+	return count >= 13 && count <= 19 && sum%10 == 0
+}
+
+// A private function used to check an IBAN with its ISO 7064 mod 97 check digits
+func ibanValid(match string) bool {
+	iban := strings.ReplaceAll(match, " ", "")
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	var digits strings.Builder
+	for _, c := range iban[4:] + iban[:4] {
+		switch {
+		case c >= '0' && c <= '9':
+			digits.WriteRune(c)
+		case c >= 'A' && c <= 'Z':
+			fmt.Fprintf(&digits, "%d", c-'A'+10)
+		default:
+			return false
+		}
+	}
+	number, ok := new(big.Int).SetString(digits.String(), 10)
+	return ok && new(big.Int).Mod(number, big.NewInt(97)).Int64() == 1
+}
+
+// A private function used to check that a match is an IP address, so that e.g. times and "std::string" aren't redacted
+// IPv6 addresses need at least two groups, which leaves out "::1"
+func ipValid(match string) bool {
+	if net.ParseIP(match) == nil {
+		return false
+	}
+	if !strings.Contains(match, ":") {
+		return true
+	}
+	groups := 0
+	for _, group := range strings.Split(match, ":") {
+		if group != "" {
+			groups++
+		}
+	}
+	return groups >= 2
+}
+
+// A private function used to hash a value so that it may still be correlated without being disclosed
+// The hash is an HMAC, so that values with few possibilities like card numbers can't be recovered without the key
+//
+// - key: The HMAC key, see Config.RedactKey (may be empty) [NOTE: If empty will use a random key of the process.]
+func hashValue(key []byte, value string) string {
+	if len(key) == 0 {
+		key = processRedactKey
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
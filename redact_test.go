@@ -0,0 +1,83 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// A private struct that marshals itself, so that its fields only reach the redactor as raw JSON
+type redactMarshaler struct {
+	Email string
+}
+
+func (m redactMarshaler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{"email": m.Email, "card": int64(4111111111111111)})
+}
+
+func TestRedactScalarsAndRawJson(t *testing.T) {
+	r, err := newRedactor([]RedactRule{{Detect: RedactCard}, {Detect: RedactEmail}, {Key: "pin", Pattern: `^\d{4}$`, Action: RedactDrop}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := r.apply(DefaultLimits().Apply(Log{Meta: M{
+		"card":    int64(4111111111111111),
+		"price":   1999.5,
+		"raw":     json.RawMessage(`{"note":"card 4111 1111 1111 1111","count":4111111111111111}`),
+		"account": redactMarshaler{Email: "jane@example.com"},
+		"pin":     1234,
+	}}))
+
+	if log.Meta["card"] != RedactedValue {
+		t.Errorf("int64 card number not redacted: %v", log.Meta["card"])
+	}
+	if log.Meta["price"] != 1999.5 {
+		t.Errorf("unmatched number changed: %#v", log.Meta["price"])
+	}
+	if _, ok := log.Meta["pin"]; ok {
+		t.Errorf("pin wasn't dropped: %v", log.Meta["pin"])
+	}
+	for _, key := range []string{"raw", "account"} {
+		raw, ok := log.Meta[key].(json.RawMessage)
+		if !ok {
+			t.Errorf("%s: expected raw JSON but got %T", key, log.Meta[key])
+			continue
+		}
+		if strings.Contains(string(raw), "4111") || strings.Contains(string(raw), "jane@") {
+			t.Errorf("%s: raw JSON not redacted: %s", key, raw)
+		}
+		if !json.Valid(raw) {
+			t.Errorf("%s: invalid JSON: %s", key, raw)
+		}
+	}
+}
+
+func TestRedactHashKey(t *testing.T) {
+	rules := []RedactRule{{Key: "card", Action: RedactHash}}
+	hash := func(key []byte) interface{} {
+		r, err := newRedactor(rules, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.apply(Log{Meta: M{"card": "4111111111111111"}}).Meta["card"]
+	}
+
+	first, second, other := hash([]byte("secret")), hash([]byte("secret")), hash([]byte("other"))
+	if first != second {
+		t.Errorf("hashes with the same key differ: %v and %v", first, second)
+	}
+	if first == other {
+		t.Errorf("hashes with different keys match: %v", first)
+	}
+	if text, _ := first.(string); !strings.HasPrefix(text, "hmac-sha256:") || strings.Contains(text, "4111") {
+		t.Errorf("unexpected hash %v", first)
+	}
+	if hash(nil) == first {
+		t.Errorf("hash without a key matches a keyed hash")
+	}
+}
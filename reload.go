@@ -0,0 +1,182 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Configure atomically swaps the level, category overrides, sample rate, catch flag, handler routes and redaction rules of a live diary instance
+// Pages already in flight will finish with the settings they were created with, the handler resources of the previous settings are closed once they have
+// Each reload is logged as a NOTICE with a list of the changes
+func (d diary) Configure(config Config) error {
+	next, err := config.settings(d.base, d.monitor)
+	if err != nil {
+		return err
+	}
+	previous := d.settings.Swap(next)
+	d.retire(previous)
+
+	changes := diffConfig(previous.Config, next.Config)
+	message := "configuration reloaded"
+	if len(changes) == 0 {
+		message = "configuration reloaded without changes"
+	}
+	d.system(TextLevelNotice, "diary.config", message, M{
+		"changes": changes,
+	})
+	return nil
+}
+
+// WatchConfig reloads the configuration file into the diary whenever the file changes or the process receives SIGHUP
+// On platforms without SIGHUP, e.g. windows, the file is only reloaded when it changes
+// Failed reloads are logged as an ERROR and the current settings are kept
+//
+// - file: The path of the configuration file [NOTE: If empty will use DIARY_CONFIG]
+// - interval: How frequently the file is checked for changes [NOTE: If zero or less the file is only reloaded on SIGHUP]
+func (d diary) WatchConfig(file string, interval time.Duration) (stop func()) {
+	if file == "" {
+		file = os.Getenv(EnvConfig)
+	}
+
+	hangup := make(chan os.Signal, 1)
+	notifyHangup(hangup)
+
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		tick = ticker.C
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	modified, size := configStat(file)
+	go func() {
+		defer close(finished)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-hangup:
+			case <-tick:
+				m, s := configStat(file)
+				if m.Equal(modified) && s == size {
+					continue
+				}
+			}
+			modified, size = configStat(file)
+
+			config, err := LoadConfig(file)
+			if err == nil {
+				err = d.Configure(config)
+			}
+			if err != nil {
+				d.system(TextLevelError, "diary.config", fmt.Sprintf("configuration reload failed: %v", err), M{
+					"file": file,
+				})
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return d.background(func() {
+		once.Do(func() {
+			signal.Stop(hangup)
+			close(done)
+			<-finished
+		})
+	})
+}
+
+// A private function used to read the details used to detect changes to a configuration file
+func configStat(file string) (time.Time, int64) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return info.ModTime(), info.Size()
+}
+
+// A private function used to describe the differences between two configurations
+func diffConfig(previous, next Config) []string {
+	changes := make([]string, 0)
+	if previous.Level != next.Level {
+		changes = append(changes, fmt.Sprintf("level: %s -> %s", ConvertToTextLevel(previous.Level), ConvertToTextLevel(next.Level)))
+	}
+	if previous.Sample != next.Sample {
+		changes = append(changes, fmt.Sprintf("sample: %d -> %d", previous.Sample, next.Sample))
+	}
+	if previous.Catch != next.Catch {
+		changes = append(changes, fmt.Sprintf("catch: %t -> %t", previous.Catch, next.Catch))
+	}
+	for _, category := range sortedKeys(previous.Categories) {
+		level, ok := next.Categories[category]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("categories.%s: %s -> removed", category, ConvertToTextLevel(previous.Categories[category])))
+		} else if level != previous.Categories[category] {
+			changes = append(changes, fmt.Sprintf("categories.%s: %s -> %s", category, ConvertToTextLevel(previous.Categories[category]), ConvertToTextLevel(level)))
+		}
+	}
+	for _, category := range sortedKeys(next.Categories) {
+		if _, ok := previous.Categories[category]; !ok {
+			changes = append(changes, fmt.Sprintf("categories.%s: added -> %s", category, ConvertToTextLevel(next.Categories[category])))
+		}
+	}
+	if !reflect.DeepEqual(previous.Handlers, next.Handlers) {
+		changes = append(changes, fmt.Sprintf("handlers: %s -> %s", describeHandlers(previous.Handlers), describeHandlers(next.Handlers)))
+	}
+	if !reflect.DeepEqual(previous.Audit, next.Audit) {
+		changes = append(changes, fmt.Sprintf("audit: %s -> %s", describeHandlers(previous.Audit), describeHandlers(next.Audit)))
+	}
+	if !reflect.DeepEqual(previous.Redact, next.Redact) {
+		changes = append(changes, fmt.Sprintf("redact: %d rules -> %d rules", len(previous.Redact), len(next.Redact)))
+	}
+	if !bytes.Equal(previous.RedactKey, next.RedactKey) {
+		// the key is a secret, so only the change is reported
+		changes = append(changes, "redactKey: changed")
+	}
+	if previous.ExitTimeout != next.ExitTimeout {
+		changes = append(changes, fmt.Sprintf("exitTimeout: %s -> %s", previous.ExitTimeout, next.ExitTimeout))
+	}
+	if previous.Panic != next.Panic {
+		changes = append(changes, fmt.Sprintf("panic: %+v -> %+v", previous.Panic, next.Panic))
+	}
+	if previous.Limits.resolve() != next.Limits.resolve() {
+		changes = append(changes, fmt.Sprintf("limits: %+v -> %+v", previous.Limits.resolve(), next.Limits.resolve()))
+	}
+	return changes
+}
+
+// A private function used to summarise handler routes, e.g. "[human(warning) json(api,db)]"
+func describeHandlers(handlers []HandlerConfig) string {
+	routes := make([]string, 0, len(handlers))
+	for _, handler := range handlers {
+		var filters []string
+		if handler.Level > LevelTrace {
+			filters = append(filters, ConvertToTextLevel(handler.Level))
+		}
+		filters = append(filters, handler.Categories...)
+		if len(handler.Options) > 0 {
+			filters = append(filters, "options")
+		}
+		route := handler.Type
+		if len(filters) > 0 {
+			route = fmt.Sprintf("%s(%s)", route, strings.Join(filters, ","))
+		}
+		routes = append(routes, route)
+	}
+	return fmt.Sprintf("[%s]", strings.Join(routes, " "))
+}
@@ -0,0 +1,18 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9 && !js && !wasip1
+
+package diary
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// A private function used to relay SIGHUP to the given channel, see IDiaryV2.WatchConfig
+func notifyHangup(hangup chan<- os.Signal) {
+	signal.Notify(hangup, syscall.SIGHUP)
+}
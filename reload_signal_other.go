@@ -0,0 +1,12 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build windows || plan9 || js || wasip1
+
+package diary
+
+import "os"
+
+// A private function used to relay SIGHUP to the given channel, platforms without SIGHUP only reload on changes to the file
+func notifyHangup(hangup chan<- os.Signal) {}
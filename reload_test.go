@@ -0,0 +1,197 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A private struct to encapsulate the entries received by a test handler, safe for handlers called from a watcher
+type logRecorder struct {
+	mutex sync.Mutex
+	logs  []Log
+}
+
+func (r *logRecorder) handler(log Log) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.logs = append(r.logs, log)
+}
+
+// find returns the entries with the given category and message
+func (r *logRecorder) find(category, message string) []Log {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var found []Log
+	for _, log := range r.logs {
+		if log.Category == category && log.Message == message {
+			found = append(found, log)
+		}
+	}
+	return found
+}
+
+// reloadChanges returns the changes listed by a reload notice, as limited before the handlers received it
+func reloadChanges(log Log) []string {
+	var changes []string
+	items, _ := log.Meta["changes"].([]interface{})
+	for _, item := range items {
+		changes = append(changes, fmt.Sprint(item))
+	}
+	return changes
+}
+
+func TestConfigureSwap(t *testing.T) {
+	recorder := &logRecorder{}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, recorder.handler)
+
+	config := DefaultConfig()
+	config.Level = LevelWarning
+	config.Categories = map[string]int{"jobs.db": LevelDebug}
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		if err := d.Configure(config); err != nil {
+			t.Fatal(err)
+		}
+		p.Info("old", nil)
+	})
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Info("new", nil)
+		p.Warning("new", "warned", nil)
+		p.Debug("db", 1)
+	})
+
+	for category, expected := range map[string]int{"jobs.old": 1, "jobs.new": 0, "jobs.db": 1} {
+		if found := len(recorder.find(category, "")); found != expected {
+			t.Errorf("%s was logged %d times, expected %d", category, found, expected)
+		}
+	}
+	if found := len(recorder.find("jobs.new", "warned")); found != 1 {
+		t.Errorf("the warning was logged %d times, expected once", found)
+	}
+
+	reloads := recorder.find("diary.config", "configuration reloaded")
+	if len(reloads) != 1 {
+		t.Fatalf("expected a single reload notice, got %d", len(reloads))
+	}
+	if reloads[0].Level != TextLevelNotice {
+		t.Errorf("expected a notice but got %s", reloads[0].Level)
+	}
+	expected := []string{"level: info -> warning", "categories.jobs.db: added -> debug"}
+	if changes := reloadChanges(reloads[0]); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %q but got %v", expected, changes)
+	}
+
+	if err := d.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged := recorder.find("diary.config", "configuration reloaded without changes"); len(unchanged) != 1 {
+		t.Errorf("expected a reload notice without changes, got %d", len(unchanged))
+	}
+
+	config.Level = 99
+	if err := d.Configure(config); err == nil {
+		t.Errorf("an invalid configuration was applied")
+	}
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Info("kept", nil)
+	})
+	if found := len(recorder.find("jobs.kept", "")); found != 0 {
+		t.Errorf("the settings were replaced by an invalid configuration")
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	previous := DefaultConfig()
+	previous.Categories = map[string]int{"api": LevelDebug, "db": LevelInfo}
+	previous.Handlers = []HandlerConfig{{Type: "human", Level: LevelWarning}}
+
+	next := DefaultConfig()
+	next.Level = LevelError
+	next.Sample = 10
+	next.Catch = true
+	next.Categories = map[string]int{"api": LevelTrace, "web": LevelError}
+	next.Handlers = []HandlerConfig{{Type: "human", Level: LevelWarning}, {Type: "json", Level: -1, Categories: []string{"api", "db"}, Options: M{"file": "x"}}}
+	next.Redact = []RedactRule{{Key: "password"}}
+	next.RedactKey = []byte("secret")
+	next.ExitTimeout = time.Second
+
+	expected := []string{
+		"level: notice -> error",
+		"sample: 0 -> 10",
+		"catch: false -> true",
+		"categories.api: debug -> trace",
+		"categories.db: info -> removed",
+		"categories.web: added -> error",
+		"handlers: [human(warning)] -> [human(warning) json(api,db,options)]",
+		"redact: 0 rules -> 1 rules",
+		"redactKey: changed",
+		"exitTimeout: 0s -> 1s",
+	}
+	if changes := diffConfig(previous, next); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes\n%q\nbut got\n%q", expected, changes)
+	}
+	if changes := diffConfig(next, next); len(changes) != 0 {
+		t.Errorf("expected no changes but got %q", changes)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "diary.json")
+	write := func(data string) {
+		if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"level": "warning"}`)
+
+	recorder := &logRecorder{}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, recorder.handler)
+	stop := d.WatchConfig(file, 5*time.Millisecond)
+	defer stop()
+
+	wait := func(message string) []Log {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if found := recorder.find("diary.config", message); len(found) > 0 {
+				return found
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("%q wasn't logged", message)
+		return nil
+	}
+
+	write(`{"level": "error"}`)
+	reloads := wait("configuration reloaded")
+	if changes := reloadChanges(reloads[0]); !reflect.DeepEqual(changes, []string{"level: info -> error"}) {
+		t.Errorf("unexpected changes %v", changes)
+	}
+
+	write(`{"level": "loud!"}`)
+	failures := wait(fmt.Sprintf("configuration reload failed: %v", ConfigError{Problems: []string{"level: invalid level loud!"}}))
+	if failures[0].Level != TextLevelError || failures[0].Meta["file"] != file {
+		t.Errorf("unexpected failure entry %+v", failures[0])
+	}
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Warning("kept", "settings", nil)
+	})
+	if found := len(recorder.find("jobs.kept", "settings")); found != 0 {
+		t.Errorf("the settings were replaced by a failed reload")
+	}
+
+	stop()
+	stop()
+	write(`{"level": "info"}`)
+	time.Sleep(50 * time.Millisecond)
+	if reloads := recorder.find("diary.config", "configuration reloaded"); len(reloads) != 1 {
+		t.Errorf("the file was reloaded after the watcher was stopped")
+	}
+}
@@ -0,0 +1,623 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The key used for the marker that replaces the entries of a map that didn't fit
+const TruncatedKey = "…"
+
+// A public struct to encapsulate the limits applied to the values of a log entry before it reaches any handler
+// Limits of zero will use the value from DefaultLimits and negative limits are not enforced
+//
+// - MaxDepth: The deepest nesting of maps, lists and structs kept, deeper values are replaced with "[max depth]"
+// - MaxString: The longest string kept in bytes, longer strings are cut and marked with "…[truncated N bytes]"
+// - MaxItems: The most entries kept per map, list or struct, the rest are replaced with a "[truncated N items]" marker
+// - MaxEntry: The approximate size in bytes of an encoded log entry [NOTE: Meta that doesn't fit is cut the same way as MaxItems and MaxString cut it.]
+// - MaxPropagated: The approximate size in bytes of the bound fields a page carries across ToJson and Load, see IPageV2.WithPropagated
+// - MaxFrames: The most stack frames captured for a log entry, the outermost frames are cut
+type Limits struct {
+	MaxDepth      int
+	MaxString     int
+	MaxItems      int
+	MaxEntry      int
+	MaxPropagated int
+	MaxFrames     int
+}
+
+// DefaultLimits returns the limits used when no other value has been given
+func DefaultLimits() Limits {
+	return Limits{
+		MaxDepth:  10,
+		MaxString: 8 * 1024,
+		MaxItems:  256,
+		MaxEntry:  256 * 1024,
+
+		MaxPropagated: 4 * 1024,
+		MaxFrames:     32,
+	}
+}
+
+// A private function used to replace the limits of zero with their default value
+func (l Limits) resolve() Limits {
+	defaults := DefaultLimits()
+	if l.MaxDepth == 0 {
+		l.MaxDepth = defaults.MaxDepth
+	}
+	if l.MaxString == 0 {
+		l.MaxString = defaults.MaxString
+	}
+	if l.MaxItems == 0 {
+		l.MaxItems = defaults.MaxItems
+	}
+	if l.MaxEntry == 0 {
+		l.MaxEntry = defaults.MaxEntry
+	}
+	if l.MaxPropagated == 0 {
+		l.MaxPropagated = defaults.MaxPropagated
+	}
+	if l.MaxFrames == 0 {
+		l.MaxFrames = defaults.MaxFrames
+	}
+	return l
+}
+
+// Apply returns a copy of the log entry that can always be encoded, the original entry and its meta are never modified
+// Meta values are converted the way encoding/json would convert them, except that:
+// - lazy values, see Lazy, are resolved and their result converted in their place
+// - errors are rendered with their message
+// - NaN and infinite floats are rendered as "NaN", "+Inf" and "-Inf"
+// - channels, functions and other unsupported values are rendered as "[unsupported <type>]"
+// - values referencing one of their parents are rendered as "[cycle]"
+// - methods that fail or panic while encoding a value are rendered as "[error: <message>]"
+func (l Limits) Apply(log Log) Log {
+	return l.apply(log, nil)
+}
+
+// apply makes a log entry safe to encode like Apply, fields tagged to be hashed are hashed with the given key
+//
+// - key: The HMAC key, see Config.RedactKey (may be empty) [NOTE: If empty will use a random key of the process.]
+func (l Limits) apply(log Log, key []byte) Log {
+	e := safeEncoder{limits: l.resolve(), key: key}
+	if e.limits.MaxEntry > 0 {
+		// the keys of a log entry and its fixed fields take up space as well
+		e.budget = e.limits.MaxEntry - 320 - len(log.Service.Client) - len(log.Service.Project) - len(log.Service.Service) -
+			len(log.Service.Host) - len(log.Commit.Repository) - len(log.Commit.Hash) - len(log.Chain.Id) -
+			len(log.Chain.Auth.Type) - len(log.Chain.Auth.Identifier) - len(log.Level) - len(log.Category) -
+			len(log.Line) - len(log.Stack)
+		for _, frame := range log.Frames {
+			e.budget -= 48 + len(frame.Function) + len(frame.File) + len(frame.Module) + len(frame.Version)
+		}
+	}
+	if e.limits.MaxFrames > 0 && len(log.Frames) > e.limits.MaxFrames {
+		log.Frames = log.Frames[:e.limits.MaxFrames]
+	}
+
+	log.Message = e.string(log.Message)
+	log.Template = e.string(log.Template)
+	log.Service.Meta = e.meta(log.Service.Meta)
+	log.Commit.Meta = e.meta(log.Commit.Meta)
+	log.Chain.Meta = e.meta(log.Chain.Meta)
+	log.Chain.Auth.Meta = e.meta(log.Chain.Auth.Meta)
+	log.Meta = e.meta(log.Meta)
+	return log
+}
+
+// propagated returns a copy of the fields that is safe to encode and fits within MaxPropagated
+func (l Limits) propagated(fields M) M {
+	e := safeEncoder{limits: l.resolve()}
+	e.limits.MaxEntry = e.limits.MaxPropagated
+	e.budget = e.limits.MaxEntry
+	return e.meta(fields)
+}
+
+// A private struct to encapsulate the state of a single Limits.Apply call
+//
+// - budget: The approximate number of bytes left for the entry, only used if MaxEntry is positive
+// - path: The addresses of the maps, lists and pointers currently being encoded, used to detect cycles
+// - depth: The number of addresses in path, addresses beyond its size are kept in overflow
+// - key: The HMAC key of fields tagged to be hashed, see RedactTag (may be empty)
+type safeEncoder struct {
+	limits   Limits
+	key      []byte
+	budget   int
+	path     [16]uintptr
+	depth    int
+	overflow []uintptr
+}
+
+// A private function used to check if the entry has used up its size budget
+func (e *safeEncoder) full() bool {
+	return e.limits.MaxEntry > 0 && e.budget <= 0
+}
+
+// A private function used to account for the encoded size of a value
+func (e *safeEncoder) spend(size int) {
+	e.budget -= size
+}
+
+// meta returns the meta unchanged if it's safe to encode, otherwise a converted copy
+func (e *safeEncoder) meta(meta M) M {
+	if meta == nil {
+		return nil
+	}
+	out, changed := e.object(meta, 0)
+	if !changed {
+		return meta
+	}
+	if m, ok := out.(map[string]interface{}); ok {
+		return m
+	}
+	return M{TruncatedKey: out}
+}
+
+// limit returns the longest string allowed at this point of the entry, or -1 if strings aren't limited
+func (e *safeEncoder) limit() int {
+	max := e.limits.MaxString
+	if e.limits.MaxEntry > 0 && (max < 0 || e.budget < max) {
+		max = e.budget
+		if max < 0 {
+			max = 0
+		}
+	}
+	return max
+}
+
+// string cuts the string to the longest length allowed, keeping whole runes
+func (e *safeEncoder) string(s string) string {
+	if max := e.limit(); max >= 0 && len(s) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		s = fmt.Sprintf("%s…[truncated %d bytes]", s[:cut], len(s)-cut)
+	}
+	e.spend(len(s) + 2)
+	return s
+}
+
+// float returns the string that replaces the values encoding/json rejects, if any
+func (e *safeEncoder) float(value float64) (string, bool) {
+	e.spend(24)
+	switch {
+	case math.IsNaN(value):
+		return "NaN", true
+	case math.IsInf(value, 1):
+		return "+Inf", true
+	case math.IsInf(value, -1):
+		return "-Inf", true
+	}
+	return "", false
+}
+
+// enter checks the depth and cycle limits before a nested value is encoded, returning a marker if the value must be replaced
+// A successful enter must be followed by a call to leave
+func (e *safeEncoder) enter(address uintptr, depth int) (string, bool) {
+	if e.limits.MaxDepth > 0 && depth > e.limits.MaxDepth {
+		e.spend(13)
+		return "[max depth]", false
+	}
+	for i := 0; i < e.depth && i < len(e.path); i++ {
+		if e.path[i] == address {
+			e.spend(9)
+			return "[cycle]", false
+		}
+	}
+	for _, parent := range e.overflow {
+		if parent == address {
+			e.spend(9)
+			return "[cycle]", false
+		}
+	}
+	if e.depth < len(e.path) {
+		e.path[e.depth] = address
+	} else {
+		e.overflow = append(e.overflow, address)
+	}
+	e.depth++
+	return "", true
+}
+
+func (e *safeEncoder) leave() {
+	e.depth--
+	if e.depth >= len(e.path) {
+		e.overflow = e.overflow[:len(e.overflow)-1]
+	}
+}
+
+// value returns the value unchanged if it's safe to encode, otherwise a converted copy and true
+// Unchanged values are returned as the given interface so that they aren't boxed again
+func (e *safeEncoder) value(value interface{}, depth int) (interface{}, bool) {
+	switch v := value.(type) {
+	case nil:
+		e.spend(4)
+	case bool:
+		e.spend(5)
+	case string:
+		if s := e.string(v); s != v {
+			return s, true
+		}
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, json.Number:
+		e.spend(20)
+	case float32:
+		if s, changed := e.float(float64(v)); changed {
+			return s, true
+		}
+	case float64:
+		if s, changed := e.float(v); changed {
+			return s, true
+		}
+	case time.Time:
+		e.spend(37)
+	case []byte:
+		if max := e.limit(); max >= 0 && len(v) > max {
+			return e.string(string(v)), true
+		}
+		e.spend(len(v)*4/3 + 4)
+	case M:
+		out, changed := e.object(v, depth)
+		if !changed {
+			return value, false
+		}
+		if m, ok := out.(map[string]interface{}); ok {
+			return M(m), true
+		}
+		return out, true
+	case map[string]interface{}:
+		return e.object(v, depth)
+	case []interface{}:
+		return e.list(v, depth)
+	case Lazy:
+		return e.lazy(v, depth), true
+	case func() interface{}:
+		return e.lazy(v, depth), true
+	default:
+		return e.reflect(reflect.ValueOf(value), depth), true
+	}
+	return value, false
+}
+
+// lazy resolves a lazy value, a lazy value may resolve to another lazy value up to the maximum depth
+func (e *safeEncoder) lazy(f func() interface{}, depth int) interface{} {
+	if f == nil {
+		e.spend(4)
+		return nil
+	}
+	if e.limits.MaxDepth > 0 && depth > e.limits.MaxDepth {
+		e.spend(13)
+		return "[max depth]"
+	}
+
+	value, err := safeResolve(f)
+	if err != nil {
+		return e.string(fmt.Sprintf("[error: %v]", err))
+	}
+	out, _ := e.value(value, depth+1)
+	return out
+}
+
+// object encodes the entries of a map in key order, only copying the map once an entry changes
+func (e *safeEncoder) object(m map[string]interface{}, depth int) (interface{}, bool) {
+	if m == nil {
+		e.spend(4)
+		return m, false
+	}
+	if marker, ok := e.enter(reflect.ValueOf(m).Pointer(), depth); !ok {
+		return marker, true
+	}
+	defer e.leave()
+
+	e.spend(2)
+	var buffer [16]string
+	keys := sortKeys(buffer[:0], m)
+	var out map[string]interface{}
+	for i, key := range keys {
+		if e.full() || (e.limits.MaxItems > 0 && i >= e.limits.MaxItems) {
+			if out == nil {
+				out = make(map[string]interface{}, i+1)
+				for _, previous := range keys[:i] {
+					out[previous] = m[previous]
+				}
+			}
+			out[TruncatedKey] = fmt.Sprintf("[truncated %d items]", len(keys)-i)
+			e.spend(24)
+			return out, true
+		}
+
+		e.spend(len(key) + 4)
+		value, changed := e.value(m[key], depth+1)
+		if changed && out == nil {
+			out = make(map[string]interface{}, len(m))
+			for _, previous := range keys[:i] {
+				out[previous] = m[previous]
+			}
+		}
+		if out != nil {
+			out[key] = value
+		}
+	}
+	if out == nil {
+		return m, false
+	}
+	return out, true
+}
+
+// list encodes the items of a list in order, only copying the list once an item changes
+func (e *safeEncoder) list(items []interface{}, depth int) (interface{}, bool) {
+	if items == nil {
+		e.spend(4)
+		return items, false
+	}
+	if len(items) > 0 {
+		if marker, ok := e.enter(reflect.ValueOf(items).Pointer(), depth); !ok {
+			return marker, true
+		}
+		defer e.leave()
+	}
+
+	e.spend(2)
+	var out []interface{}
+	for i, item := range items {
+		if e.full() || (e.limits.MaxItems > 0 && i >= e.limits.MaxItems) {
+			if out == nil {
+				out = append(make([]interface{}, 0, i+1), items[:i]...)
+			}
+			e.spend(24)
+			return append(out, fmt.Sprintf("[truncated %d items]", len(items)-i)), true
+		}
+
+		e.spend(1)
+		value, changed := e.value(item, depth+1)
+		if changed && out == nil {
+			out = append(make([]interface{}, 0, len(items)), items[:i]...)
+		}
+		if out != nil {
+			out = append(out, value)
+		}
+	}
+	if out == nil {
+		return items, false
+	}
+	return out, true
+}
+
+// reflect converts any other value into a generic form that the value, object and list functions understand
+func (e *safeEncoder) reflect(v reflect.Value, depth int) interface{} {
+	if !v.IsValid() {
+		e.spend(4)
+		return nil
+	}
+	if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+		e.spend(4)
+		return nil
+	}
+
+	// custom encodings take precedence the same way they do for encoding/json
+	if v.CanInterface() {
+		switch m := v.Interface().(type) {
+		case json.Marshaler:
+			data, err := safeCall(func() ([]byte, error) { return m.MarshalJSON() })
+			if err != nil {
+				return e.string(fmt.Sprintf("[error: %v]", err))
+			}
+			if !json.Valid(data) {
+				return e.string("[error: invalid JSON]")
+			}
+			e.spend(len(data))
+			return json.RawMessage(data)
+		case error:
+			text, err := safeCall(func() ([]byte, error) { return []byte(m.Error()), nil })
+			if err != nil {
+				return e.string(fmt.Sprintf("[error: %v]", err))
+			}
+			return e.string(string(text))
+		case encoding.TextMarshaler:
+			text, err := safeCall(m.MarshalText)
+			if err != nil {
+				return e.string(fmt.Sprintf("[error: %v]", err))
+			}
+			return e.string(string(text))
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		e.spend(5)
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.spend(20)
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.spend(20)
+		return v.Uint()
+	case reflect.Float32, reflect.Float64:
+		if s, changed := e.float(v.Float()); changed {
+			return s
+		}
+		return v.Float()
+	case reflect.Complex64, reflect.Complex128:
+		return e.string(fmt.Sprint(v.Complex()))
+	case reflect.String:
+		return e.string(v.String())
+	case reflect.Interface:
+		return e.reflect(v.Elem(), depth)
+	case reflect.Pointer:
+		if marker, ok := e.enter(v.Pointer(), 0); !ok {
+			return marker
+		}
+		defer e.leave()
+		return e.reflect(v.Elem(), depth)
+	case reflect.Struct:
+		out, _ := e.object(safeFields(v, map[string]interface{}{}, e.key), depth)
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			e.spend(4)
+			return nil
+		}
+		if marker, ok := e.enter(v.Pointer(), depth); !ok {
+			return marker
+		}
+		defer e.leave()
+		raw := make(map[string]interface{}, v.Len())
+		iterator := v.MapRange()
+		for iterator.Next() {
+			if value := iterator.Value(); value.CanInterface() {
+				raw[safeKey(iterator.Key())] = value.Interface()
+			}
+		}
+		out, _ := e.object(raw, depth)
+		return out
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice {
+			if v.IsNil() {
+				e.spend(4)
+				return nil
+			}
+			if v.Type().Elem().Kind() == reflect.Uint8 {
+				// byte slices are encoded as base64 by encoding/json
+				return e.string(string(v.Bytes()))
+			}
+			if v.Len() > 0 {
+				if marker, ok := e.enter(v.Pointer(), depth); !ok {
+					return marker
+				}
+				defer e.leave()
+			}
+		}
+		raw := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if item := v.Index(i); item.CanInterface() {
+				raw = append(raw, item.Interface())
+			}
+		}
+		out, _ := e.list(raw, depth)
+		return out
+	}
+	return e.string(fmt.Sprintf("[unsupported %s]", v.Type()))
+}
+
+// A private function used to collect the fields of a struct the way encoding/json names them
+// Fields of embedded structs are promoted unless a field with the same name already exists, fields tagged with RedactTag are redacted
+func safeFields(v reflect.Value, out map[string]interface{}, key []byte) map[string]interface{} {
+	t := v.Type()
+	var embedded []reflect.Value
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		value := v.Field(i)
+		if field.Anonymous && name == "" {
+			if value.Kind() == reflect.Pointer {
+				if value.IsNil() {
+					continue
+				}
+				value = value.Elem()
+			}
+			if value.Kind() == reflect.Struct {
+				embedded = append(embedded, value)
+				continue
+			}
+		}
+		if !field.IsExported() || !value.CanInterface() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.Contains(","+options+",", ",omitempty,") && safeEmpty(value) {
+			continue
+		}
+		if redact, action, _ := strings.Cut(field.Tag.Get(RedactTag), ","); redact == "redact" {
+			switch action {
+			case RedactDrop:
+				continue
+			case RedactHash:
+				out[name] = hashValue(key, fmt.Sprint(value.Interface()))
+			default:
+				out[name] = RedactedValue
+			}
+			continue
+		}
+		out[name] = value.Interface()
+	}
+
+	// fields of the outer struct take precedence over promoted fields
+	for _, value := range embedded {
+		promoted := safeFields(value, map[string]interface{}{}, key)
+		for name, field := range promoted {
+			if _, ok := out[name]; !ok {
+				out[name] = field
+			}
+		}
+	}
+	return out
+}
+
+// A private function used to check if a value is omitted by the omitempty option of encoding/json
+func safeEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+// A private function used to render a map key the way encoding/json renders it
+func safeKey(key reflect.Value) string {
+	if key.Kind() == reflect.String {
+		return key.String()
+	}
+	if m, ok := key.Interface().(encoding.TextMarshaler); ok {
+		if text, err := safeCall(m.MarshalText); err == nil {
+			return string(text)
+		}
+	}
+	switch key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10)
+	}
+	return fmt.Sprint(key.Interface())
+}
+
+// A private function used to resolve a lazy value, turning a panic into an error
+func safeResolve(f func() interface{}) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f(), nil
+}
+
+// A private function used to call a method of a logged value, turning a panic into an error
+func safeCall(f func() ([]byte, error)) (data []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f()
+}
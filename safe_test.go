@@ -0,0 +1,78 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLimitsTruncateString(t *testing.T) {
+	// the marker of 23 truncated bytes is 23 bytes long as well, so the length doesn't change
+	value := strings.Repeat("a", 33)
+	log := Limits{MaxString: 10}.Apply(Log{Meta: M{"value": value, "list": []interface{}{value}}})
+
+	expected := strings.Repeat("a", 10) + "…[truncated 23 bytes]"
+	if log.Meta["value"] != expected {
+		t.Errorf("meta value is %q, expected %q", log.Meta["value"], expected)
+	}
+	if list, _ := log.Meta["list"].([]interface{}); len(list) != 1 || list[0] != expected {
+		t.Errorf("list value is %v, expected %q", log.Meta["list"], expected)
+	}
+}
+
+func TestLazyResolvedOnlyWhenEmitted(t *testing.T) {
+	calls := 0
+	value := Lazy(func() interface{} {
+		calls++
+		return M{"rows": 3}
+	})
+	var logged []Log
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, func(log Log) {
+		if log.Category == "jobs.query" {
+			logged = append(logged, log)
+		}
+	})
+
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Debug("query", value)
+	})
+	if calls != 0 {
+		t.Errorf("a suppressed lazy value was resolved %d times", calls)
+	}
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Info("query", M{"result": value})
+	})
+	if calls != 1 {
+		t.Errorf("an emitted lazy value was resolved %d times, expected once", calls)
+	}
+	if len(logged) != 1 {
+		t.Fatalf("expected a single entry but got %d", len(logged))
+	}
+	if result, _ := logged[0].Meta["result"].(M); result == nil || result["rows"] != 3 {
+		t.Errorf("the lazy value wasn't resolved in place: %#v", logged[0].Meta["result"])
+	}
+}
+
+func TestLazyValues(t *testing.T) {
+	cases := []struct {
+		name     string
+		value    interface{}
+		expected interface{}
+	}{
+		{"lazy", Lazy(func() interface{} { return 42 }), 42},
+		{"plain function", func() interface{} { return "text" }, "text"},
+		{"nested", Lazy(func() interface{} { return Lazy(func() interface{} { return true }) }), true},
+		{"nil", Lazy(nil), nil},
+		{"panic", Lazy(func() interface{} { panic("boom") }), "[error: panic: boom]"},
+		{"too deep", Lazy(func() interface{} { return Lazy(func() interface{} { return Lazy(func() interface{} { return 1 }) }) }), "[max depth]"},
+	}
+	for _, c := range cases {
+		log := Limits{MaxDepth: 2}.Apply(Log{Meta: M{"value": c.value}})
+		if log.Meta["value"] != c.expected {
+			t.Errorf("%s: expected %#v but got %#v", c.name, c.expected, log.Meta["value"])
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The meta key used for the target user of an audit event when none is given
+const SiemDefaultTargetKey = "target"
+
+// A public struct used to encode audit log entries as ArcSight Common Event Format (CEF) records
+// Entries of other levels are skipped unless they are listed in Levels
+//
+// - Vendor: The device vendor [NOTE: If empty will use the service client.]
+// - Product: The device product [NOTE: If empty will use the service name.]
+// - Levels: The text levels that are rendered [NOTE: If empty will only render audit, e.g. ["audit", "error", "fatal"].]
+// - TargetKey: The meta key holding the target user, rendered as duser [NOTE: If empty will use "target". The target of an audit event isn't a user and is rendered as cs1.]
+type CefFormatter struct {
+	Vendor    string
+	Product   string
+	Levels    []string
+	TargetKey string
+}
+
+func (f CefFormatter) Format(dst []byte, log Log) ([]byte, error) {
+	if !siemLevel(f.Levels, log.Level) {
+		return dst, nil
+	}
+	record, err := newSiemRecord(log, f.Vendor, f.Product, f.TargetKey)
+	if err != nil {
+		return dst, err
+	}
+
+	// CEF:Version|Device Vendor|Device Product|Device Version|Device Event Class ID|Name|Severity|Extension
+	dst = append(dst, "CEF:0|"...)
+	for _, field := range []string{record.vendor, record.product, record.version, record.event, record.name} {
+		dst = appendCefHeader(dst, field)
+		dst = append(dst, '|')
+	}
+	dst = strconv.AppendInt(dst, int64(cefSeverity(log.Level)), 10)
+	dst = append(dst, '|')
+
+	extensions := [][2]string{
+		{"rt", strconv.FormatInt(log.Time.UnixMilli(), 10)},
+		{"cat", log.Category},
+		{"msg", log.Message},
+		{"suser", log.Chain.Auth.Identifier},
+		{"duser", record.user},
+		{"act", record.action},
+		{"outcome", record.outcome},
+		{"reason", record.reason},
+		{"dvchost", log.Service.Host},
+		{"dvc", record.ipv4},
+		{"c6a1Label", "deviceAddress"},
+		{"c6a1", record.ipv6},
+		{"dvcpid", strconv.Itoa(log.Service.ProcessId)},
+		{"cs1Label", "target"},
+		{"cs1", record.target},
+		{"cs2Label", "chainId"},
+		{"cs2", log.Chain.Id},
+		{"cs3Label", "meta"},
+		{"cs3", record.meta},
+		{"cs4Label", "line"},
+		{"cs4", log.Line},
+		{"cs5Label", "authType"},
+		{"cs5", log.Chain.Auth.Type},
+		{"cs6Label", "stack"},
+		{"cs6", log.Stack},
+	}
+
+	first := true
+	for i, extension := range extensions {
+		if extension[1] == "" || strings.HasSuffix(extension[0], "Label") && extensions[i+1][1] == "" {
+			continue
+		}
+		if !first {
+			dst = append(dst, ' ')
+		}
+		first = false
+		dst = append(dst, extension[0]...)
+		dst = append(dst, '=')
+		dst = appendCefExtension(dst, extension[1])
+	}
+	return append(dst, '\n'), nil
+}
+
+// A public struct used to encode audit log entries as IBM QRadar Log Event Extended Format (LEEF 1.0) records
+// Entries of other levels are skipped unless they are listed in Levels
+//
+// - Vendor: The vendor [NOTE: If empty will use the service client.]
+// - Product: The product [NOTE: If empty will use the service name.]
+// - Levels: The text levels that are rendered [NOTE: If empty will only render audit, e.g. ["audit", "error", "fatal"].]
+// - TargetKey: The meta key holding the target user, rendered as duser [NOTE: If empty will use "target". The target of an audit event isn't a user and is rendered as target.]
+type LeefFormatter struct {
+	Vendor    string
+	Product   string
+	Levels    []string
+	TargetKey string
+}
+
+func (f LeefFormatter) Format(dst []byte, log Log) ([]byte, error) {
+	if !siemLevel(f.Levels, log.Level) {
+		return dst, nil
+	}
+	record, err := newSiemRecord(log, f.Vendor, f.Product, f.TargetKey)
+	if err != nil {
+		return dst, err
+	}
+
+	// LEEF:Version|Vendor|Product|Version|EventID|Attributes (tab delimited)
+	dst = append(dst, "LEEF:1.0|"...)
+	for _, field := range []string{record.vendor, record.product, record.version, record.event} {
+		dst = appendLeefHeader(dst, field)
+		dst = append(dst, '|')
+	}
+
+	attributes := [][2]string{
+		{"devTime", log.Time.UTC().Format("Jan 02 2006 15:04:05.000 MST")},
+		{"devTimeFormat", "MMM dd yyyy HH:mm:ss.SSS z"},
+		{"sev", strconv.Itoa(leefSeverity(log.Level))},
+		{"cat", log.Category},
+		{"msg", log.Message},
+		{"usrName", log.Chain.Auth.Identifier},
+		{"authType", log.Chain.Auth.Type},
+		{"duser", record.user},
+		{"target", record.target},
+		{"action", record.action},
+		{"outcome", record.outcome},
+		{"reason", record.reason},
+		{"identHostName", log.Service.Host},
+		{"src", record.ip()},
+		{"pid", strconv.Itoa(log.Service.ProcessId)},
+		{"chainId", log.Chain.Id},
+		{"meta", record.meta},
+		{"line", log.Line},
+		{"stack", log.Stack},
+	}
+
+	first := true
+	for _, attribute := range attributes {
+		if attribute[1] == "" {
+			continue
+		}
+		if !first {
+			dst = append(dst, '\t')
+		}
+		first = false
+		dst = append(dst, attribute[0]...)
+		dst = append(dst, '=')
+		dst = appendLeefAttribute(dst, attribute[1])
+	}
+	return append(dst, '\n'), nil
+}
+
+// A private struct to encapsulate the values shared by CEF and LEEF records
+//
+// - user: The target user, see CefFormatter.TargetKey
+// - target: The target of the audit event, e.g. "order/42"
+// - ipv4, ipv6: The first IPv4 and IPv6 address of the host that isn't a loopback address
+type siemRecord struct {
+	vendor  string
+	product string
+	version string
+	event   string
+	name    string
+	user    string
+	target  string
+	action  string
+	outcome string
+	reason  string
+	ipv4    string
+	ipv6    string
+	meta    string
+}
+
+// ip returns the address of the host, preferring IPv4
+func (r siemRecord) ip() string {
+	if r.ipv4 != "" {
+		return r.ipv4
+	}
+	return r.ipv6
+}
+
+// A private function used to collect the values shared by CEF and LEEF records
+func newSiemRecord(log Log, vendor, product, targetKey string) (siemRecord, error) {
+	record := siemRecord{
+		vendor:  vendor,
+		product: product,
+		version: log.Commit.Hash,
+		event:   log.Category,
+		name:    log.Message,
+	}
+	if record.vendor == "" {
+		record.vendor = log.Service.Client
+	}
+	if record.product == "" {
+		record.product = log.Service.Service
+	}
+	if record.name == "" {
+		record.name = log.Category
+	}
+	for _, address := range log.Service.HostIps {
+		ip := net.ParseIP(address)
+		switch {
+		case ip == nil || ip.IsLoopback():
+		case ip.To4() != nil && record.ipv4 == "":
+			record.ipv4 = ip.String()
+		case ip.To4() == nil && record.ipv6 == "":
+			record.ipv6 = ip.String()
+		}
+	}
+
+	record.action, record.target, record.outcome, record.reason = auditFields(log)
+
+	if targetKey == "" {
+		targetKey = SiemDefaultTargetKey
+	}
+	meta := log.Meta
+	if target, ok := log.Meta[targetKey]; ok {
+		record.user = fmt.Sprint(target)
+		meta = make(M, len(log.Meta))
+		for key, value := range log.Meta {
+			if key != targetKey {
+				meta[key] = value
+			}
+		}
+	}
+	if len(meta) > 0 {
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return record, err
+		}
+		record.meta = string(data)
+	}
+	return record, nil
+}
+
+// A private function used to check if a log level should be rendered to a SIEM
+func siemLevel(levels []string, level string) bool {
+	if len(levels) == 0 {
+		return level == TextLevelAudit
+	}
+	for _, l := range levels {
+		if strings.EqualFold(l, level) {
+			return true
+		}
+	}
+	return false
+}
+
+// A private function used to map a diary level onto the CEF severity scale of 0 - 10
+func cefSeverity(level string) int {
+	switch logLevel(level) {
+	case LevelTrace:
+		return 0
+	case LevelDebug:
+		return 1
+	case LevelInfo:
+		return 2
+	case LevelNotice, LevelAudit:
+		return 3
+	case LevelWarning:
+		return 5
+	case LevelError:
+		return 7
+	case LevelFatal:
+		return 10
+	}
+	return 0
+}
+
+// A private function used to map a diary level onto the LEEF severity scale of 1 - 10
+func leefSeverity(level string) int {
+	if severity := cefSeverity(level); severity > 0 {
+		return severity
+	}
+	return 1
+}
+
+// A private function used to append a CEF header field, pipes and backslashes are escaped and line breaks are not allowed
+func appendCefHeader(dst []byte, value string) []byte {
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\', '|':
+			dst = append(dst, '\\', c)
+		case '\r', '\n':
+			dst = append(dst, ' ')
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+// A private function used to append a CEF extension value, backslashes, equal signs and line breaks are escaped
+func appendCefExtension(dst []byte, value string) []byte {
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\', '=':
+			dst = append(dst, '\\', c)
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+// A private function used to append a LEEF header field, pipes and backslashes are escaped and line breaks are not allowed
+func appendLeefHeader(dst []byte, value string) []byte {
+	return appendCefHeader(dst, value)
+}
+
+// A private function used to append a LEEF attribute value, backslashes, the tab delimiter and line breaks are escaped
+func appendLeefAttribute(dst []byte, value string) []byte {
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\':
+			dst = append(dst, '\\', '\\')
+		case '\t':
+			dst = append(dst, '\\', 't')
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+// A private function used to create handler factories for CEF and LEEF output
+//
+// Options:
+// - vendor, product, targetKey: See CefFormatter and LeefFormatter (may be empty)
+// - levels: The text levels that are rendered (may be empty)
+// - output, path: See formatterHandler
+func siemHandler(leef bool) HandlerFactory {
+	return func(options M) (H, error) {
+		options = copyOptions(options)
+		var vendor, product, targetKey string
+		var levels []string
+		for key, target := range map[string]*string{"vendor": &vendor, "product": &product, "targetKey": &targetKey} {
+			if value, ok := options[key]; ok {
+				if *target, ok = value.(string); !ok {
+					return nil, fmt.Errorf("%s must be a string", key)
+				}
+				delete(options, key)
+			}
+		}
+		if value, ok := options["levels"]; ok {
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("levels must be a list of levels")
+			}
+			for _, level := range list {
+				levels = append(levels, fmt.Sprint(level))
+			}
+			delete(options, "levels")
+		}
+
+		if leef {
+			return formatterHandler(LeefFormatter{Vendor: vendor, Product: product, Levels: levels, TargetKey: targetKey})(options)
+		}
+		return formatterHandler(CefFormatter{Vendor: vendor, Product: product, Levels: levels, TargetKey: targetKey})(options)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSiemEscaping(t *testing.T) {
+	cases := []struct {
+		name   string
+		escape func(dst []byte, value string) []byte
+		input  string
+		output string
+	}{
+		{"cef header pipe", appendCefHeader, "a|b", `a\|b`},
+		{"cef header backslash", appendCefHeader, `a\b`, `a\\b`},
+		{"cef header equals", appendCefHeader, "a=b", "a=b"},
+		{"cef header newline", appendCefHeader, "a\r\nb", "a  b"},
+		{"cef extension pipe", appendCefExtension, "a|b", "a|b"},
+		{"cef extension backslash", appendCefExtension, `a\b`, `a\\b`},
+		{"cef extension equals", appendCefExtension, "a=b", `a\=b`},
+		{"cef extension newline", appendCefExtension, "a\r\nb", `a\r\nb`},
+		{"leef header pipe", appendLeefHeader, "a|b", `a\|b`},
+		{"leef header backslash", appendLeefHeader, `a\b`, `a\\b`},
+		{"leef header newline", appendLeefHeader, "a\nb", "a b"},
+		{"leef attribute pipe", appendLeefAttribute, "a|b", "a|b"},
+		{"leef attribute backslash", appendLeefAttribute, `a\b`, `a\\b`},
+		{"leef attribute equals", appendLeefAttribute, "a=b", "a=b"},
+		{"leef attribute tab", appendLeefAttribute, "a\tb", `a\tb`},
+		{"leef attribute newline", appendLeefAttribute, "a\r\nb", `a\r\nb`},
+	}
+	for _, c := range cases {
+		if output := string(c.escape(nil, c.input)); output != c.output {
+			t.Errorf("%s: %q escaped as %q, expected %q", c.name, c.input, output, c.output)
+		}
+	}
+}
+
+// siemLog returns an audit entry with values that need escaping
+func siemLog() Log {
+	return Log{
+		Service:  Service{Client: "up|rate", Service: "api", Host: "web-1", HostIps: []string{"127.0.0.1", "fd00::2", "10.0.0.1"}, ProcessId: 42},
+		Commit:   Commit{Hash: "abc123"},
+		Chain:    Chain{Id: "chain-1", Auth: Auth{Type: "user", Identifier: "42"}},
+		Level:    TextLevelAudit,
+		Category: "orders",
+		Line:     "/app/orders.go:12",
+		Message:  "a=b\nc",
+		Meta:     M{"target": "17", "note": `x\y`},
+		Time:     time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC),
+	}
+}
+
+func TestCefFormatter(t *testing.T) {
+	out, err := CefFormatter{}.Format(nil, siemLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := string(out)
+	for _, expected := range []string{
+		`CEF:0|up\|rate|api|abc123|orders|a=b c|3|`,
+		` msg=a\=b\nc `,
+		` suser=42 `,
+		` duser=17 `,
+		` dvc=10.0.0.1 `,
+		` c6a1Label=deviceAddress c6a1=fd00::2 `,
+		` cs2Label=chainId cs2=chain-1 `,
+		` cs3Label=meta cs3={"note":"x\\\\y"} `,
+		` cs5Label=authType cs5=user`,
+	} {
+		if !strings.Contains(record, expected) {
+			t.Errorf("%q not found in %s", expected, record)
+		}
+	}
+	if strings.Contains(record, "spriv=") || strings.Contains(record, "cs1Label") {
+		t.Errorf("unexpected field in %s", record)
+	}
+	if strings.Count(record, "\n") != 1 || !strings.HasSuffix(record, "\n") {
+		t.Errorf("expected a single line: %q", record)
+	}
+}
+
+func TestLeefFormatter(t *testing.T) {
+	out, err := LeefFormatter{}.Format(nil, siemLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := string(out)
+	if !strings.HasPrefix(record, `LEEF:1.0|up\|rate|api|abc123|orders|`) {
+		t.Errorf("unexpected header in %s", record)
+	}
+	attributes := map[string]string{}
+	_, body, _ := strings.Cut(record, "|orders|")
+	for _, attribute := range strings.Split(strings.TrimSuffix(body, "\n"), "\t") {
+		key, value, _ := strings.Cut(attribute, "=")
+		if _, ok := attributes[key]; ok {
+			t.Errorf("%s is rendered twice", key)
+		}
+		attributes[key] = value
+	}
+	for key, expected := range map[string]string{"usrName": "42", "authType": "user", "duser": "17", "src": "10.0.0.1", "msg": `a=b\nc`, "meta": `{"note":"x\\\\y"}`} {
+		if attributes[key] != expected {
+			t.Errorf("%s: expected %q but got %q", key, expected, attributes[key])
+		}
+	}
+	if _, ok := attributes["suser"]; ok {
+		t.Errorf("the identifier is rendered as suser as well: %s", record)
+	}
+}
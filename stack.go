@@ -0,0 +1,157 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A public struct to encapsulate a single frame of a stack trace
+//
+// - Module: The path of the Go module the function belongs to (may be empty) [NOTE: Empty for the standard library and binaries built without module support.]
+// - Version: The version of the module (may be empty), e.g. "v1.2.3" or "(devel)" for the main module
+type Frame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Module   string `json:"module,omitempty"`
+	Version  string `json:"version,omitempty"`
+}
+
+// The import path of this package, its frames are trimmed from stack traces
+var diaryPackage = reflect.TypeOf(page{}).PkgPath()
+
+// A private struct used to map a package to the module that provides it
+type buildModule struct {
+	path    string
+	version string
+}
+
+// A private cache of the modules of the binary, see frameModule
+var buildModules struct {
+	sync.Once
+	main    buildModule
+	modules []buildModule
+}
+
+// A private function used to capture the stack of the caller as frames, see framesOf
+//
+// - max: The most frames kept [NOTE: If negative all frames are kept.]
+func callerFrames(max int) []Frame {
+	pcs := make([]uintptr, 64)
+	for {
+		n := runtime.Callers(1, pcs)
+		if n < len(pcs) || len(pcs) >= 4096 {
+			return framesOf(pcs[:n], max)
+		}
+		pcs = make([]uintptr, len(pcs)*2)
+	}
+}
+
+// A private function used to resolve program counters into frames
+// Frames of this package and of the runtime are left out, so that the first frame is the code that logged or panicked
+//
+// - max: The most frames kept [NOTE: If negative all frames are kept.]
+func framesOf(pcs []uintptr, max int) []Frame {
+	if len(pcs) == 0 || max == 0 {
+		return nil
+	}
+	frames := make([]Frame, 0, 16)
+	resolved := runtime.CallersFrames(pcs)
+	for {
+		frame, more := resolved.Next()
+		if frame.Function != "" && !internalFunction(frame.Function) {
+			module := frameModule(framePackage(frame.Function))
+			frames = append(frames, Frame{
+				Function: frame.Function,
+				File:     frame.File,
+				Line:     frame.Line,
+				Module:   module.path,
+				Version:  module.version,
+			})
+			if max > 0 && len(frames) >= max {
+				break
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return frames
+}
+
+// A private function used to check if a function belongs to this package or the runtime
+func internalFunction(function string) bool {
+	pkg := framePackage(function)
+	return pkg == diaryPackage || pkg == "runtime" || strings.HasPrefix(pkg, "runtime/")
+}
+
+// A private function used to read the import path from a fully qualified function name, e.g. "github.com/a/b.(*T).Method"
+// The runtime escapes the dots of the last path element, e.g. "gopkg.in/yaml%2ev3.Unmarshal", so they're unescaped
+func framePackage(function string) string {
+	slash := strings.LastIndex(function, "/")
+	dot := strings.Index(function[slash+1:], ".")
+	if dot < 0 {
+		return function
+	}
+	return strings.ReplaceAll(function[:slash+1+dot], "%2e", ".")
+}
+
+// A private function used to find the module that provides a package, using the build info of the binary
+func frameModule(pkg string) buildModule {
+	buildModules.Do(func() {
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		buildModules.main = buildModule{path: info.Main.Path, version: info.Main.Version}
+		buildModules.modules = append(buildModules.modules, buildModules.main)
+		for _, dep := range info.Deps {
+			// packages keep the import path of the module they replace
+			module := buildModule{path: dep.Path, version: dep.Version}
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				module.version = dep.Replace.Version
+			}
+			buildModules.modules = append(buildModules.modules, module)
+		}
+	})
+
+	if pkg == "main" {
+		return buildModules.main
+	}
+	var found buildModule
+	for _, module := range buildModules.modules {
+		if module.path == "" || len(module.path) <= len(found.path) {
+			continue
+		}
+		if pkg == module.path || strings.HasPrefix(pkg, module.path+"/") {
+			found = module
+		}
+	}
+	return found
+}
+
+// A private function used to render frames in the format of debug.Stack, without the goroutine header and arguments
+// This is the legacy string form of a stack, used by Log.Stack
+func renderFrames(frames []Frame) string {
+	if len(frames) == 0 {
+		return ""
+	}
+	var builder strings.Builder
+	for _, frame := range frames {
+		builder.WriteString(frame.Function)
+		builder.WriteString("(...)\n\t")
+		builder.WriteString(frame.File)
+		builder.WriteString(":")
+		builder.WriteString(strconv.Itoa(frame.Line))
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestFramePackage(t *testing.T) {
+	cases := map[string]string{
+		"main.main":                               "main",
+		"runtime.gopark":                          "runtime",
+		"net/http.(*conn).serve":                  "net/http",
+		"github.com/a/b.(*T).Method":              "github.com/a/b",
+		"github.com/a/b.run.func1":                "github.com/a/b",
+		"gopkg.in/yaml%2ev3.(*decoder).unmarshal": "gopkg.in/yaml.v3",
+		"gopkg.in/yaml%2ev3.Unmarshal":            "gopkg.in/yaml.v3",
+	}
+	for function, expected := range cases {
+		if pkg := framePackage(function); pkg != expected {
+			t.Errorf("%s: expected package %q but got %q", function, expected, pkg)
+		}
+	}
+}
+
+// A private value that captures the frames of the decoder calling it
+type yamlCapture struct {
+	frames []Frame
+}
+
+func (c *yamlCapture) UnmarshalYAML(value *yaml.Node) error {
+	c.frames = callerFrames(-1)
+	return nil
+}
+
+func TestFramesOfDependency(t *testing.T) {
+	capture := &yamlCapture{}
+	if err := yaml.Unmarshal([]byte("a: 1"), capture); err != nil {
+		t.Fatal(err)
+	}
+	if len(capture.frames) == 0 {
+		t.Fatalf("no frames captured")
+	}
+
+	// the frames of diary are left out, so the first frame is the decoder
+	first := capture.frames[0]
+	if framePackage(first.Function) != "gopkg.in/yaml.v3" || first.Module != "gopkg.in/yaml.v3" || !strings.HasPrefix(first.Version, "v3.") {
+		t.Errorf("unexpected first frame %+v", first)
+	}
+	if first.Line <= 0 || !strings.HasSuffix(first.File, ".go") {
+		t.Errorf("unexpected location of the first frame %+v", first)
+	}
+	for _, frame := range capture.frames {
+		if internalFunction(frame.Function) {
+			t.Errorf("internal frame %s wasn't left out", frame.Function)
+		}
+	}
+}
+
+func TestFramesOfLimits(t *testing.T) {
+	pcs := make([]uintptr, 32)
+	pcs = pcs[:runtime.Callers(0, pcs)]
+	all := framesOf(pcs, -1)
+	if len(all) == 0 || all[0].Function != "testing.tRunner" || all[0].Module != "" {
+		t.Fatalf("expected the test runner as the first frame outside of diary and the runtime, got %+v", all)
+	}
+	if frames := framesOf(pcs, 1); len(frames) != 1 || frames[0] != all[0] {
+		t.Errorf("expected a single frame but got %+v", frames)
+	}
+	if frames := framesOf(pcs, 0); frames != nil {
+		t.Errorf("expected no frames but got %+v", frames)
+	}
+}
+
+func TestRenderFrames(t *testing.T) {
+	frames := []Frame{
+		{Function: "main.main", File: "/app/main.go", Line: 12},
+		{Function: "github.com/a/b.(*T).Run", File: "/go/b/t.go", Line: 7, Module: "github.com/a/b", Version: "v1.0.0"},
+	}
+	expected := "main.main(...)\n\t/app/main.go:12\ngithub.com/a/b.(*T).Run(...)\n\t/go/b/t.go:7\n"
+	if stack := renderFrames(frames); stack != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, stack)
+	}
+	if stack := renderFrames(nil); stack != "" {
+		t.Errorf("expected an empty stack but got %q", stack)
+	}
+}
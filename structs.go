@@ -51,7 +51,16 @@ type Log struct {
 	Category string `json:"category"`
 	Line string `json:"line"`
 	Stack string `json:"stack"`
+	Frames []Frame `json:"frames,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
 	Message string `json:"message"`
+	Template string `json:"template,omitempty"`
 	Meta M `json:"meta"`
 	Time time.Time `json:"time"`
+
+	// the encoded service and commit details of the diary instance, see jsonFragment
+	static *jsonFragment
+	// the failure installed by the guard of the handler, see ReportFailure
+	failure *handlerFailure
+	generation uint64
 }
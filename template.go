@@ -0,0 +1,101 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A private function used to render the message of the formatted page methods, e.g. Infof
+// Formats with "{name}" placeholders are message templates, every placeholder is replaced by the next argument and captured into the returned fields by its name
+// Formats without placeholders are rendered with fmt.Sprintf and return no fields
+// [NOTE: Within a message template "{{" and "}}" are used for literal braces and fmt verbs are left as is.]
+func renderMessage(format string, args []interface{}) (string, M) {
+	if !isTemplate(format) {
+		return fmt.Sprintf(format, args...), nil
+	}
+
+	var builder strings.Builder
+	fields := make(M, len(args))
+	next := 0
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if (c == '{' || c == '}') && i+1 < len(format) && format[i+1] == c {
+			builder.WriteByte(c)
+			i++
+			continue
+		}
+		if c == '{' {
+			if end := placeholderEnd(format, i); end > 0 {
+				if next < len(args) {
+					// the first placeholder with a name wins so the fields match the order of the message
+					name := format[i+1 : end]
+					if _, ok := fields[name]; !ok {
+						fields[name] = args[next]
+					}
+					fmt.Fprint(&builder, args[next])
+					next++
+				} else {
+					builder.WriteString("%!(MISSING " + format[i+1:end] + ")")
+				}
+				i = end
+				continue
+			}
+		}
+		builder.WriteByte(c)
+	}
+
+	if next < len(args) {
+		// report unused arguments the same way fmt does
+		builder.WriteString("%!(EXTRA ")
+		for i, arg := range args[next:] {
+			if i > 0 {
+				builder.WriteString(", ")
+			}
+			fmt.Fprintf(&builder, "%T=%v", arg, arg)
+		}
+		builder.WriteString(")")
+	}
+	return builder.String(), fields
+}
+
+// A private function used to check if a format contains at least one "{name}" placeholder
+func isTemplate(format string) bool {
+	for i := 0; i < len(format); i++ {
+		switch format[i] {
+		case '{':
+			if i+1 < len(format) && format[i+1] == '{' {
+				i++
+				continue
+			}
+			if placeholderEnd(format, i) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A private function used to find the closing brace of the placeholder starting at the given index
+// Placeholder names are made of letters, digits, "_", "-" and "."
+//
+// - return: The index of the closing brace [NOTE: If the brace doesn't start a placeholder will be 0.]
+func placeholderEnd(format string, start int) int {
+	for i := start + 1; i < len(format); i++ {
+		c := format[i]
+		switch {
+		case c == '}':
+			if i == start+1 {
+				return 0
+			}
+			return i
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-', c == '.':
+		default:
+			return 0
+		}
+	}
+	return 0
+}
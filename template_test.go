@@ -0,0 +1,63 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRenderMessage(t *testing.T) {
+	cases := []struct {
+		name    string
+		format  string
+		args    []interface{}
+		message string
+		fields  M
+	}{
+		{"template", "order {id} failed", []interface{}{7}, "order 7 failed", M{"id": 7}},
+		{"dotted name", "user {user.name} left", []interface{}{"jo"}, "user jo left", M{"user.name": "jo"}},
+		{"escaped braces", "{{literal}} {id} }}", []interface{}{1}, "{literal} 1 }", M{"id": 1}},
+		{"escaped placeholder", "{{id}} is {id}", []interface{}{2}, "{id} is 2", M{"id": 2}},
+		{"empty braces", "{} {id}", []interface{}{3}, "{} 3", M{"id": 3}},
+		{"verbs left as is", "100%d {id}", []interface{}{4}, "100%d 4", M{"id": 4}},
+		{"repeated name", "{a} then {a}", []interface{}{1, 2}, "1 then 2", M{"a": 1}},
+		{"missing", "{a} and {b}", []interface{}{1}, "1 and %!(MISSING b)", M{"a": 1}},
+		{"extra", "{a}", []interface{}{1, "x", 2.5}, "1%!(EXTRA string=x, float64=2.5)", M{"a": 1}},
+		{"fmt format", "plain %d", []interface{}{5}, "plain 5", nil},
+		{"fmt format with escapes", "plain {{}} %s", []interface{}{"x"}, "plain {{}} x", nil},
+		{"no placeholder", "{bad name}", nil, "{bad name}", nil},
+	}
+	for _, c := range cases {
+		message, fields := renderMessage(c.format, c.args)
+		if message != c.message {
+			t.Errorf("%s: %q rendered as %q, expected %q", c.name, c.format, message, c.message)
+		}
+		if !reflect.DeepEqual(fields, c.fields) {
+			t.Errorf("%s: %q captured %v, expected %v", c.name, c.format, fields, c.fields)
+		}
+	}
+}
+
+func TestFormattedPageMethods(t *testing.T) {
+	recorder := &logRecorder{}
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelInfo, recorder.handler)
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.(IPageV2).With(M{"id": "bound"}).Infof("paid", "order {id} paid {{in full}}", 7)
+		p.(IPageV2).Warningf("late", "retry %d of %d", 2, 3)
+	})
+
+	paid := recorder.find("jobs.paid", "order 7 paid {in full}")
+	if len(paid) != 1 {
+		t.Fatalf("expected a single entry but got %d", len(paid))
+	}
+	if paid[0].Template != "order {id} paid {{in full}}" || paid[0].Meta["id"] != 7 {
+		t.Errorf("unexpected template %q and meta %v", paid[0].Template, paid[0].Meta)
+	}
+	late := recorder.find("jobs.late", "retry 2 of 3")
+	if len(late) != 1 || late[0].Template != "retry %d of %d" || len(late[0].Meta) != 0 {
+		t.Errorf("unexpected fmt entry %+v", late)
+	}
+}
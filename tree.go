@@ -0,0 +1,251 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The time a page is buffered for when none is given
+const TreeDefaultTimeout = 30 * time.Second
+
+// The number of log entries and scopes a page is buffered with at most, the page is written once it's reached and the rest of it is rendered as a new tree
+const TreeMaxEntries = 1000
+
+// A private struct to encapsulate a scope of a page, opened by a trace enter and closed by a trace exit
+type treeScope struct {
+	category string
+	line     string
+	enter    time.Time
+	exit     time.Time
+	entries  []treeEntry
+}
+
+// A private struct to encapsulate either a log entry or a nested scope of a page
+type treeEntry struct {
+	log   *Log
+	scope *treeScope
+}
+
+// A private struct to encapsulate the logs of a single page while it's being buffered
+//
+// - entries: The number of log entries and scopes buffered, see TreeMaxEntries
+type treeChain struct {
+	id      string
+	root    *treeScope
+	open    []*treeScope
+	entries int
+	timer   *time.Timer
+}
+
+// A public struct to encapsulate a handler for local development that groups log entries by page
+// Each page is rendered as an indented tree of its scopes, with their durations and the logs emitted in each scope
+// A page is written once its root scope exits, once the timeout passes for pages that aren't traced, or once it reaches TreeMaxEntries
+type Tree struct {
+	mutex      sync.Mutex
+	chains     map[string]*treeChain
+	w          io.Writer
+	formatter  ConsoleFormatter
+	timeout    time.Duration
+	maxEntries int
+}
+
+// NewTree returns a tree handler writing to the given writer, register it with IDiaryV2.Manage so that the pages still buffered are written by Flush and Close
+//
+// - timeout: How long a page is buffered for at most [NOTE: If zero or less will use TreeDefaultTimeout.]
+func NewTree(w io.Writer, timeout time.Duration) *Tree {
+	if w == nil {
+		panic("writer must be defined")
+	}
+	if timeout <= 0 {
+		timeout = TreeDefaultTimeout
+	}
+	return &Tree{
+		chains: map[string]*treeChain{},
+		w:      w,
+		formatter: ConsoleFormatter{
+			Color:      colorEnabled(w, ColorAuto),
+			Root:       moduleRoot(),
+			InlineMeta: true,
+		},
+		timeout:    timeout,
+		maxEntries: TreeMaxEntries,
+	}
+}
+
+// Handle adds the log entry to the tree of its page
+func (t *Tree) Handle(log Log) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	chain, ok := t.chains[log.Chain.Id]
+	if !ok {
+		chain = &treeChain{id: log.Chain.Id, root: &treeScope{}}
+		chain.timer = time.AfterFunc(t.timeout, func() {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if t.chains[chain.id] == chain {
+				t.flush(chain, "timed out")
+			}
+		})
+		t.chains[log.Chain.Id] = chain
+	}
+
+	switch log.Level {
+	case TextLevelTraceEnter:
+		scope := &treeScope{category: log.Category, line: log.Line, enter: log.Time}
+		parent := chain.parent(log.Category)
+		parent.entries = append(parent.entries, treeEntry{scope: scope})
+		chain.open = append(chain.open, scope)
+		chain.entries++
+	case TextLevelTraceExit:
+		for i := len(chain.open) - 1; i >= 0; i-- {
+			if chain.open[i].category == log.Category {
+				chain.open[i].exit = log.Time
+				chain.open = append(chain.open[:i], chain.open[i+1:]...)
+				break
+			}
+		}
+		if len(chain.open) == 0 {
+			chain.timer.Stop()
+			t.flush(chain, "")
+		}
+	default:
+		parent := chain.parent(log.Category)
+		parent.entries = append(parent.entries, treeEntry{log: &log})
+		chain.entries++
+	}
+	if chain.entries >= t.maxEntries && t.chains[chain.id] == chain {
+		chain.timer.Stop()
+		t.flush(chain, "entry limit reached")
+	}
+}
+
+// parent returns the deepest open scope that the category belongs to
+func (c *treeChain) parent(category string) *treeScope {
+	for i := len(c.open) - 1; i >= 0; i-- {
+		if matchCategory(c.open[i].category, category) {
+			return c.open[i]
+		}
+	}
+	if len(c.open) > 0 {
+		return c.open[len(c.open)-1]
+	}
+	return c.root
+}
+
+// flush writes the tree of the page and forgets about it
+//
+// - note: Why the page is written before its root scope exited (may be empty), e.g. "timed out"
+func (t *Tree) flush(chain *treeChain, note string) {
+	delete(t.chains, chain.id)
+	if len(chain.root.entries) == 0 {
+		// e.g. the trace exit of a page that was already flushed
+		return
+	}
+
+	var dst []byte
+	header := fmt.Sprintf("── page %s ", chain.id)
+	if note != "" {
+		header += "(" + note + ") "
+	}
+	dst = t.formatter.paint(dst, "90", header+strings.Repeat("─", 40))
+	dst = append(dst, '\n')
+	dst = t.render(dst, chain.root, 0)
+	_, _ = t.w.Write(dst)
+}
+
+// Flush writes the pages that are still being buffered, see Flusher
+func (t *Tree) Flush(ctx context.Context) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, chain := range t.chains {
+		chain.timer.Stop()
+		t.flush(chain, "flushed")
+	}
+	return nil
+}
+
+// render appends the entries of the scope, indented by their depth
+func (t *Tree) render(dst []byte, scope *treeScope, depth int) []byte {
+	indent := strings.Repeat("  ", depth)
+	for _, entry := range scope.entries {
+		if entry.scope != nil {
+			child := entry.scope
+			duration := "running"
+			if !child.exit.IsZero() {
+				duration = child.exit.Sub(child.enter).String()
+			}
+			dst = append(dst, indent...)
+			dst = t.formatter.paint(dst, "1", "▸ "+child.category)
+			dst = append(dst, ' ')
+			dst = t.formatter.paint(dst, "90", fmt.Sprintf("(%s) %s", duration, shortenPath(t.formatter.Root, child.line)))
+			dst = append(dst, '\n')
+			dst = t.render(dst, child, depth+1)
+			continue
+		}
+
+		log := entry.log
+		dst = append(dst, indent...)
+		dst = t.formatter.paint(dst, "90", log.Time.Format("15:04:05.000"))
+		dst = append(dst, ' ')
+		dst = t.formatter.paint(dst, levelColor(log.Level), fmt.Sprintf("%-7s", strings.ToUpper(log.Level)))
+		dst = append(dst, ' ')
+		dst = append(dst, log.Category...)
+		if log.Message != "" {
+			dst = append(dst, ' ')
+			dst = t.formatter.paint(dst, levelColor(log.Level), log.Message)
+		}
+		e := logfmtEncoder{dst: dst}
+		for _, key := range sortedKeys(log.Meta) {
+			e.value(logfmtKey(key), log.Meta[key])
+		}
+		dst = append(e.dst, ' ')
+		dst = t.formatter.paint(dst, "90", shortenPath(t.formatter.Root, log.Line))
+		dst = append(dst, '\n')
+		if strings.TrimSpace(log.Stack) != "" {
+			for _, frame := range strings.Split(strings.TrimSuffix(log.Stack, "\n"), "\n") {
+				dst = append(dst, indent...)
+				dst = append(dst, "  "...)
+				dst = t.formatter.paint(dst, "90", frame)
+				dst = append(dst, '\n')
+			}
+		}
+	}
+	return dst
+}
+
+// A private function used to create a handler factory for tree output
+//
+// Options:
+// - timeout: How long a page is buffered for at most, e.g. "10s" (may be empty)
+// - output, path: See formatterHandler
+func treeHandlerFactory(options M) (H, error) {
+	options = copyOptions(options)
+	timeout := time.Duration(0)
+	if value, ok := options["timeout"]; ok {
+		text, _ := value.(string)
+		var err error
+		if timeout, err = time.ParseDuration(text); err != nil {
+			return nil, fmt.Errorf("timeout must be a duration, e.g. \"10s\"")
+		}
+		delete(options, "timeout")
+	}
+	w, err := outputOption(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := unknownOptions(options); err != nil {
+		return nil, err
+	}
+	t := NewTree(w, timeout)
+	manage(t)
+	return t.Handle, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 The Uprate Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package diary
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// treeLines returns the rendered lines without their times, durations and source lines
+func treeLines(output string) []string {
+	volatile := regexp.MustCompile(`\d\d:\d\d:\d\d\.\d{3} |\([^)]*\) .*$| \S+\.go:\d+$|page \S+ `)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		lines = append(lines, strings.TrimRight(volatile.ReplaceAllString(line, ""), " ─"))
+	}
+	return lines
+}
+
+func TestTreeNestedPage(t *testing.T) {
+	output := &bytes.Buffer{}
+	tree := NewTree(output, time.Hour)
+	d := Dear("uprate", "diary", "test", nil, "", "", nil, nil, LevelTrace, tree.Handle)
+
+	d.Page(-1, 0, false, "jobs", nil, "", "", nil, func(p IPage) {
+		p.Info("start", nil)
+		p.Scope("db", func(p IPage) {
+			p.Warning("query", "slow", M{"ms": 120})
+			p.Scope("retry", func(p IPage) {
+				p.Info("again", nil)
+			})
+		})
+		p.Notice("done", nil)
+	})
+
+	if !strings.HasPrefix(output.String(), "── page ") {
+		t.Errorf("expected a page header: %s", output)
+	}
+	expected := []string{
+		"",
+		"▸ jobs",
+		"  INFO    jobs.start",
+		"  ▸ jobs.db",
+		"    WARNING jobs.db.query slow ms=120",
+		"    ▸ jobs.db.retry",
+		"      INFO    jobs.db.retry.again",
+		"  NOTICE  jobs.done",
+	}
+	if lines := treeLines(output.String()); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\nbut got\n%s\nfrom\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"), output)
+	}
+}
+
+func TestTreeFlush(t *testing.T) {
+	output := &bytes.Buffer{}
+	tree := NewTree(output, time.Hour)
+
+	// a page whose root scope hasn't exited yet is only written by Flush
+	tree.Handle(Log{Chain: Chain{Id: "chain-1"}, Level: TextLevelTraceEnter, Category: "jobs", Time: time.Now()})
+	tree.Handle(Log{Chain: Chain{Id: "chain-1"}, Level: TextLevelInfo, Category: "jobs.run", Time: time.Now()})
+	if output.Len() != 0 {
+		t.Fatalf("a page whose root scope is open was written early: %s", output)
+	}
+	if err := tree.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "(flushed)") || !strings.Contains(output.String(), "jobs.run") {
+		t.Errorf("the buffered page wasn't written by Flush: %s", output)
+	}
+}
+
+func TestTreeMaxEntries(t *testing.T) {
+	output := &bytes.Buffer{}
+	tree := NewTree(output, time.Hour)
+	tree.maxEntries = 3
+	for i := 0; i < 7; i++ {
+		tree.Handle(Log{Chain: Chain{Id: "chain-1"}, Level: TextLevelInfo, Category: "jobs", Time: time.Now()})
+	}
+	if written := strings.Count(output.String(), "(entry limit reached)"); written != 2 {
+		t.Errorf("expected the page to be written in 2 parts, got %d\n%s", written, output)
+	}
+	if buffered := tree.chains["chain-1"].entries; buffered != 1 {
+		t.Errorf("expected 1 entry left buffered, got %d", buffered)
+	}
+}
@@ -4,7 +4,13 @@ package diary
 type M map[string]interface{}
 
 // A package shorthand for a handler function
+// [NOTE: The meta of a log entry is shared with the caller and other handlers, a handler must copy it before making changes.]
 type H func(log Log)
 
 // A package shorthand for a page scope function
 type S func(p IPage)
+
+// A package shorthand for a meta value that is only computed once the log entry is emitted
+// Values that are filtered out by the level or sampling are never computed, plain func() interface{} values are treated the same way
+// [NOTE: If the function panics the panic is logged as the value instead, e.g. "[error: panic: ...]".]
+type Lazy func() interface{}